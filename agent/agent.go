@@ -74,11 +74,12 @@ func (cf *AgentConfig) Prepare() (daemon.StartFunc, error) {
 	serviceUpdatesReset := make(chan struct{}, 1)
 
 	instanceUpdates := make(chan InstanceUpdate)
-	instanceUpdatesRead := instanceUpdates
+	checkedUpdates := make(chan InstanceUpdate)
+	instanceUpdatesRead := checkedUpdates
 	instanceUpdatesTee := daemon.NullStartFunc
 	if cf.InstanceUpdates != nil {
 		instanceUpdatesRead = make(chan InstanceUpdate)
-		instanceUpdatesTee = Tee(instanceUpdates, cf.InstanceUpdates,
+		instanceUpdatesTee = Tee(checkedUpdates, cf.InstanceUpdates,
 			instanceUpdatesRead)
 	}
 
@@ -94,6 +95,11 @@ func (cf *AgentConfig) Prepare() (daemon.StartFunc, error) {
 		instanceUpdatesReset:  cf.InstanceUpdatesReset,
 	}
 
+	healthChecksConf := healthChecksConfig{
+		instanceUpdates: instanceUpdates,
+		checkedUpdates:  checkedUpdates,
+	}
+
 	setInstConf := setInstancesConfig{
 		hostIP:               cf.hostIP,
 		store:                cf.store,
@@ -108,12 +114,13 @@ func (cf *AgentConfig) Prepare() (daemon.StartFunc, error) {
 					containerUpdates))),
 
 		daemon.Reset(serviceUpdatesReset,
-			daemon.Restart(cf.reconnectInterval,
-				store.WatchServicesStartFunc(cf.store,
-					store.QueryServiceOptions{WithContainerRules: true},
-					serviceUpdates))),
+			store.WatchServicesStartFunc(cf.store,
+				cf.reconnectInterval,
+				store.QueryServiceOptions{WithContainerRules: true},
+				serviceUpdates)),
 
 		daemon.Restart(cf.reconnectInterval, syncInstConf.StartFunc()),
+		daemon.Restart(cf.reconnectInterval, healthChecksConf.StartFunc()),
 		daemon.Restart(cf.reconnectInterval, setInstConf.StartFunc()),
 		instanceUpdatesTee), nil
 }
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"errors"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	docker "github.com/fsouza/go-dockerclient"
@@ -20,6 +21,10 @@ type dockerListener struct {
 	errorSink daemon.ErrorSink
 }
 
+// Docker reports changes in the health of a container with events
+// like "health_status: healthy"
+const healthStatusEvent = "health_status"
+
 // Passed from the readContainerIDs goroutine to the inspectContainers
 // goroutine, via the buffer goroutine
 type containerIDs struct {
@@ -146,11 +151,16 @@ whileListingContainers:
 		}
 
 		var started bool
-		switch ev.Status {
-		case "start":
+		switch {
+		case ev.Status == "start":
 			started = true
-		case "die":
+		case ev.Status == "die":
 			started = false
+		case strings.HasPrefix(ev.Status, healthStatusEvent):
+			// The container's HEALTHCHECK has passed or
+			// failed; inspecting it again picks up its
+			// health
+			started = true
 		default:
 			continue
 		}
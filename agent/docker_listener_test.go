@@ -102,6 +102,17 @@ func (mdc *mockDockerClient) removeContainer(id string, async bool) {
 	})
 }
 
+func (mdc *mockDockerClient) setHealth(id, health string, async bool) {
+	mdc.lock.Lock()
+	defer mdc.lock.Unlock()
+
+	mdc.containers[id].State.Health.Status = health
+	mdc.notify(async, docker.APIEvents{
+		ID:     id,
+		Status: healthStatusEvent + ": " + health,
+	})
+}
+
 // Generate the events for a container coming and going, but so that
 // it is gone by the time it can be inspected
 func (mdc *mockDockerClient) transientContainer(id string, async bool) {
@@ -177,6 +188,13 @@ func TestDockerListener(t *testing.T) {
 	require.Len(t, update.Containers, 1)
 	require.Equal(t, update.Containers["5"].Name, "/qux")
 
+	// A change in health means the container is inspected again
+	mdc.setHealth("5", "healthy", true)
+	update = <-updates
+	require.False(t, update.Reset)
+	require.Len(t, update.Containers, 1)
+	require.Equal(t, "healthy", update.Containers["5"].State.Health.Status)
+
 	dlComp.Stop()
 	require.Empty(t, updates)
 	require.Empty(t, errs)
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/weaveworks/flux/common/daemon"
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+// Checks the health of instances on their way from syncInstances to
+// the store, and sends on updates as instances become healthy or
+// unhealthy.
+type healthChecksConfig struct {
+	instanceUpdates <-chan InstanceUpdate
+	checkedUpdates  chan<- InstanceUpdate
+
+	// For testing
+	probe func(check store.HealthCheck, addr netutil.IPPort) error
+}
+
+type healthChecks struct {
+	healthChecksConfig
+	results   chan probeResult
+	instances map[InstanceKey]*checkedInstance
+}
+
+// An instance being checked.  The check and address are fixed; if
+// either changes, the checker is replaced.  inst is as last received,
+// so its health is what Docker says, if anything.
+type checkedInstance struct {
+	inst     store.Instance
+	health   string
+	check    store.HealthCheck
+	addr     netutil.IPPort
+	stop     chan struct{}
+	passes   int
+	failures int
+}
+
+type probeResult struct {
+	key     InstanceKey
+	checker *checkedInstance
+	err     error
+}
+
+func (conf healthChecksConfig) StartFunc() daemon.StartFunc {
+	return daemon.SimpleComponent(conf.start)
+}
+
+func (conf healthChecksConfig) start(stop <-chan struct{}, errs daemon.ErrorSink) {
+	if conf.probe == nil {
+		conf.probe = probe
+	}
+
+	hc := healthChecks{
+		healthChecksConfig: conf,
+		results:            make(chan probeResult),
+		instances:          make(map[InstanceKey]*checkedInstance),
+	}
+
+	defer func() {
+		for _, ci := range hc.instances {
+			close(ci.stop)
+		}
+	}()
+
+	for {
+		var update InstanceUpdate
+		select {
+		case u := <-hc.instanceUpdates:
+			update = hc.processUpdate(u)
+
+		case res := <-hc.results:
+			update = hc.processResult(res)
+			if len(update.Instances) == 0 {
+				continue
+			}
+
+		case <-stop:
+			return
+		}
+
+		select {
+		case hc.checkedUpdates <- update:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (hc *healthChecks) processUpdate(update InstanceUpdate) InstanceUpdate {
+	if update.Reset {
+		for key := range hc.instances {
+			if update.Instances[key] == nil {
+				hc.stopChecking(key)
+			}
+		}
+	}
+
+	res := InstanceUpdate{
+		Instances: make(map[InstanceKey]*store.Instance),
+		Reset:     update.Reset,
+	}
+
+	for key, inst := range update.Instances {
+		check := update.HealthChecks[key.Service]
+		if inst == nil || inst.Address == nil || check == nil {
+			hc.stopChecking(key)
+			res.Instances[key] = inst
+			continue
+		}
+
+		withDefaults := check.WithDefaults()
+		ci := hc.instances[key]
+		if ci == nil || ci.check != withDefaults || !ci.addr.Equal(*inst.Address) {
+			hc.stopChecking(key)
+			ci = &checkedInstance{
+				check: withDefaults,
+				addr:  *inst.Address,
+				stop:  make(chan struct{}),
+			}
+			hc.instances[key] = ci
+			go ci.run(key, hc.probe, hc.results)
+		}
+
+		ci.inst = *inst
+		checked := ci.checked()
+		res.Instances[key] = &checked
+	}
+
+	return res
+}
+
+func (hc *healthChecks) stopChecking(key InstanceKey) {
+	if ci := hc.instances[key]; ci != nil {
+		close(ci.stop)
+		delete(hc.instances, key)
+	}
+}
+
+// Count a check towards the thresholds, returning an update if that
+// changes the health of the instance
+func (hc *healthChecks) processResult(res probeResult) InstanceUpdate {
+	update := InstanceUpdate{Instances: make(map[InstanceKey]*store.Instance)}
+	ci := hc.instances[res.key]
+	if ci != res.checker {
+		// From a checker since stopped
+		return update
+	}
+
+	health := ci.health
+	if res.err == nil {
+		ci.failures = 0
+		ci.passes++
+		if ci.passes >= ci.check.HealthyThreshold {
+			health = store.Healthy
+		}
+	} else {
+		ci.passes = 0
+		ci.failures++
+		if ci.failures >= ci.check.UnhealthyThreshold {
+			health = store.Unhealthy
+		}
+	}
+
+	if health != ci.health {
+		if health == store.Unhealthy {
+			log.Warnf("Service '%s' instance '%.12s' at %s is unhealthy: %s", res.key.Service, res.key.Instance, ci.addr, res.err)
+		} else {
+			log.Infof("Service '%s' instance '%.12s' at %s is healthy", res.key.Service, res.key.Instance, ci.addr)
+		}
+		ci.health = health
+		checked := ci.checked()
+		update.Instances[res.key] = &checked
+	}
+
+	return update
+}
+
+// The instance with its health.  If Docker says the container is
+// starting or unhealthy, that stands; otherwise the health check
+// decides.
+func (ci *checkedInstance) checked() store.Instance {
+	inst := ci.inst
+	switch {
+	case inst.Health == store.Starting || inst.Health == store.Unhealthy:
+	case ci.health != "":
+		inst.Health = ci.health
+	}
+	return inst
+}
+
+func (ci *checkedInstance) run(key InstanceKey, probe func(store.HealthCheck, netutil.IPPort) error, results chan<- probeResult) {
+	ticker := time.NewTicker(time.Duration(ci.check.Interval))
+	defer ticker.Stop()
+
+	for {
+		err := probe(ci.check, ci.addr)
+		select {
+		case results <- probeResult{key: key, checker: ci, err: err}:
+		case <-ci.stop:
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ci.stop:
+			return
+		}
+	}
+}
+
+func probe(check store.HealthCheck, addr netutil.IPPort) error {
+	timeout := time.Duration(check.Timeout)
+
+	if check.Type != store.HealthCheckHTTP {
+		conn, err := net.DialTimeout("tcp", addr.String(), timeout)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// Using the transport directly means redirects are not
+	// followed; a redirect counts as a response like any other.
+	transport := &http.Transport{
+		Dial:                  (&net.Dialer{Timeout: timeout}).Dial,
+		ResponseHeaderTimeout: timeout,
+		DisableKeepAlives:     true,
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", addr, check.Path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if check.Status != 0 && resp.StatusCode != check.Status {
+		return fmt.Errorf("status %d; expected %d", resp.StatusCode, check.Status)
+	}
+	if check.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/daemon"
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+// Probes succeed or fail according to what the test says about each
+// address
+type fakeProbes struct {
+	lock    sync.Mutex
+	failing map[netutil.IPPort]bool
+}
+
+func (f *fakeProbes) probe(_ store.HealthCheck, addr netutil.IPPort) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failing[addr] {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (f *fakeProbes) setFailing(addr netutil.IPPort, failing bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failing[addr] = failing
+}
+
+type healthHarness struct {
+	in     chan InstanceUpdate
+	out    chan InstanceUpdate
+	probes *fakeProbes
+	errs   daemon.ErrorSink
+	comp   daemon.Component
+}
+
+func setupHealthChecks() *healthHarness {
+	h := &healthHarness{
+		in:     make(chan InstanceUpdate),
+		out:    make(chan InstanceUpdate),
+		probes: &fakeProbes{failing: make(map[netutil.IPPort]bool)},
+		errs:   daemon.NewErrorSink(),
+	}
+	h.comp = healthChecksConfig{
+		instanceUpdates: h.in,
+		checkedUpdates:  h.out,
+		probe:           h.probes.probe,
+	}.StartFunc()(h.errs)
+	return h
+}
+
+func (h *healthHarness) stop(t *testing.T) {
+	h.comp.Stop()
+	require.Empty(t, h.errs)
+}
+
+func (h *healthHarness) next(t *testing.T) InstanceUpdate {
+	select {
+	case update := <-h.out:
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for update")
+	}
+	return InstanceUpdate{}
+}
+
+var checkedKey = InstanceKey{Service: "svc", Instance: "inst"}
+
+func checkedUpdate(inst *store.Instance, check *store.HealthCheck) InstanceUpdate {
+	update := InstanceUpdate{
+		Instances:    map[InstanceKey]*store.Instance{checkedKey: inst},
+		HealthChecks: map[string]*store.HealthCheck{},
+	}
+	if check != nil {
+		update.HealthChecks["svc"] = check
+	}
+	return update
+}
+
+var fastCheck = &store.HealthCheck{
+	Type:               store.HealthCheckTCP,
+	Interval:           store.Duration(time.Millisecond),
+	HealthyThreshold:   2,
+	UnhealthyThreshold: 3,
+}
+
+func TestNoHealthCheck(t *testing.T) {
+	h := setupHealthChecks()
+	inst := &store.Instance{Address: netutil.ParseIPPortPtr("10.0.0.1:80")}
+
+	h.in <- checkedUpdate(inst, nil)
+	require.Equal(t, "", h.next(t).Instances[checkedKey].Health)
+
+	h.in <- checkedUpdate(nil, nil)
+	require.Nil(t, h.next(t).Instances[checkedKey])
+	h.stop(t)
+}
+
+func TestHealthCheckTransitions(t *testing.T) {
+	h := setupHealthChecks()
+	addr := netutil.ParseIPPortPtr("10.0.0.1:80")
+	inst := &store.Instance{Address: addr, Labels: map[string]string{"image": "foo"}}
+
+	// Passed through straight away, with unknown health
+	h.in <- checkedUpdate(inst, fastCheck)
+	require.Equal(t, "", h.next(t).Instances[checkedKey].Health)
+
+	// Then healthy, after passing enough checks
+	update := h.next(t)
+	require.Equal(t, store.Healthy, update.Instances[checkedKey].Health)
+	require.Equal(t, "foo", update.Instances[checkedKey].Labels["image"])
+
+	// Unhealthy after failing enough checks
+	h.probes.setFailing(*addr, true)
+	inst2 := h.next(t).Instances[checkedKey]
+	require.Equal(t, store.Unhealthy, inst2.Health)
+	require.Equal(t, store.StateUnhealthy, inst2.Label(store.StateLabel))
+
+	// An update of the instance keeps its health
+	h.in <- checkedUpdate(inst, fastCheck)
+	require.Equal(t, store.Unhealthy, h.next(t).Instances[checkedKey].Health)
+
+	// Recovers
+	h.probes.setFailing(*addr, false)
+	require.Equal(t, store.Healthy, h.next(t).Instances[checkedKey].Health)
+
+	// Removing the health check stops checking
+	h.in <- checkedUpdate(inst, nil)
+	require.Equal(t, "", h.next(t).Instances[checkedKey].Health)
+	h.probes.setFailing(*addr, true)
+	select {
+	case update := <-h.out:
+		t.Fatalf("unexpected update %v", update)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	h.stop(t)
+}
+
+func TestHealthCheckReset(t *testing.T) {
+	h := setupHealthChecks()
+	addr := netutil.ParseIPPortPtr("10.0.0.1:80")
+	h.probes.setFailing(*addr, true)
+
+	h.in <- checkedUpdate(&store.Instance{Address: addr}, fastCheck)
+	h.next(t)
+	require.Equal(t, store.Unhealthy, h.next(t).Instances[checkedKey].Health)
+
+	// A reset without the instance stops it being checked
+	h.in <- InstanceUpdate{Instances: map[InstanceKey]*store.Instance{}, Reset: true}
+	update := h.next(t)
+	require.True(t, update.Reset)
+	require.Empty(t, update.Instances)
+	h.probes.setFailing(*addr, false)
+	select {
+	case update := <-h.out:
+		t.Fatalf("unexpected update %v", update)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	h.stop(t)
+}
+
+func TestHealthCheckWithDocker(t *testing.T) {
+	h := setupHealthChecks()
+	addr := netutil.ParseIPPortPtr("10.0.0.1:80")
+
+	// Docker's verdict stands while it is starting
+	h.in <- checkedUpdate(&store.Instance{Address: addr, Health: store.Starting}, fastCheck)
+	require.Equal(t, store.Starting, h.next(t).Instances[checkedKey].Health)
+	require.Equal(t, store.Starting, h.next(t).Instances[checkedKey].Health)
+
+	// Once Docker says it is healthy, the health check decides
+	h.in <- checkedUpdate(&store.Instance{Address: addr, Health: store.Healthy}, fastCheck)
+	require.Equal(t, store.Healthy, h.next(t).Instances[checkedKey].Health)
+	h.probes.setFailing(*addr, true)
+	require.Equal(t, store.Unhealthy, h.next(t).Instances[checkedKey].Health)
+
+	h.stop(t)
+}
+
+func TestProbe(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/health", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	tcpAddr := srv.Listener.Addr().(*net.TCPAddr)
+	addr := netutil.NewIPPort(tcpAddr.IP, tcpAddr.Port)
+	check := store.HealthCheck{Type: store.HealthCheckHTTP, Path: "/health"}.WithDefaults()
+
+	require.NoError(t, probe(check, addr))
+	status = http.StatusFound
+	require.NoError(t, probe(check, addr))
+	status = http.StatusInternalServerError
+	require.Error(t, probe(check, addr))
+
+	check.Status = http.StatusInternalServerError
+	require.NoError(t, probe(check, addr))
+
+	tcpCheck := store.HealthCheck{Type: store.HealthCheckTCP}.WithDefaults()
+	require.NoError(t, probe(tcpCheck, addr))
+
+	srv.Close()
+	require.Error(t, probe(check, addr))
+	require.Error(t, probe(tcpCheck, addr))
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -21,6 +22,9 @@ type InstanceKey struct {
 type InstanceUpdate struct {
 	Instances map[InstanceKey]*store.Instance
 	Reset     bool
+	// The health checks of the services of the instances in the
+	// update, where they have them
+	HealthChecks map[string]*store.HealthCheck
 }
 
 type syncInstancesConfig struct {
@@ -75,6 +79,7 @@ func (conf syncInstancesConfig) start(stop <-chan struct{}, errs daemon.ErrorSin
 	for {
 		// Clear the current update
 		si.update.Instances = make(map[InstanceKey]*store.Instance)
+		si.update.HealthChecks = make(map[string]*store.HealthCheck)
 		si.update.Reset = false
 
 		select {
@@ -97,6 +102,7 @@ func (conf syncInstancesConfig) start(stop <-chan struct{}, errs daemon.ErrorSin
 		if len(si.update.Instances) > 0 || si.update.Reset {
 			si.instanceUpdates <- si.update
 			si.update.Instances = nil
+			si.update.HealthChecks = nil
 		}
 	}
 }
@@ -134,8 +140,10 @@ func (si *syncInstances) addContainer(cont *docker.Container) {
 		return
 	}
 
+	// A container already known has been inspected again, e.g.,
+	// because its health has changed, so it is evaluated afresh
 	if _, found := si.containers[cont.ID]; found {
-		return
+		si.removeContainer(cont.ID)
 	}
 
 	c := container{Container: cont, instances: make(map[string]struct{})}
@@ -160,13 +168,28 @@ func (si *syncInstances) removeContainer(id string) {
 	}
 }
 
+// A container is an instance of the service if it matches any of the
+// rules.  The rules are tried in order of name, so that which rule a
+// container is attributed to does not change from one time to the
+// next.
 func (si *syncInstances) addInstances(svc service, cont container) {
-	for _, rule := range svc.ContainerRules {
-		inst := si.extractInstance(cont.Container, svc.ServiceInfo, &rule)
+	var ruleNames []string
+	for ruleName := range svc.ContainerRules {
+		ruleNames = append(ruleNames, ruleName)
+	}
+	sort.Strings(ruleNames)
+
+	for _, ruleName := range ruleNames {
+		rule := svc.ContainerRules[ruleName]
+		inst := si.extractInstance(cont.Container, svc.ServiceInfo, ruleName, &rule)
 		if inst != nil {
 			svc.instances[cont.ID] = inst
 			cont.instances[svc.name] = struct{}{}
 			si.updateInstance(svc.name, cont.ID, inst)
+			if svc.HealthCheck != nil {
+				si.update.HealthChecks[svc.name] = svc.HealthCheck
+			}
+			return
 		}
 	}
 }
@@ -245,7 +268,7 @@ func (si *syncInstances) clearInstances() {
 	}
 }
 
-func (si *syncInstances) extractInstance(container *docker.Container, svc *store.ServiceInfo, rule *store.ContainerRule) *store.Instance {
+func (si *syncInstances) extractInstance(container *docker.Container, svc *store.ServiceInfo, ruleName string, rule *store.ContainerRule) *store.Instance {
 	if !rule.Includes(containerLabels{container}) {
 		return nil
 	}
@@ -270,10 +293,37 @@ func (si *syncInstances) extractInstance(container *docker.Container, svc *store
 	}
 
 	return &store.Instance{
-		Address: addr,
-		Labels:  labels,
-		Host:    store.Host{IP: si.hostIP},
+		ContainerRule: ruleName,
+		Address:       addr,
+		Labels:        labels,
+		Host:          store.Host{IP: si.hostIP},
+		Weight:        extractWeight(container, rule),
+		Health:        dockerHealth(container),
+	}
+}
+
+// The health of a container according to its HEALTHCHECK, if it has
+// one
+func dockerHealth(container *docker.Container) string {
+	switch status := container.State.Health.Status; status {
+	case store.Starting, store.Healthy, store.Unhealthy:
+		return status
+	default:
+		return ""
+	}
+}
+
+// The weight of an instance comes from the container's weight label,
+// if it has a usable one, otherwise from the rule.
+func extractWeight(container *docker.Container, rule *store.ContainerRule) int {
+	if s, found := container.Config.Labels[store.WeightLabel]; found {
+		weight, err := strconv.Atoi(s)
+		if err == nil && weight > 0 {
+			return weight
+		}
+		log.Warnf(`Ignoring label %s="%s" of container '%s'; expected a positive integer`, store.WeightLabel, s, container.ID)
 	}
+	return rule.Weight
 }
 
 type containerLabels struct{ *docker.Container }
@@ -284,6 +334,8 @@ func (container containerLabels) Label(label string) string {
 		return imageName(container.Config.Image)
 	case label == "tag":
 		return imageTag(container.Config.Image)
+	case label == store.HealthLabel:
+		return dockerHealth(container.Container)
 	case len(label) > 4 && label[:4] == "env.":
 		return envValue(container.Config.Env, label[4:])
 	default:
@@ -22,6 +22,7 @@ type containerInfo struct {
 	Env         map[string]string
 	Ports       map[string]string
 	NetworkMode string
+	Health      string
 }
 
 func makeContainersMap(cs []containerInfo) map[string]*docker.Container {
@@ -61,6 +62,7 @@ func makeContainersMap(cs []containerInfo) map[string]*docker.Container {
 				Ports:     ports,
 			},
 		}
+		c1.State.Health.Status = c.Health
 		containers[c.ID] = c1
 	}
 
@@ -435,3 +437,112 @@ func TestSyncInstancesResets(t *testing.T) {
 
 	h.stop(t)
 }
+
+func TestInstanceWeight(t *testing.T) {
+	h := setup("192.168.5.135", LOCAL)
+
+	rule := makeRule(8080, "image", "blorp-image")
+	rule.Weight = 20
+	h.serviceUpdates <- serviceUpdate(true, "blorp-svc", store.ServiceInfo{
+		ContainerRules: map[string]store.ContainerRule{GROUP: rule},
+	})
+
+	h.addContainers(true,
+		containerInfo{
+			ID:    "from-rule",
+			Image: "blorp-image:tag",
+		},
+		containerInfo{
+			ID:     "from-label",
+			Image:  "blorp-image:tag",
+			Labels: map[string]string{store.WeightLabel: "5"},
+		},
+		containerInfo{
+			ID:     "bad-label",
+			Image:  "blorp-image:tag",
+			Labels: map[string]string{store.WeightLabel: "lots"},
+		})
+
+	iu := <-h.instanceUpdates
+	require.True(t, iu.Reset)
+	require.Len(t, iu.Instances, 3)
+	require.Equal(t, 20, iu.get("blorp-svc", "from-rule").Weight)
+	require.Equal(t, 5, iu.get("blorp-svc", "from-label").Weight)
+	require.Equal(t, 20, iu.get("blorp-svc", "bad-label").Weight)
+	h.stop(t)
+}
+
+func TestInstanceRule(t *testing.T) {
+	h := setup("192.168.5.135", LOCAL)
+
+	// The container matches both rules; it is attributed to the
+	// first by name
+	h.serviceUpdates <- serviceUpdate(true, "blorp-svc", store.ServiceInfo{
+		ContainerRules: map[string]store.ContainerRule{
+			"b-rule": makeRule(8080, "image", "blorp-image"),
+			"a-rule": makeRule(8080, "tag", "tag"),
+			"c-rule": makeRule(8080, "image", "blorp-image"),
+		},
+	})
+
+	h.addContainers(true, containerInfo{
+		ID:    "blorp-instance",
+		Image: "blorp-image:tag",
+	})
+
+	iu := <-h.instanceUpdates
+	require.True(t, iu.Reset)
+	require.Len(t, iu.Instances, 1)
+	require.Equal(t, "a-rule", iu.get("blorp-svc", "blorp-instance").ContainerRule)
+	h.stop(t)
+}
+
+func TestInstanceDockerHealth(t *testing.T) {
+	h := setup("192.168.5.135", LOCAL)
+
+	h.serviceUpdates <- serviceUpdate(true, "blorp-svc", store.ServiceInfo{
+		ContainerRules: map[string]store.ContainerRule{GROUP: makeRule(8080, "image", "blorp-image")},
+	})
+	h.serviceUpdates <- serviceUpdate(false, "healthy-svc", store.ServiceInfo{
+		ContainerRules: map[string]store.ContainerRule{GROUP: makeRule(8080, store.HealthLabel, store.Healthy)},
+	})
+
+	h.addContainers(true, containerInfo{
+		ID:     "blorp-instance",
+		Image:  "blorp-image:tag",
+		Health: store.Starting,
+	}, containerInfo{
+		ID:     "no-healthcheck",
+		Image:  "blorp-image:tag",
+		Health: "none",
+	})
+
+	iu := <-h.instanceUpdates
+	require.Len(t, iu.Instances, 2)
+	require.Equal(t, store.Starting, iu.get("blorp-svc", "blorp-instance").Health)
+	require.Equal(t, "", iu.get("blorp-svc", "no-healthcheck").Health)
+
+	// Inspected again once it becomes healthy, when it is also
+	// selected by the rule on health
+	h.addContainers(false, containerInfo{
+		ID:     "blorp-instance",
+		Image:  "blorp-image:tag",
+		Health: store.Healthy,
+	})
+	iu = <-h.instanceUpdates
+	require.Len(t, iu.Instances, 2)
+	require.Equal(t, store.Healthy, iu.get("blorp-svc", "blorp-instance").Health)
+	require.NotNil(t, iu.get("healthy-svc", "blorp-instance"))
+
+	// and dropped from that rule when it becomes unhealthy
+	h.addContainers(false, containerInfo{
+		ID:     "blorp-instance",
+		Image:  "blorp-image:tag",
+		Health: store.Unhealthy,
+	})
+	iu = <-h.instanceUpdates
+	require.Equal(t, store.Unhealthy, iu.get("blorp-svc", "blorp-instance").Health)
+	require.Contains(t, iu.Instances, InstanceKey{Service: "healthy-svc", Instance: "blorp-instance"})
+	require.Nil(t, iu.get("healthy-svc", "blorp-instance"))
+	h.stop(t)
+}
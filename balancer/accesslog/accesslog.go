@@ -0,0 +1,236 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/common/daemon"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+)
+
+type eventHandlerSlot struct {
+	slot *events.Handler
+}
+
+type eventHandlerKey struct{}
+
+// The access log, or nil if none was asked for
+func EventHandlerDependency(slot *events.Handler) daemon.DependencySlot {
+	return eventHandlerSlot{slot}
+}
+
+func (eventHandlerSlot) Key() daemon.DependencyKey {
+	return eventHandlerKey{}
+}
+
+func (s eventHandlerSlot) Assign(value interface{}) {
+	*s.slot, _ = value.(events.Handler)
+}
+
+type eventHandlerConfig struct {
+	path     string
+	format   string
+	maxSize  int
+	maxFiles int
+}
+
+func (eventHandlerKey) MakeConfig() daemon.DependencyConfig {
+	return &eventHandlerConfig{}
+}
+
+func (cf *eventHandlerConfig) Populate(deps *daemon.Dependencies) {
+	deps.StringVar(&cf.path,
+		"access-log", "",
+		"write a log of forwarded HTTP requests and TCP connections to this file")
+	deps.StringVar(&cf.format,
+		"access-log-format", FormatJSON,
+		"format of the access log: json, common or combined")
+	deps.IntVar(&cf.maxSize,
+		"access-log-max-size", 100,
+		"rotate the access log when it reaches this many megabytes; 0 to never rotate it")
+	deps.IntVar(&cf.maxFiles,
+		"access-log-max-files", 5,
+		"number of rotated access logs to keep")
+}
+
+func (cf *eventHandlerConfig) MakeValue() (interface{}, daemon.StartFunc, error) {
+	if cf.path == "" {
+		return nil, nil, nil
+	}
+
+	switch cf.format {
+	case FormatJSON, FormatCommon, FormatCombined:
+	default:
+		return nil, nil, fmt.Errorf("unknown access log format '%s'", cf.format)
+	}
+
+	file, err := openRotatingFile(cf.path, int64(cf.maxSize)<<20,
+		cf.maxFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := New(file, cf.format)
+	return h, func(daemon.ErrorSink) daemon.Component {
+		return daemon.StopFunc(func() {
+			if err := file.Close(); err != nil {
+				log.WithError(err).Error("closing access log")
+			}
+		})
+	}, nil
+}
+
+// An events.Handler that writes a line for each HTTP exchange, and
+// for each connection to a TCP service when it closes.
+type AccessLog struct {
+	events.DiscardOthers
+	out    io.Writer
+	format string
+}
+
+func New(out io.Writer, format string) *AccessLog {
+	return &AccessLog{out: out, format: format}
+}
+
+// The fields written for the json format
+type entry struct {
+	Time         string `json:"time"`
+	Type         string `json:"type"`
+	Service      string `json:"service"`
+	Instance     string `json:"instance,omitempty"`
+	InstanceAddr string `json:"instance_addr,omitempty"`
+	Client       string `json:"client"`
+
+	// HTTP exchanges
+	Method    string  `json:"method,omitempty"`
+	URI       string  `json:"uri,omitempty"`
+	Proto     string  `json:"proto,omitempty"`
+	Status    int     `json:"status,omitempty"`
+	Size      *int64  `json:"size,omitempty"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	RoundTrip float64 `json:"roundtrip_seconds,omitempty"`
+	Total     float64 `json:"total_seconds,omitempty"`
+
+	// TCP connections
+	BytesIn  *int64  `json:"bytes_in,omitempty"`
+	BytesOut *int64  `json:"bytes_out,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+	Reason   string  `json:"reason,omitempty"`
+}
+
+func (l *AccessLog) newEntry(typ string, ev *events.Connection) *entry {
+	e := &entry{
+		Time:     ev.Time.Format(time.RFC3339Nano),
+		Type:     typ,
+		Service:  ev.ServiceName,
+		Instance: ev.InstanceName,
+		Client:   ev.Inbound.IP.String(),
+	}
+	if ev.InstanceAddr.IP() != nil {
+		e.InstanceAddr = ev.InstanceAddr.String()
+	}
+	return e
+}
+
+func (l *AccessLog) HttpExchange(ev *events.HttpExchange) {
+	req := ev.Request
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+
+	if l.format != FormatJSON {
+		size := "-"
+		if ev.Response.ContentLength >= 0 {
+			size = strconv.FormatInt(ev.Response.ContentLength, 10)
+		}
+		l.writeCommon(ev.Connection,
+			fmt.Sprintf("%s %s %s", req.Method, uri, req.Proto),
+			strconv.Itoa(ev.Response.StatusCode), size,
+			req.Referer(), req.UserAgent())
+		return
+	}
+
+	e := l.newEntry("http", ev.Connection)
+	e.Method = req.Method
+	e.URI = uri
+	e.Proto = req.Proto
+	e.Status = ev.Response.StatusCode
+	if ev.Response.ContentLength >= 0 {
+		e.Size = &ev.Response.ContentLength
+	}
+	e.Referer = req.Referer()
+	e.UserAgent = req.UserAgent()
+	e.RoundTrip = ev.RoundTrip.Seconds()
+	e.Total = ev.TotalTime.Seconds()
+	l.writeJSON(e)
+}
+
+func (l *AccessLog) ConnectionClosed(ev *events.ConnectionClosed) {
+	// HTTP connections are covered by their exchanges
+	if ev.Protocol == "http" {
+		return
+	}
+
+	if l.format != FormatJSON {
+		l.writeCommon(ev.Connection, "", "", strconv.FormatInt(ev.BytesOut, 10), "", "")
+		return
+	}
+
+	e := l.newEntry("tcp", ev.Connection)
+	e.BytesIn = &ev.BytesIn
+	e.BytesOut = &ev.BytesOut
+	e.Duration = ev.Duration.Seconds()
+	e.Reason = ev.Reason
+	l.writeJSON(e)
+}
+
+func (l *AccessLog) writeJSON(e *entry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Error("formatting access log entry")
+		return
+	}
+	l.write(append(b, '\n'))
+}
+
+// Write a line in the Common Log Format, or the Combined Log Format
+// which adds the referer and user agent
+func (l *AccessLog) writeCommon(ev *events.Connection, request, status, size, referer, userAgent string) {
+	line := fmt.Sprintf("%s - - [%s] %s %s %s",
+		ev.Inbound.IP, ev.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(request), orDash(status), size)
+	if l.format == FormatCombined {
+		line += fmt.Sprintf(" %s %s", quote(referer), quote(userAgent))
+	}
+	l.write([]byte(line + "\n"))
+}
+
+func quote(s string) string {
+	return strconv.Quote(orDash(s))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (l *AccessLog) write(line []byte) {
+	if _, err := l.out.Write(line); err != nil {
+		log.WithError(err).Error("writing access log")
+	}
+}
@@ -0,0 +1,159 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/common/netutil"
+)
+
+func testLog(format string) (*AccessLog, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return New(&buf, format), &buf
+}
+
+func connection(protocol string) *events.Connection {
+	return &events.Connection{
+		Time:         time.Date(2016, 5, 4, 13, 2, 1, 0, time.UTC),
+		ServiceName:  "svc",
+		Protocol:     protocol,
+		InstanceName: "inst",
+		InstanceAddr: netutil.NewIPPort(net.ParseIP("10.0.0.2"), 8080),
+		Inbound:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 34567},
+	}
+}
+
+func exchange() *events.HttpExchange {
+	req, _ := http.NewRequest("GET", "http://svc/foo?bar=baz", nil)
+	req.Header.Set("User-Agent", "test")
+	return &events.HttpExchange{
+		Connection: connection("http"),
+		Request:    req,
+		Response: &http.Response{
+			StatusCode:    200,
+			ContentLength: 42,
+		},
+		RoundTrip: 2 * time.Millisecond,
+		TotalTime: 3 * time.Millisecond,
+	}
+}
+
+func closed(protocol string) *events.ConnectionClosed {
+	return &events.ConnectionClosed{
+		Connection: connection(protocol),
+		BytesIn:    10,
+		BytesOut:   20,
+		Duration:   time.Second,
+		Reason:     events.ClosedByClient,
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := testLog(FormatJSON)
+	l.HttpExchange(exchange())
+	l.ConnectionClosed(closed("http"))
+	l.ConnectionClosed(closed("tcp"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var e map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &e))
+	require.Equal(t, map[string]interface{}{
+		"time":              "2016-05-04T13:02:01Z",
+		"type":              "http",
+		"service":           "svc",
+		"instance":          "inst",
+		"instance_addr":     "10.0.0.2:8080",
+		"client":            "10.0.0.1",
+		"method":            "GET",
+		"uri":               "/foo?bar=baz",
+		"proto":             "HTTP/1.1",
+		"status":            200.0,
+		"size":              42.0,
+		"user_agent":        "test",
+		"roundtrip_seconds": 0.002,
+		"total_seconds":     0.003,
+	}, e)
+
+	e = nil
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &e))
+	require.Equal(t, map[string]interface{}{
+		"time":             "2016-05-04T13:02:01Z",
+		"type":             "tcp",
+		"service":          "svc",
+		"instance":         "inst",
+		"instance_addr":    "10.0.0.2:8080",
+		"client":           "10.0.0.1",
+		"bytes_in":         10.0,
+		"bytes_out":        20.0,
+		"duration_seconds": 1.0,
+		"reason":           "client",
+	}, e)
+}
+
+func TestCommon(t *testing.T) {
+	l, buf := testLog(FormatCommon)
+	ex := exchange()
+	ex.Response.ContentLength = -1
+	l.HttpExchange(ex)
+	l.ConnectionClosed(closed("tcp"))
+	require.Equal(t, `10.0.0.1 - - [04/May/2016:13:02:01 +0000] "GET /foo?bar=baz HTTP/1.1" 200 -
+10.0.0.1 - - [04/May/2016:13:02:01 +0000] "-" - 20
+`, buf.String())
+
+	l, buf = testLog(FormatCombined)
+	l.HttpExchange(exchange())
+	require.Equal(t, `10.0.0.1 - - [04/May/2016:13:02:01 +0000] "GET /foo?bar=baz HTTP/1.1" 200 42 "-" "test"
+`, buf.String())
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := openRotatingFile(path, 10, 2)
+	require.Nil(t, err)
+	for _, s := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(s))
+		require.Nil(t, err)
+	}
+	require.Nil(t, f.Close())
+
+	read := func(p string) string {
+		b, err := ioutil.ReadFile(p)
+		require.Nil(t, err)
+		return string(b)
+	}
+	require.Equal(t, "four\nfive\n", read(path))
+	require.Equal(t, "three\n", read(path+".1"))
+	require.Equal(t, "one\ntwo\n", read(path+".2"))
+
+	// A file already there is counted, and without rotated files
+	// to keep, it is simply replaced
+	f, err = openRotatingFile(path, 10, 0)
+	require.Nil(t, err)
+	_, err = f.Write([]byte("six\n"))
+	require.Nil(t, err)
+	_, err = f.Write([]byte("seven\n"))
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	require.Equal(t, "six\nseven\n", read(path))
+	require.Equal(t, "three\n", read(path+".1"))
+
+	_, err = f.Write([]byte("eight\n"))
+	require.NotNil(t, err)
+}
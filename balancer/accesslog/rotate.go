@@ -0,0 +1,115 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A file that is moved aside when it gets too big, to path.1, path.2
+// and so on, with the oldest beyond the maximum number of files
+// removed.  Each write is kept whole in one file.
+type rotatingFile struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = fi.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, fmt.Errorf("%s is closed", f.path)
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		// If the files could not be moved, carry on with the
+		// one there is
+		if err := f.rotate(); err != nil {
+			log.WithError(err).Error("rotating ", f.path)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err == nil {
+		err = f.shift()
+	}
+
+	if oerr := f.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+// Move the files along by one, overwriting the oldest
+func (f *rotatingFile) shift() error {
+	if f.maxFiles == 0 {
+		return os.Remove(f.path)
+	}
+
+	for i := f.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(f.rotated(i), f.rotated(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.rotated(1))
+}
+
+func (f *rotatingFile) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
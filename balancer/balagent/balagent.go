@@ -83,12 +83,11 @@ func (cf *BalancerAgentConfig) Prepare() (daemon.StartFunc, error) {
 	services := make(chan Services, 1)
 
 	return daemon.Aggregate(
-		daemon.Restart(cf.reconnectInterval,
-			store.WatchServicesStartFunc(cf.store,
-				store.QueryServiceOptions{
-					WithInstances:        true,
-					WithIngressInstances: true,
-				}, updates)),
+		store.WatchServicesStartFunc(cf.store, cf.reconnectInterval,
+			store.QueryServiceOptions{
+				WithInstances:        true,
+				WithIngressInstances: true,
+			}, updates),
 		daemon.SimpleComponent(updater{updates, services}.run),
 		daemon.SimpleComponent(generator{cf, services}.run)), nil
 }
@@ -6,8 +6,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/balancer/eventsinks"
 	"github.com/weaveworks/flux/balancer/model"
-	"github.com/weaveworks/flux/balancer/prometheus"
 	"github.com/weaveworks/flux/common/daemon"
 	"github.com/weaveworks/flux/common/store"
 	"github.com/weaveworks/flux/common/store/etcdstore"
@@ -51,7 +51,7 @@ func (cf *BalancerConfig) Populate(deps *daemon.Dependencies) {
 	deps.BoolVar(&cf.debug, "debug", false, "output debugging logs")
 
 	deps.Dependency(etcdstore.StoreDependency(&cf.store))
-	deps.Dependency(prometheus.EventHandlerDependency(&cf.eventHandler))
+	deps.Dependency(eventsinks.EventHandlerDependency(&cf.eventHandler))
 }
 
 func (cf *BalancerConfig) Prepare() (daemon.StartFunc, error) {
@@ -85,9 +85,8 @@ func (cf *BalancerConfig) Prepare() (daemon.StartFunc, error) {
 
 	return daemon.Aggregate(
 		daemon.Reset(updatesReset,
-			daemon.Restart(cf.reconnectInterval,
-				model.WatchServicesStartFunc(cf.store, true,
-					updates))),
+			model.WatchServicesStartFunc(cf.store,
+				cf.reconnectInterval, true, updates)),
 
 		daemon.Restart(cf.reconnectInterval, startBalancer)), nil
 }
@@ -11,7 +11,16 @@ type EventLogger struct {
 }
 
 func (EventLogger) Connection(ev *events.Connection) {
-	log.Infoln("Connection", ev.Inbound, ev.InstanceAddr)
+	log.Infoln("Connection", ev.Inbound)
+}
+
+func (EventLogger) ConnectionClosed(ev *events.ConnectionClosed) {
+	log.Infoln("Connection closed", ev.Inbound, ev.InstanceAddr,
+		ev.Reason, ev.BytesIn, ev.BytesOut, ev.Duration)
+}
+
+func (EventLogger) Dial(ev *events.Dial) {
+	log.Infoln("Dial", ev.Inbound, ev.InstanceAddr)
 }
 
 func (EventLogger) HttpExchange(ev *events.HttpExchange) {
@@ -19,3 +28,7 @@ func (EventLogger) HttpExchange(ev *events.HttpExchange) {
 		ev.Request.Method, ev.Request.URL, ev.Response.StatusCode,
 		ev.RoundTrip, ev.TotalTime)
 }
+
+func (EventLogger) Timeout(ev *events.Timeout) {
+	log.Infoln("Timeout", ev.Kind, ev.Inbound, ev.InstanceAddr)
+}
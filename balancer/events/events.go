@@ -10,10 +10,19 @@ import (
 
 type Handler interface {
 	Connection(*Connection)
+	ConnectionClosed(*ConnectionClosed)
+	Dial(*Dial)
 	HttpExchange(*HttpExchange)
+	Timeout(*Timeout)
 }
 
+// A connection from a client, and the instance it is forwarded to.
+// As an event in its own right, it is an inbound connection just
+// accepted, so the instance is not given.
 type Connection struct {
+	// When the event happened, which may be a while before a
+	// queued handler gets to it
+	Time         time.Time
 	ServiceName  string
 	Protocol     string
 	InstanceName string
@@ -21,6 +30,34 @@ type Connection struct {
 	Inbound      *net.TCPAddr
 }
 
+const (
+	ClosedByClient   = "client"
+	ClosedByInstance = "instance"
+	ClosedByError    = "error"
+	ClosedByTimeout  = "timeout"
+	ClosedByDrain    = "drain"
+)
+
+// The end of an inbound connection.  For http connections, the
+// instance given is the one that served the last request, if any.
+type ConnectionClosed struct {
+	*Connection
+	// Received from and sent to the client
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	// One of the ClosedBy constants
+	Reason string
+}
+
+// A new connection made to an instance.  For http services,
+// connections to instances are kept and reused, so there may be many
+// inbound connections for each of these; the inbound connection given
+// is the one that the connection was made for.
+type Dial struct {
+	*Connection
+}
+
 type HttpExchange struct {
 	*Connection
 	Request   *http.Request
@@ -29,12 +66,66 @@ type HttpExchange struct {
 	TotalTime time.Duration
 }
 
+const (
+	TimeoutConnect       = "connect"
+	TimeoutIdle          = "idle"
+	TimeoutRequestHeader = "request-header"
+	TimeoutRequest       = "request"
+)
+
+// A timeout of forwarded traffic.  For timeouts waiting on the
+// client, the instance is not given.
+type Timeout struct {
+	*Connection
+	// One of the Timeout constants
+	Kind string
+}
+
 type DiscardOthers struct{}
 
 func (DiscardOthers) Connection(*Connection) {}
 
+func (DiscardOthers) ConnectionClosed(*ConnectionClosed) {}
+
+func (DiscardOthers) Dial(*Dial) {}
+
 func (DiscardOthers) HttpExchange(*HttpExchange) {}
 
+func (DiscardOthers) Timeout(*Timeout) {}
+
 type NullHandler struct{ DiscardOthers }
 
 func (NullHandler) Stop() {}
+
+// Passes each event to all of the handlers, in turn
+type Handlers []Handler
+
+func (hs Handlers) Connection(ev *Connection) {
+	for _, h := range hs {
+		h.Connection(ev)
+	}
+}
+
+func (hs Handlers) ConnectionClosed(ev *ConnectionClosed) {
+	for _, h := range hs {
+		h.ConnectionClosed(ev)
+	}
+}
+
+func (hs Handlers) Dial(ev *Dial) {
+	for _, h := range hs {
+		h.Dial(ev)
+	}
+}
+
+func (hs Handlers) HttpExchange(ev *HttpExchange) {
+	for _, h := range hs {
+		h.HttpExchange(ev)
+	}
+}
+
+func (hs Handlers) Timeout(ev *Timeout) {
+	for _, h := range hs {
+		h.Timeout(ev)
+	}
+}
@@ -0,0 +1,86 @@
+package eventsinks
+
+import (
+	"fmt"
+
+	"github.com/weaveworks/flux/balancer/accesslog"
+	"github.com/weaveworks/flux/balancer/eventlogger"
+	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/balancer/prometheus"
+	"github.com/weaveworks/flux/common/daemon"
+)
+
+type eventHandlerSlot struct {
+	slot *events.Handler
+}
+
+type eventHandlerKey struct{}
+
+// The handler for forwarders to send events to, which passes them on
+// to each of the sinks turned on by flags: Prometheus metrics, the
+// access log and the daemon's log.  Each sink has its own queue, so
+// that a slow one does not hold up forwarding or the others.
+func EventHandlerDependency(slot *events.Handler) daemon.DependencySlot {
+	return eventHandlerSlot{slot}
+}
+
+func (eventHandlerSlot) Key() daemon.DependencyKey {
+	return eventHandlerKey{}
+}
+
+func (s eventHandlerSlot) Assign(value interface{}) {
+	*s.slot = value.(events.Handler)
+}
+
+type eventHandlerConfig struct {
+	queueSize  int
+	logEvents  bool
+	prometheus events.Handler
+	accessLog  events.Handler
+}
+
+func (eventHandlerKey) MakeConfig() daemon.DependencyConfig {
+	return &eventHandlerConfig{}
+}
+
+func (cf *eventHandlerConfig) Populate(deps *daemon.Dependencies) {
+	deps.IntVar(&cf.queueSize,
+		"event-queue-size", 1000,
+		"number of events to queue for each of Prometheus, the access log and the event log, beyond which they are dropped")
+	deps.BoolVar(&cf.logEvents,
+		"log-events", false,
+		"log each forwarded connection and HTTP request")
+
+	deps.Dependency(prometheus.EventHandlerDependency(&cf.prometheus))
+	deps.Dependency(accesslog.EventHandlerDependency(&cf.accessLog))
+}
+
+func (cf *eventHandlerConfig) MakeValue() (interface{}, daemon.StartFunc, error) {
+	if cf.queueSize <= 0 {
+		return nil, nil, fmt.Errorf("event queue size must be positive")
+	}
+
+	var handlers events.Handlers
+	var queues []*queue
+	addSink := func(name string, sink events.Handler) {
+		if sink != nil {
+			q := newQueue(name, sink, cf.queueSize)
+			handlers = append(handlers, q)
+			queues = append(queues, q)
+		}
+	}
+
+	addSink("prometheus", cf.prometheus)
+	addSink("access log", cf.accessLog)
+	if cf.logEvents {
+		addSink("event log", eventlogger.EventLogger{})
+	}
+
+	return handlers, func(daemon.ErrorSink) daemon.Component {
+		return daemon.StopFunc(func() {
+			for _, q := range queues {
+				q.Stop()
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,90 @@
+package eventsinks
+
+import (
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/weaveworks/flux/balancer/events"
+)
+
+// Passes events on to a handler from a goroutine of its own, through
+// a queue of bounded size.  When the queue is full, events are dropped
+// rather than holding up the forwarding that produced them.
+type queue struct {
+	name    string
+	handler events.Handler
+	events  chan func()
+	stop    chan struct{}
+	done    chan struct{}
+	dropped uint64
+}
+
+func newQueue(name string, h events.Handler, size int) *queue {
+	q := &queue{
+		name:    name,
+		handler: h,
+		events:  make(chan func(), size),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *queue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case f := <-q.events:
+			f()
+			if n := atomic.SwapUint64(&q.dropped, 0); n > 0 {
+				log.Warnf("%s: dropped %d events while behind", q.name, n)
+			}
+
+		case <-q.stop:
+			// Deliver what is already queued
+			for {
+				select {
+				case f := <-q.events:
+					f()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *queue) put(f func()) {
+	select {
+	case q.events <- f:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+func (q *queue) Stop() {
+	close(q.stop)
+	<-q.done
+}
+
+func (q *queue) Connection(ev *events.Connection) {
+	q.put(func() { q.handler.Connection(ev) })
+}
+
+func (q *queue) ConnectionClosed(ev *events.ConnectionClosed) {
+	q.put(func() { q.handler.ConnectionClosed(ev) })
+}
+
+func (q *queue) Dial(ev *events.Dial) {
+	q.put(func() { q.handler.Dial(ev) })
+}
+
+func (q *queue) HttpExchange(ev *events.HttpExchange) {
+	q.put(func() { q.handler.HttpExchange(ev) })
+}
+
+func (q *queue) Timeout(ev *events.Timeout) {
+	q.put(func() { q.handler.Timeout(ev) })
+}
@@ -0,0 +1,58 @@
+package eventsinks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/balancer/events"
+)
+
+// A sink that says when it has taken each event, then waits to be
+// let go before passing it on
+type slowSink struct {
+	events.DiscardOthers
+	taken   chan struct{}
+	release chan struct{}
+	got     chan *events.Timeout
+}
+
+func (s *slowSink) Timeout(ev *events.Timeout) {
+	s.taken <- struct{}{}
+	<-s.release
+	s.got <- ev
+}
+
+func TestQueue(t *testing.T) {
+	sink := &slowSink{
+		taken:   make(chan struct{}, 10),
+		release: make(chan struct{}),
+		got:     make(chan *events.Timeout, 10),
+	}
+	q := newQueue("test", sink, 2)
+
+	// The first is taken by the sink, the next two queued, and the
+	// rest dropped, without holding up the sender
+	var sent []*events.Timeout
+	for i := 0; i < 5; i++ {
+		ev := &events.Timeout{Kind: events.TimeoutIdle}
+		sent = append(sent, ev)
+		q.Timeout(ev)
+		if i == 0 {
+			// Let the sink take the first one
+			<-sink.taken
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		sink.release <- struct{}{}
+		require.True(t, sent[i] == <-sink.got)
+	}
+
+	// Events still queued are delivered when stopping
+	q.Timeout(sent[3])
+	go func() { sink.release <- struct{}{} }()
+	q.Stop()
+	require.True(t, sent[3] == <-sink.got)
+	require.Empty(t, sink.got)
+}
@@ -0,0 +1,159 @@
+package forwarder
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// The most idle connections kept open to each instance of an http
+// service, and how long they are kept for
+const (
+	max_idle_conns_per_instance = 8
+	idle_conn_timeout           = 90 * time.Second
+)
+
+// A connection to an instance
+type backendConn struct {
+	*net.TCPConn
+	inst *pooledInstance
+	// For reading http responses; created when first needed
+	rd *bufio.Reader
+	// Whether the connection was kept from an earlier request
+	reused    bool
+	idleSince time.Time
+}
+
+// Connections to instances of an http service that are idle between
+// requests, kept so that later requests can reuse them.
+type connPool struct {
+	lock        sync.Mutex
+	now         func() time.Time
+	maxIdle     int
+	idleTimeout time.Duration
+	// Oldest first, for each instance
+	idle    map[*pooledInstance][]*backendConn
+	timer   *time.Timer
+	stopped bool
+}
+
+func newConnPool() *connPool {
+	return &connPool{
+		now:         time.Now,
+		maxIdle:     max_idle_conns_per_instance,
+		idleTimeout: idle_conn_timeout,
+		idle:        make(map[*pooledInstance][]*backendConn),
+	}
+}
+
+// Take the most recently used idle connection to the instance, or nil
+// if there are none
+func (p *connPool) get(inst *pooledInstance) *backendConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	conns := p.idle[inst]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	bc := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(p.idle, inst)
+	} else {
+		p.idle[inst] = conns[:len(conns)-1]
+	}
+	bc.reused = true
+	return bc
+}
+
+// Keep a connection for a later request, closing the oldest idle
+// connection to the same instance if there are too many
+func (p *connPool) put(bc *backendConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		bc.Close()
+		return
+	}
+
+	bc.idleSince = p.now()
+	conns := append(p.idle[bc.inst], bc)
+	if len(conns) > p.maxIdle {
+		conns[0].Close()
+		conns = conns[1:]
+	}
+	p.idle[bc.inst] = conns
+
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.idleTimeout, p.expire)
+	}
+}
+
+// Close connections that have been idle for too long, including those
+// to instances that have since gone away
+func (p *connPool) expire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.timer = nil
+	if p.stopped {
+		return
+	}
+
+	now := p.now()
+	var next time.Time
+	for inst, conns := range p.idle {
+		for len(conns) != 0 && !now.Before(conns[0].idleSince.Add(p.idleTimeout)) {
+			conns[0].Close()
+			conns = conns[1:]
+		}
+
+		if len(conns) == 0 {
+			delete(p.idle, inst)
+			continue
+		}
+
+		p.idle[inst] = conns
+		if expiry := conns[0].idleSince.Add(p.idleTimeout); next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+
+	if !next.IsZero() {
+		p.timer = time.AfterFunc(next.Sub(now), p.expire)
+	}
+}
+
+// Close the idle connections to the instances given
+func (p *connPool) closeIdle(insts []*pooledInstance) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, inst := range insts {
+		for _, bc := range p.idle[inst] {
+			bc.Close()
+		}
+		delete(p.idle, inst)
+	}
+}
+
+func (p *connPool) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stopped = true
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	for _, conns := range p.idle {
+		for _, bc := range conns {
+			bc.Close()
+		}
+	}
+	p.idle = nil
+}
@@ -0,0 +1,87 @@
+package forwarder
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Make connections to a listener, so that there is something to
+// close
+func makeConns(t *testing.T, inst *pooledInstance, n int) []*backendConn {
+	listener, err := net.ListenTCP("tcp", nil)
+	require.Nil(t, err)
+	defer listener.Close()
+
+	var conns []*backendConn
+	for i := 0; i < n; i++ {
+		conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		require.Nil(t, err)
+		conns = append(conns, &backendConn{TCPConn: conn, inst: inst})
+	}
+	return conns
+}
+
+func closed(bc *backendConn) bool {
+	return bc.SetDeadline(time.Time{}) != nil
+}
+
+func TestConnPool(t *testing.T) {
+	p := newConnPool()
+	p.maxIdle = 2
+	inst1, inst2 := &pooledInstance{Name: "inst1"}, &pooledInstance{Name: "inst2"}
+	conns := makeConns(t, inst1, 3)
+
+	require.Nil(t, p.get(inst1))
+
+	// The most recently used connection is taken first
+	p.put(conns[0])
+	p.put(conns[1])
+	require.Nil(t, p.get(inst2))
+	bc := p.get(inst1)
+	require.Equal(t, conns[1], bc)
+	require.True(t, bc.reused)
+
+	// Beyond the limit, the oldest connection is closed
+	p.put(conns[1])
+	p.put(conns[2])
+	require.True(t, closed(conns[0]))
+	require.Equal(t, conns[2], p.get(inst1))
+	require.Equal(t, conns[1], p.get(inst1))
+	require.Nil(t, p.get(inst1))
+
+	// Connections given back after stopping are closed
+	p.put(conns[1])
+	p.stop()
+	require.True(t, closed(conns[1]))
+	p.put(conns[2])
+	require.True(t, closed(conns[2]))
+}
+
+func TestConnPoolExpiry(t *testing.T) {
+	p := newConnPool()
+	tm := time.Now()
+	p.now = func() time.Time { return tm }
+	inst := &pooledInstance{Name: "inst"}
+	conns := makeConns(t, inst, 2)
+
+	p.put(conns[0])
+	tm = tm.Add(idle_conn_timeout / 2)
+	p.put(conns[1])
+
+	tm = tm.Add(idle_conn_timeout / 2)
+	p.expire()
+	require.True(t, closed(conns[0]))
+	require.False(t, closed(conns[1]))
+	require.NotNil(t, p.timer)
+
+	tm = tm.Add(idle_conn_timeout / 2)
+	p.expire()
+	require.True(t, closed(conns[1]))
+	require.Nil(t, p.get(inst))
+	require.Nil(t, p.timer)
+
+	p.stop()
+}
@@ -1,16 +1,25 @@
 package forwarder
 
 import (
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/balancer/model"
 	"github.com/weaveworks/flux/common/daemon"
-	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
 )
 
-const max_connection_attempts = 5
+const (
+	max_connection_attempts = 5
+	// How often to log the connections still active while draining
+	drain_report_interval = 10 * time.Second
+)
 
 type Config struct {
 	ServiceName  string
@@ -25,12 +34,52 @@ type Forwarder struct {
 
 	listener *net.TCPListener
 	pool     *instancePool
+	conns    *connPool
+	retries  retryBudget
+	stopped  bool
+
+	lock     sync.Mutex
 	protocol string
 	shim     shimFunc
-	stopped  bool
+	timeouts store.Timeouts
+	// The inbound connections being forwarded
+	active map[*connection]struct{}
+	// Set once the forwarder is draining
+	draining bool
+	// Closed when draining, once there are no active connections
+	drained chan struct{}
 }
 
-type shimFunc func(inbound, outbound *net.TCPConn, conn *events.Connection, eventHandler events.Handler) error
+// A shim copies traffic between the inbound connection and
+// connections to instances, which it makes as it needs them
+type shimFunc func(conn *connection) error
+
+// An inbound connection being forwarded
+type connection struct {
+	fwd      *Forwarder
+	inbound  *net.TCPConn
+	client   *net.TCPAddr
+	protocol string
+	shim     shimFunc
+	timeouts store.Timeouts
+	// When the http request being forwarded must be done by, or
+	// zero if there is no limit
+	deadline time.Time
+
+	start time.Time
+	// Received from and sent to the client; updated atomically
+	bytesIn, bytesOut int64
+
+	lock sync.Mutex
+	// The connection to an instance in use, if any
+	backend *backendConn
+	// The last instance used
+	last *pooledInstance
+	// How the connection ended, if known yet
+	closedBy string
+	// Whether the connection is waiting for an http request to start
+	idle bool
+}
 
 func (cf Config) New() (*Forwarder, error) {
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: cf.BindIP})
@@ -42,8 +91,10 @@ func (cf Config) New() (*Forwarder, error) {
 		Config:   cf,
 		listener: listener,
 		pool:     NewInstancePool(),
+		conns:    newConnPool(),
 		protocol: "tcp",
 		shim:     tcpShim,
+		active:   make(map[*connection]struct{}),
 	}
 
 	go fwd.run()
@@ -58,6 +109,87 @@ func (fwd *Forwarder) Stop() {
 	fwd.stopped = true
 	fwd.listener.Close()
 	fwd.pool.Stop()
+	fwd.conns.stop()
+}
+
+// Stop accepting connections, and stop once the active connections
+// have finished.  http connections are closed once they are between
+// requests.  With a drain timeout, any connections still active after
+// it are closed.
+func (fwd *Forwarder) Drain() {
+	fwd.stopped = true
+	fwd.listener.Close()
+	fwd.conns.stop()
+
+	fwd.lock.Lock()
+	fwd.draining = true
+	for conn := range fwd.active {
+		conn.closeIfIdle()
+	}
+	active := len(fwd.active)
+	timeout := time.Duration(fwd.timeouts.Drain)
+	drained := make(chan struct{})
+	if active != 0 {
+		fwd.drained = drained
+	}
+	fwd.lock.Unlock()
+
+	if active == 0 {
+		fwd.pool.Stop()
+		return
+	}
+
+	log.Infof("%s: draining %d active connections", fwd.Description, active)
+	go func() {
+		defer fwd.pool.Stop()
+
+		var timedOut <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timedOut = timer.C
+		}
+
+		report := time.NewTicker(drain_report_interval)
+		defer report.Stop()
+
+		for {
+			select {
+			case <-drained:
+				log.Infof("%s: drained", fwd.Description)
+				return
+			case <-timedOut:
+				n := fwd.closeConns(func(*connection) bool { return true })
+				log.Infof("%s: closed %d connections still active after drain timeout",
+					fwd.Description, n)
+				return
+			case <-report.C:
+				log.Infof("%s: draining %d active connections",
+					fwd.Description, fwd.countActive())
+			}
+		}
+	}()
+}
+
+func (fwd *Forwarder) countActive() int {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	return len(fwd.active)
+}
+
+// Close the connections chosen, returning how many were closed
+func (fwd *Forwarder) closeConns(choose func(*connection) bool) int {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	n := 0
+	for conn := range fwd.active {
+		if choose(conn) {
+			conn.close()
+			n++
+		}
+	}
+	return n
 }
 
 func (fwd *Forwarder) run() {
@@ -74,46 +206,278 @@ func (fwd *Forwarder) run() {
 	}
 }
 
+func (fwd *Forwarder) newConnection(inbound *net.TCPConn) *connection {
+	fwd.lock.Lock()
+	conn := &connection{
+		fwd:      fwd,
+		inbound:  inbound,
+		client:   inbound.RemoteAddr().(*net.TCPAddr),
+		protocol: fwd.protocol,
+		shim:     fwd.shim,
+		timeouts: fwd.timeouts,
+		start:    time.Now(),
+	}
+	fwd.lock.Unlock()
+
+	fwd.EventHandler.Connection(conn.event(nil))
+	return conn
+}
+
 func (fwd *Forwarder) forward(inbound *net.TCPConn) {
-	inAddr := inbound.RemoteAddr().(*net.TCPAddr)
+	conn := fwd.newConnection(inbound)
+	fwd.track(conn)
+	defer fwd.untrack(conn)
+
+	err := conn.shim(conn)
+	if err != nil {
+		log.Errorf("%s: forwarding from %s: %s",
+			fwd.Description, conn.client, err)
+	}
+	conn.closed(err)
+}
+
+func (fwd *Forwarder) track(conn *connection) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.active[conn] = struct{}{}
+}
+
+func (fwd *Forwarder) untrack(conn *connection) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	delete(fwd.active, conn)
+	if fwd.drained != nil && len(fwd.active) == 0 {
+		close(fwd.drained)
+		fwd.drained = nil
+	}
+}
+
+// Count the active connections using each of the instances given
+func (fwd *Forwarder) countConns(insts map[*pooledInstance]bool) map[*pooledInstance]int {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	counts := make(map[*pooledInstance]int)
+	for conn := range fwd.active {
+		if inst := conn.instance(); insts[inst] {
+			counts[inst]++
+		}
+	}
+	return counts
+}
 
+// Close the inbound connection, and the connection to an instance
+// if one is in use, after the drain timeout
+func (c *connection) close() {
+	c.setClosedBy(events.ClosedByTimeout)
+	c.inbound.Close()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.backend != nil {
+		c.backend.Close()
+	}
+}
+
+// Close the inbound connection if it is waiting for an http request,
+// because the forwarder is draining
+func (c *connection) closeIfIdle() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.idle {
+		c.closedBy = events.ClosedByDrain
+		c.inbound.Close()
+	}
+}
+
+// Mark the connection as waiting for an http request, or not.  A
+// draining forwarder closes connections while they are waiting, so
+// the result is false if the connection is, or has been, closed for
+// that.
+func (c *connection) setIdle(idle bool) bool {
+	c.fwd.lock.Lock()
+	defer c.fwd.lock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closedBy == events.ClosedByDrain {
+		return false
+	}
+	if idle && c.fwd.draining {
+		c.closedBy = events.ClosedByDrain
+		return false
+	}
+	c.idle = idle
+	return true
+}
+
+func (fwd *Forwarder) isDraining() bool {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	return fwd.draining
+}
+
+// Record how the connection ended, unless that is already known
+func (c *connection) setClosedBy(reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closedBy == "" {
+		c.closedBy = reason
+	}
+}
+
+// Report the connection as closed, given the error the shim returned.
+// Unless something else ended it first, it was either the error or
+// the client that did.
+func (c *connection) closed(err error) {
+	if err != nil {
+		c.setClosedBy(events.ClosedByError)
+	} else {
+		c.setClosedBy(events.ClosedByClient)
+	}
+
+	c.lock.Lock()
+	ev := &events.ConnectionClosed{
+		Connection: c.event(c.last),
+		BytesIn:    atomic.LoadInt64(&c.bytesIn),
+		BytesOut:   atomic.LoadInt64(&c.bytesOut),
+		Duration:   time.Since(c.start),
+		Reason:     c.closedBy,
+	}
+	c.lock.Unlock()
+	c.fwd.EventHandler.ConnectionClosed(ev)
+}
+
+// The instance in use, or nil if there is none
+func (c *connection) instance() *pooledInstance {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.backend == nil {
+		return nil
+	}
+	return c.backend.inst
+}
+
+func (c *connection) setBackend(bc *backendConn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.backend = bc
+	c.last = bc.inst
+}
+
+var (
+	errNoInstances = errors.New("ran out of instances")
+	errGaveUp      = errors.New("gave up trying to connect")
+)
+
+// Pick an instance other than those given, and get a connection to
+// it: an idle one kept from an earlier request if there is one,
+// otherwise a new one.  The connection should be given back with
+// release.
+func (c *connection) connect(except []*pooledInstance) (*backendConn, error) {
+	pool := c.fwd.pool
 	for i := 0; i < max_connection_attempts; i++ {
-		inst := fwd.pool.PickInstance()
+		inst := pool.PickInstanceExcept(c.client.IP, except)
 		if inst == nil {
-			log.Errorf("%s: ran out of instances for connection from %s",
-				fwd.Description, inAddr)
-			return
+			return nil, errNoInstances
 		}
 
-		outbound, err := net.DialTCP("tcp", nil, inst.Address.TCPAddr())
-		if err != nil {
-			log.Errorf("%s: connecting to %s: %s",
-				fwd.Description, inst.Address, err)
-			fwd.pool.Failed(inst)
-			continue
+		bc := c.fwd.conns.get(inst)
+		if bc == nil {
+			outbound, err := c.dial(inst)
+			if err != nil {
+				except = append(except, inst)
+				continue
+			}
+			bc = &backendConn{TCPConn: outbound, inst: inst}
 		}
 
-		fwd.pool.Succeeded(inst)
-		connEvent := &events.Connection{
-			ServiceName:  fwd.ServiceName,
-			Protocol:     fwd.protocol,
-			InstanceName: inst.Name,
-			InstanceAddr: inst.Address,
-			Inbound:      inAddr,
-		}
-		fwd.EventHandler.Connection(connEvent)
+		pool.Connected(inst)
+		c.setBackend(bc)
+		return bc, nil
+	}
 
-		err = fwd.shim(inbound, outbound, connEvent, fwd.EventHandler)
-		if err != nil {
-			log.Errorf("%s: forwarding from %s to %s: %s",
-				fwd.Description, inAddr, inst.Address, err)
+	return nil, errGaveUp
+}
+
+// Make a new connection to the instance
+func (c *connection) dial(inst *pooledInstance) (*net.TCPConn, error) {
+	fwd := c.fwd
+	dialer := net.Dialer{Timeout: time.Duration(c.timeouts.Connect)}
+	outbound, err := dialer.Dial("tcp", inst.Address.String())
+	if err != nil {
+		log.Errorf("%s: connecting to %s: %s",
+			fwd.Description, inst.Address, err)
+		if isTimeout(err) {
+			c.timedOut(events.TimeoutConnect, inst)
 		}
-		return
+		fwd.pool.Failed(inst)
+		return nil, err
 	}
 
-	inbound.Close()
-	log.Errorf("%s: gave up trying to connect for connection from %s",
-		fwd.Description, inAddr)
+	fwd.pool.Succeeded(inst)
+	fwd.EventHandler.Dial(&events.Dial{Connection: c.event(inst)})
+	return outbound.(*net.TCPConn), nil
+}
+
+// The instance may be nil, when it is not known
+func (c *connection) event(inst *pooledInstance) *events.Connection {
+	ev := &events.Connection{
+		Time:        time.Now(),
+		ServiceName: c.fwd.ServiceName,
+		Protocol:    c.protocol,
+		Inbound:     c.client,
+	}
+	if inst != nil {
+		ev.InstanceName = inst.Name
+		ev.InstanceAddr = inst.Address
+	}
+	return ev
+}
+
+func (c *connection) timedOut(kind string, inst *pooledInstance) {
+	c.fwd.EventHandler.Timeout(&events.Timeout{
+		Connection: c.event(inst),
+		Kind:       kind,
+	})
+}
+
+// The connection is to be closed because of a timeout
+func (c *connection) closeForTimeout(kind string, inst *pooledInstance) {
+	c.setClosedBy(events.ClosedByTimeout)
+	c.timedOut(kind, inst)
+}
+
+func isTimeout(err error) bool {
+	neterr, ok := err.(net.Error)
+	return ok && neterr.Timeout()
+}
+
+// Finish with a connection to an instance, keeping it for later
+// requests if it can be reused
+func (c *connection) release(bc *backendConn, reuse bool) {
+	c.lock.Lock()
+	if c.backend == bc {
+		c.backend = nil
+	}
+	c.lock.Unlock()
+
+	c.fwd.pool.Disconnected(bc.inst)
+	if reuse {
+		bc.SetDeadline(time.Time{})
+		c.fwd.conns.put(bc)
+	} else {
+		bc.Close()
+	}
+}
+
+// Record the status of a response from the instance, or 0 if a
+// request got no response
+func (c *connection) responded(inst *pooledInstance, status int) {
+	if c.fwd.pool.Responded(inst, status) {
+		log.Warnf("%s: ejecting instance %s at %s after too many errors",
+			c.fwd.Description, inst.Name, inst.Address)
+	}
 }
 
 var shims = map[string]shimFunc{
@@ -131,31 +495,166 @@ func (fwd *Forwarder) SetProtocol(proto string) {
 		shim = tcpShim
 	}
 
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
 	fwd.protocol = proto
 	fwd.shim = shim
 }
 
-func (fwd *Forwarder) SetInstances(instances map[string]netutil.IPPort) {
-	fwd.pool.UpdateInstances(instances)
+func (fwd *Forwarder) SetStrategy(strategy string) {
+	if !fwd.pool.SetStrategy(strategy) {
+		log.Warn(fwd.Description,
+			": no support for load-balancing strategy ", strategy,
+			", falling back to random")
+		fwd.pool.SetStrategy(store.StrategyRandom)
+	}
+}
+
+func (fwd *Forwarder) SetTraffic(traffic map[string]int) {
+	fwd.pool.SetTraffic(traffic)
+}
+
+func (fwd *Forwarder) SetOutlierDetection(od *store.OutlierDetection) {
+	fwd.pool.SetOutlierDetection(od)
+}
+
+func (fwd *Forwarder) SetRetries(policy *store.RetryPolicy) {
+	fwd.retries.setPolicy(policy)
+}
+
+func (fwd *Forwarder) SetTimeouts(timeouts store.Timeouts) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.timeouts = timeouts
+}
+
+// Set the instances to forward to.  Instances that have been removed
+// get no new connections, but keep those they have; with a drain
+// timeout, those still active after it are closed.
+func (fwd *Forwarder) SetInstances(instances map[string]model.Instance) {
+	removed := fwd.pool.UpdateInstances(instances)
+	if len(removed) == 0 {
+		return
+	}
+
+	fwd.conns.closeIdle(removed)
+	draining := make(map[*pooledInstance]bool)
+	for _, inst := range removed {
+		draining[inst] = true
+	}
+
+	if !fwd.reportDraining(draining) {
+		return
+	}
+
+	fwd.lock.Lock()
+	timeout := time.Duration(fwd.timeouts.Drain)
+	fwd.lock.Unlock()
+	go fwd.drainInstances(draining, timeout)
+}
+
+// Log the active connections to the instances being drained,
+// returning whether there are any
+func (fwd *Forwarder) reportDraining(draining map[*pooledInstance]bool) bool {
+	counts := fwd.countConns(draining)
+	for inst, n := range counts {
+		log.Infof("%s: draining %d active connections to removed instance %s at %s",
+			fwd.Description, n, inst.Name, inst.Address)
+	}
+	return len(counts) != 0
+}
+
+// Keep reporting the connections to removed instances until they
+// have finished, closing them if the drain timeout comes first
+func (fwd *Forwarder) drainInstances(draining map[*pooledInstance]bool, timeout time.Duration) {
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	report := time.NewTicker(drain_report_interval)
+	defer report.Stop()
+
+	for {
+		select {
+		case <-timedOut:
+			n := fwd.closeConns(func(conn *connection) bool {
+				return draining[conn.instance()]
+			})
+			if n > 0 {
+				log.Infof("%s: closed %d connections to removed instances after drain timeout",
+					fwd.Description, n)
+			}
+			return
+		case <-report.C:
+			if !fwd.reportDraining(draining) {
+				log.Infof("%s: drained removed instances", fwd.Description)
+				return
+			}
+		}
+	}
 }
 
-func tcpShim(inbound, outbound *net.TCPConn, connEvent *events.Connection, eh events.Handler) error {
+func tcpShim(conn *connection) error {
+	inbound := conn.inbound
+	bc, err := conn.connect(nil)
+	if err != nil {
+		inbound.Close()
+		return err
+	}
+	defer conn.release(bc, false)
+	outbound := bc.TCPConn
+
+	// With an idle timeout, the connections are closed if nothing
+	// is read from either for that long.  Otherwise they are
+	// copied between as they are, so that io.Copy can splice them.
+	var in, out io.Reader = inbound, outbound
+	var timedOut int32
+	if idle := time.Duration(conn.timeouts.Idle); idle > 0 {
+		idleTimer := time.AfterFunc(idle, func() {
+			if atomic.CompareAndSwapInt32(&timedOut, 0, 1) {
+				conn.closeForTimeout(events.TimeoutIdle, bc.inst)
+				inbound.Close()
+				outbound.Close()
+			}
+		})
+		defer idleTimer.Stop()
+		in = activityReader{inbound, idleTimer, idle}
+		out = activityReader{outbound, idleTimer, idle}
+	}
+	// Whichever side finishes sending first is taken to have
+	// closed the connection
 	ch := make(chan error, 1)
 	go func() {
 		var err error
 		defer func() { ch <- err }()
-		_, err = io.Copy(inbound, outbound)
+		var n int64
+		n, err = io.Copy(inbound, out)
+		atomic.AddInt64(&conn.bytesOut, n)
+		if err == nil {
+			conn.setClosedBy(events.ClosedByInstance)
+		}
 		outbound.CloseRead()
 		inbound.CloseWrite()
 	}()
 
-	_, err1 := io.Copy(outbound, inbound)
+	n, err1 := io.Copy(outbound, in)
+	atomic.AddInt64(&conn.bytesIn, n)
+	if err1 == nil {
+		conn.setClosedBy(events.ClosedByClient)
+	}
 	inbound.CloseRead()
 	outbound.CloseWrite()
 
 	err2 := <-ch
 	inbound.Close()
-	outbound.Close()
+
+	if atomic.LoadInt32(&timedOut) != 0 {
+		// Already reported
+		return nil
+	}
 
 	if err1 != nil {
 		return err1
@@ -163,3 +662,42 @@ func tcpShim(inbound, outbound *net.TCPConn, connEvent *events.Connection, eh ev
 		return err2
 	}
 }
+
+// Counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// Counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// Puts off a timer whenever something is read
+type activityReader struct {
+	io.Reader
+	timer *time.Timer
+	d     time.Duration
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.d)
+	}
+	return n, err
+}
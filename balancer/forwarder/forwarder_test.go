@@ -1,7 +1,9 @@
 package forwarder
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
@@ -11,8 +13,10 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/balancer/model"
 	"github.com/weaveworks/flux/common/daemon"
 	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
 )
 
 func TestForwarder(t *testing.T) {
@@ -31,13 +35,13 @@ func TestForwarder(t *testing.T) {
 	require.Nil(t, err)
 
 	fwd.SetProtocol("tcp")
-	fwd.SetInstances(map[string]netutil.IPPort{
-		"inst": netutil.NewIPPort(laddr.IP, laddr.Port),
+	fwd.SetInstances(map[string]model.Instance{
+		"inst": {Address: netutil.NewIPPort(laddr.IP, laddr.Port)},
 	})
 
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	expect := fmt.Sprint(rng.Int63())
-	got := ""
+	got := make(chan string, 1)
 
 	go func() {
 		for {
@@ -49,7 +53,7 @@ func TestForwarder(t *testing.T) {
 			b, err := ioutil.ReadAll(conn)
 			require.Nil(t, err)
 			require.Nil(t, conn.Close())
-			got = string(b)
+			got <- string(b)
 		}
 	}()
 
@@ -62,8 +66,229 @@ func TestForwarder(t *testing.T) {
 	_, err = ioutil.ReadAll(conn)
 	require.Nil(t, err)
 	require.Nil(t, conn.Close())
-	require.Equal(t, expect, got)
+	require.Equal(t, expect, <-got)
 
 	listener.Close()
 	fwd.Stop()
 }
+
+func TestTcpIdleTimeout(t *testing.T) {
+	// A server that accepts connections and does nothing with them
+	listener, err := net.ListenTCP("tcp", nil)
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			if _, err := listener.AcceptTCP(); err != nil {
+				return
+			}
+		}
+	}()
+
+	w := wrapShim(tcpShim, t, listener.Addr().(*net.TCPAddr))
+	defer w.stop()
+	w.fwd.SetTimeouts(store.Timeouts{Idle: store.Duration(50 * time.Millisecond)})
+
+	conn, err := net.DialTCP("tcp", nil, w.addr())
+	require.Nil(t, err)
+
+	// Traffic puts off the timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, err = conn.Write([]byte("ping"))
+		require.Nil(t, err)
+	}
+	require.Empty(t, w.timeouts)
+
+	_, err = ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	ev := <-w.timeouts
+	require.Equal(t, events.TimeoutIdle, ev.Kind)
+	require.Equal(t, "inst1", ev.InstanceName)
+}
+
+// Echo lines back to each connection made
+func echoServer(t *testing.T) *net.TCPListener {
+	listener, err := net.ListenTCP("tcp", nil)
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return listener
+}
+
+func echo(conn *net.TCPConn, t *testing.T) error {
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err == nil {
+		require.Equal(t, "ping\n", line)
+	}
+	return err
+}
+
+func newTestForwarder(t *testing.T, insts map[string]*net.TCPListener) *Forwarder {
+	fwd, err := Config{
+		ServiceName:  "service",
+		Description:  "service",
+		BindIP:       net.ParseIP("127.42.0.1"),
+		EventHandler: events.NullHandler{},
+		ErrorSink:    daemon.NewErrorSink(),
+	}.New()
+	require.Nil(t, err)
+	fwd.SetTimeouts(store.Timeouts{Drain: store.Duration(100 * time.Millisecond)})
+	setInstances(fwd, insts)
+	return fwd
+}
+
+func setInstances(fwd *Forwarder, insts map[string]*net.TCPListener) {
+	mis := make(map[string]model.Instance)
+	for name, l := range insts {
+		addr := l.Addr().(*net.TCPAddr)
+		mis[name] = model.Instance{Address: netutil.NewIPPort(addr.IP, addr.Port)}
+	}
+	fwd.SetInstances(mis)
+}
+
+func TestDrainInstance(t *testing.T) {
+	l1, l2 := echoServer(t), echoServer(t)
+	defer l1.Close()
+	defer l2.Close()
+	fwd := newTestForwarder(t, map[string]*net.TCPListener{"inst1": l1})
+	defer fwd.Stop()
+
+	conn1, err := net.DialTCP("tcp", nil, fwd.Addr())
+	require.Nil(t, err)
+	require.Nil(t, echo(conn1, t))
+
+	// The connection to the removed instance carries on, while
+	// new connections go to the other instance
+	setInstances(fwd, map[string]*net.TCPListener{"inst2": l2})
+	conn2, err := net.DialTCP("tcp", nil, fwd.Addr())
+	require.Nil(t, err)
+	require.Nil(t, echo(conn2, t))
+	require.Nil(t, echo(conn1, t))
+
+	// Until the drain timeout
+	time.Sleep(200 * time.Millisecond)
+	require.NotNil(t, echo(conn1, t))
+	require.Nil(t, echo(conn2, t))
+}
+
+func TestDrainForwarder(t *testing.T) {
+	l := echoServer(t)
+	defer l.Close()
+
+	// Without active connections, the forwarder stops straight away
+	fwd := newTestForwarder(t, map[string]*net.TCPListener{"inst": l})
+	fwd.Drain()
+	_, err := net.DialTCP("tcp", nil, fwd.Addr())
+	require.NotNil(t, err)
+
+	// Active connections carry on until they finish, or until
+	// the drain timeout
+	fwd = newTestForwarder(t, map[string]*net.TCPListener{"inst": l})
+	conn1, err := net.DialTCP("tcp", nil, fwd.Addr())
+	require.Nil(t, err)
+	require.Nil(t, echo(conn1, t))
+	conn2, err := net.DialTCP("tcp", nil, fwd.Addr())
+	require.Nil(t, err)
+	require.Nil(t, echo(conn2, t))
+
+	fwd.Drain()
+	_, err = net.DialTCP("tcp", nil, fwd.Addr())
+	require.NotNil(t, err)
+	require.Nil(t, echo(conn1, t))
+	require.Nil(t, conn2.Close())
+
+	time.Sleep(200 * time.Millisecond)
+	require.NotNil(t, echo(conn1, t))
+	fwd.lock.Lock()
+	require.Empty(t, fwd.active)
+	fwd.lock.Unlock()
+}
+
+func TestTcpConnectionClosed(t *testing.T) {
+	// A server that greets each connection, then reads until the
+	// client is done
+	listener, err := net.ListenTCP("tcp", nil)
+	require.Nil(t, err)
+	defer listener.Close()
+	hangup := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello\n"))
+			if <-hangup {
+				conn.Close()
+				continue
+			}
+			ioutil.ReadAll(conn)
+			conn.Close()
+		}
+	}()
+
+	w := wrapShim(tcpShim, t, listener.Addr().(*net.TCPAddr))
+	defer w.stop()
+
+	// Closed by the client
+	hangup <- false
+	conn, err := net.DialTCP("tcp", nil, w.addr())
+	require.Nil(t, err)
+	_, err = conn.Write([]byte("ping\n"))
+	require.Nil(t, err)
+	require.Nil(t, conn.CloseWrite())
+	b, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", string(b))
+	require.Nil(t, conn.Close())
+
+	ev := <-w.closed
+	require.Equal(t, events.ClosedByClient, ev.Reason)
+	require.Equal(t, "inst1", ev.InstanceName)
+	require.Equal(t, int64(5), ev.BytesIn)
+	require.Equal(t, int64(6), ev.BytesOut)
+	require.True(t, ev.Duration > 0)
+
+	// Closed by the instance
+	hangup <- true
+	conn, err = net.DialTCP("tcp", nil, w.addr())
+	require.Nil(t, err)
+	b, err = ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", string(b))
+	require.Nil(t, conn.Close())
+
+	ev = <-w.closed
+	require.Equal(t, events.ClosedByInstance, ev.Reason)
+	require.Equal(t, int64(0), ev.BytesIn)
+	require.Equal(t, int64(6), ev.BytesOut)
+
+	// The bytes are counted the same way with an idle timeout
+	w.fwd.SetTimeouts(store.Timeouts{Idle: store.Duration(time.Minute)})
+	hangup <- false
+	conn, err = net.DialTCP("tcp", nil, w.addr())
+	require.Nil(t, err)
+	_, err = conn.Write([]byte("ping\n"))
+	require.Nil(t, err)
+	require.Nil(t, conn.CloseWrite())
+	b, err = ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", string(b))
+	require.Nil(t, conn.Close())
+
+	ev = <-w.closed
+	require.Equal(t, events.ClosedByClient, ev.Reason)
+	require.Equal(t, int64(5), ev.BytesIn)
+	require.Equal(t, int64(6), ev.BytesOut)
+}
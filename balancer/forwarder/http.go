@@ -2,104 +2,274 @@ package forwarder
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+
 	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/common/store"
 )
 
-func httpShim(inbound, outbound *net.TCPConn, connEvent *events.Connection, eh events.Handler) error {
-	eh.Connection(connEvent)
-	defer inbound.Close()
-	defer outbound.Close()
-
-	// Request handling and response handling take place in
-	// separate goroutines.  This is not to support pipelining
-	// (although it could easily be extended to do so).  Rather,
-	// it is to support cases where the server produces a response
-	// before the client is done sending the request (e.g. when
-	// the server produces an error response before reading the
-	// whole request).
-
-	type request struct {
-		req      *http.Request
-		tReadReq time.Time
-		err      error
-	}
+// Requests are forwarded one at a time, each to an instance picked for
+// it, over connections that are kept open between requests.
+func httpShim(conn *connection) error {
+	fwd := conn.fwd
+	defer conn.inbound.Close()
 
-	reqCh := make(chan request)
-	doneCh := make(chan struct{})
-	defer close(doneCh)
+	timeouts := conn.timeouts
+	reqrd := bufio.NewReader(countingReader{conn.inbound, &conn.bytesIn})
+	out := countingWriter{conn.inbound, &conn.bytesOut}
+	for {
+		// Wait for a request to start, then for the rest of its
+		// header.  A draining forwarder closes the connection
+		// while it waits.
+		if !conn.setIdle(true) {
+			return nil
+		}
+		conn.inbound.SetReadDeadline(deadline(timeouts.Idle))
+		_, err := reqrd.Peek(1)
+		if !conn.setIdle(false) {
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if isTimeout(err) {
+				conn.closeForTimeout(events.TimeoutIdle, nil)
+				return nil
+			}
+			return err
+		}
 
-	passReq := func(req request) bool {
-		select {
-		case reqCh <- req:
-			return true
-		case <-doneCh:
-			return false
+		conn.inbound.SetReadDeadline(deadline(timeouts.RequestHeader))
+		req, err := http.ReadRequest(reqrd)
+		if err != nil {
+			if isTimeout(err) {
+				conn.closeForTimeout(events.TimeoutRequestHeader, nil)
+				return nil
+			}
+			return err
 		}
-	}
+		tReadReq := time.Now()
 
-	// The request handler loop
-	go func() {
-		reqrd := bufio.NewReader(inbound)
-		for {
-			// XXX timeout on no request
-			req, err := http.ReadRequest(reqrd)
-			if err != nil {
-				if err == io.EOF {
-					close(reqCh)
-					return
+		// The rest of the exchange, including reading the body
+		// of the request, has to be done by the deadline
+		conn.deadline = deadline(timeouts.Request)
+		conn.inbound.SetDeadline(conn.deadline)
+
+		// To be retried, a request's body must be kept so that
+		// it can be sent again
+		var body []byte
+		policy := fwd.retries.policyFor(req)
+		if policy != nil {
+			if body, err = bufferBody(req, policy.MaxBodyBytes); err != nil {
+				if isTimeout(err) {
+					conn.closeForTimeout(events.TimeoutRequest, nil)
+					return nil
 				}
+				return err
+			}
+		}
+
+		outbound, err := conn.connect(nil)
+		if err != nil {
+			return err
+		}
+
+		var tried []*pooledInstance
+		var resp *http.Response
+		var wrote <-chan error
+		for {
+			resp, wrote, err = conn.roundTrip(outbound, req, body)
 
-				passReq(request{err: err})
-				return
+			status := 0
+			if err == nil {
+				status = resp.StatusCode
 			}
+			conn.responded(outbound.inst, status)
 
-			if !passReq(request{req: req, tReadReq: time.Now()}) {
-				return
+			// A request that timed out has no time left
+			// to be retried
+			if err != nil && isTimeout(err) {
+				break
 			}
 
-			err = req.Write(outbound)
-			if err != nil {
-				passReq(request{err: err})
-				return
+			if body == nil || len(tried) >= policy.MaxRetries ||
+				!(status == 0 || status == http.StatusBadGateway || status == http.StatusServiceUnavailable) ||
+				!fwd.retries.withdraw() {
+				break
 			}
-		}
-	}()
 
-	// The response handler loop
-	resprd := bufio.NewReader(outbound)
-	for {
-		req, ok := <-reqCh
-		if !ok {
-			return nil
-		}
+			tried = append(tried, outbound.inst)
+			next, cerr := conn.connect(tried)
+			if cerr != nil {
+				break
+			}
 
-		if req.err != nil {
-			return req.err
-		}
+			// The request is no longer being written to the
+			// old connection, once it is closed
+			failed := outbound.inst
+			conn.release(outbound, false)
+			<-wrote
+			outbound = next
 
-		resp, err := http.ReadResponse(resprd, req.req)
+			reason := http.StatusText(status)
+			if err != nil {
+				reason = err.Error()
+			}
+			log.Infof("%s: retrying %s %s on %s, after %s from %s",
+				fwd.Description, req.Method, req.URL, outbound.inst.Address, reason, failed.Address)
+		}
 		tReadResponse := time.Now()
 		if err != nil {
+			conn.release(outbound, false)
+			if isTimeout(err) {
+				conn.closeForTimeout(events.TimeoutRequest, outbound.inst)
+				return gatewayTimeout(conn.inbound, out, req)
+			}
 			return err
 		}
 
-		err = resp.Write(inbound)
+		// Once the forwarder is draining, the client is told to
+		// close the connection after this response
+		instClose := resp.Close
+		if fwd.isDraining() {
+			resp.Close = true
+		}
+		err = resp.Write(out)
 		tWroteResponse := time.Now()
+
+		// The server may have responded before reading all of
+		// the request; it has to be sent regardless before the
+		// connection can be used for another request
+		werr := <-wrote
+		conn.release(outbound, err == nil && werr == nil && !req.Close && !instClose)
+		if err == nil {
+			err = werr
+		}
 		if err != nil {
+			if isTimeout(err) {
+				conn.closeForTimeout(events.TimeoutRequest, outbound.inst)
+				return nil
+			}
 			return err
 		}
+		conn.inbound.SetWriteDeadline(time.Time{})
 
-		eh.HttpExchange(&events.HttpExchange{
-			Connection: connEvent,
-			Request:    req.req,
+		fwd.EventHandler.HttpExchange(&events.HttpExchange{
+			Connection: conn.event(outbound.inst),
+			Request:    req,
 			Response:   resp,
-			RoundTrip:  tReadResponse.Sub(req.tReadReq),
-			TotalTime:  tWroteResponse.Sub(req.tReadReq),
+			RoundTrip:  tReadResponse.Sub(tReadReq),
+			TotalTime:  tWroteResponse.Sub(tReadReq),
 		})
+
+		if req.Close {
+			return nil
+		}
+
+		// The client has been told that the connection is to be
+		// closed, and may need it to be, to see the end of the
+		// response
+		if instClose {
+			conn.setClosedBy(events.ClosedByInstance)
+			return nil
+		}
+		if resp.Close {
+			conn.setClosedBy(events.ClosedByDrain)
+			return nil
+		}
 	}
 }
+
+// Send a request on a connection to an instance, and read the
+// response.  If the connection was kept from an earlier request, the
+// instance may have closed it in the meantime; if so, the request is
+// sent again on a new connection, where that is safe.
+func (c *connection) roundTrip(bc *backendConn, req *http.Request, body []byte) (*http.Response, <-chan error, error) {
+	for {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if bc.rd == nil {
+			bc.rd = bufio.NewReader(bc)
+		}
+		bc.SetDeadline(c.deadline)
+
+		resp, wrote, err := roundTrip(req, bc, bc.rd)
+		if err == nil || !bc.reused || isTimeout(err) || !canResend(req, body) {
+			return resp, wrote, err
+		}
+
+		bc.Close()
+		outbound, derr := c.dial(bc.inst)
+		if derr != nil {
+			return nil, wrote, err
+		}
+
+		<-wrote
+		c.lock.Lock()
+		bc.TCPConn = outbound
+		c.lock.Unlock()
+		bc.rd = nil
+		bc.reused = false
+	}
+}
+
+// When something that may take as long as the timeout given must be
+// done by, or zero if there is no timeout
+func deadline(timeout store.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(timeout))
+}
+
+// Tell the client that its request timed out waiting for the
+// instance, and that the connection is to be closed
+func gatewayTimeout(inbound *net.TCPConn, out io.Writer, req *http.Request) error {
+	inbound.SetWriteDeadline(time.Time{})
+	resp := &http.Response{
+		StatusCode: http.StatusGatewayTimeout,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Close:      true,
+	}
+	return resp.Write(out)
+}
+
+// Whether a request can be sent again without harm: it must have a
+// body that was kept, or no body, and it must be idempotent
+func canResend(req *http.Request, body []byte) bool {
+	if body != nil {
+		// Only kept for idempotent requests
+		return true
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+	}
+	return false
+}
+
+// Send a request and read the response.  The request is written
+// concurrently with reading the response, to support cases where the
+// server produces a response before the client is done sending the
+// request (e.g. when the server produces an error response before
+// reading the whole request).  The result of writing the request is
+// sent on the channel returned.
+func roundTrip(req *http.Request, outbound io.Writer, resprd *bufio.Reader) (*http.Response, <-chan error, error) {
+	wrote := make(chan error, 1)
+	go func() { wrote <- req.Write(outbound) }()
+
+	resp, err := http.ReadResponse(resprd, req)
+	return resp, wrote, err
+}
@@ -1,6 +1,7 @@
 package forwarder
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -14,18 +15,30 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/balancer/model"
 	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
 )
 
 type shimWrapper struct {
 	listener    *net.TCPListener
 	baseUrl     string
 	exchanges   chan *events.HttpExchange
+	timeouts    chan *events.Timeout
+	closed      chan *events.ConnectionClosed
+	accepted    chan *events.Connection
+	dials       chan *events.Dial
 	connections int
+	fwd         *Forwarder
+	// Whether the shim may fail, e.g. when a server closes the
+	// connection without responding
+	allowErrors bool
 	events.NullHandler
 }
 
-func wrapShim(shim shimFunc, target *net.TCPAddr, t *testing.T) *shimWrapper {
+// Forward connections with the shim to the targets given, as the
+// instances inst1, inst2, ...
+func wrapShim(shim shimFunc, t *testing.T, targets ...*net.TCPAddr) *shimWrapper {
 	listener, err := net.ListenTCP("tcp", nil)
 	require.Nil(t, err)
 	laddr := listener.Addr().(*net.TCPAddr)
@@ -33,9 +46,29 @@ func wrapShim(shim shimFunc, target *net.TCPAddr, t *testing.T) *shimWrapper {
 	w := &shimWrapper{
 		listener:  listener,
 		exchanges: make(chan *events.HttpExchange, 100),
+		timeouts:  make(chan *events.Timeout, 100),
+		closed:    make(chan *events.ConnectionClosed, 100),
+		accepted:  make(chan *events.Connection, 100),
+		dials:     make(chan *events.Dial, 100),
 		baseUrl:   fmt.Sprintf("http://localhost:%d/", laddr.Port),
 	}
 
+	w.fwd = &Forwarder{
+		Config: Config{
+			ServiceName:  "service",
+			Description:  "service",
+			EventHandler: w,
+		},
+		pool:     NewInstancePool(),
+		conns:    newConnPool(),
+		protocol: "http",
+	}
+	insts := make(map[string]model.Instance)
+	for i, target := range targets {
+		insts[fmt.Sprintf("inst%d", i+1)] = model.Instance{Address: netutil.NewIPPort(target.IP, target.Port)}
+	}
+	w.fwd.pool.UpdateInstances(insts)
+
 	go func() {
 		for {
 			inbound, err := listener.AcceptTCP()
@@ -47,16 +80,12 @@ func wrapShim(shim shimFunc, target *net.TCPAddr, t *testing.T) *shimWrapper {
 
 			w.connections++
 			go func() {
-				outbound, err := net.DialTCP("tcp", nil, target)
-				require.Nil(t, err)
-				cevent := &events.Connection{
-					ServiceName:  "service",
-					Protocol:     "http",
-					InstanceName: "inst",
-					InstanceAddr: netutil.NewIPPort(laddr.IP, laddr.Port),
-					Inbound:      inbound.RemoteAddr().(*net.TCPAddr),
+				conn := w.fwd.newConnection(inbound)
+				err := shim(conn)
+				if !w.allowErrors {
+					require.Nil(t, err)
 				}
-				require.Nil(t, shim(inbound, outbound, cevent, w))
+				conn.closed(err)
 			}()
 		}
 	}()
@@ -71,6 +100,7 @@ func (w *shimWrapper) addr() *net.TCPAddr {
 func (w *shimWrapper) stop() error {
 	l := w.listener
 	w.listener = nil
+	w.fwd.conns.stop()
 	return l.Close()
 }
 
@@ -78,6 +108,22 @@ func (w *shimWrapper) HttpExchange(exch *events.HttpExchange) {
 	w.exchanges <- exch
 }
 
+func (w *shimWrapper) Timeout(ev *events.Timeout) {
+	w.timeouts <- ev
+}
+
+func (w *shimWrapper) Connection(ev *events.Connection) {
+	w.accepted <- ev
+}
+
+func (w *shimWrapper) Dial(ev *events.Dial) {
+	w.dials <- ev
+}
+
+func (w *shimWrapper) ConnectionClosed(ev *events.ConnectionClosed) {
+	w.closed <- ev
+}
+
 func readAll(r io.ReadCloser, t *testing.T) string {
 	b, err := ioutil.ReadAll(r)
 	require.Nil(t, err)
@@ -109,7 +155,7 @@ func newHarness(t *testing.T) *harness {
 		w.Write(([]byte)(h.expectOut))
 	})
 
-	h.shimWrapper = wrapShim(httpShim, l.Addr().(*net.TCPAddr), t)
+	h.shimWrapper = wrapShim(httpShim, t, l.Addr().(*net.TCPAddr))
 
 	go func() { http.Serve(l, mux) }()
 
@@ -198,9 +244,7 @@ func TestHttp(t *testing.T) {
 }
 
 func noKeepAlivesClient() *http.Client {
-	transport := *http.DefaultTransport.(*http.Transport)
-	transport.DisableKeepAlives = true
-	return &http.Client{Transport: &transport}
+	return &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
 }
 
 func TestHttpNoKeepAlive(t *testing.T) {
@@ -210,3 +254,348 @@ func TestHttpNoKeepAlive(t *testing.T) {
 	test(harness, noKeepAlivesClient(), t)
 	require.Equal(t, 6, harness.connections)
 }
+
+// Forward to two servers, one of them bad, with retries for GET and
+// PUT requests.  The bodies of requests to the good server come out
+// of the channel returned.
+func newRetryHarness(bad http.HandlerFunc, t *testing.T) (*shimWrapper, <-chan string, func()) {
+	var servers []net.Listener
+	var targets []*net.TCPAddr
+	gotIn := make(chan string, 100)
+	good := func(w http.ResponseWriter, req *http.Request) {
+		gotIn <- readAll(req.Body, t)
+		w.Write([]byte("good"))
+	}
+
+	for _, h := range []http.HandlerFunc{good, bad} {
+		l, err := net.ListenTCP("tcp", nil)
+		require.Nil(t, err)
+		go func(h http.HandlerFunc) { http.Serve(l, h) }(h)
+		servers = append(servers, l)
+		targets = append(targets, l.Addr().(*net.TCPAddr))
+	}
+
+	w := wrapShim(httpShim, t, targets...)
+	w.allowErrors = true
+	w.fwd.SetRetries(&store.RetryPolicy{
+		Methods:       []string{"PUT"},
+		MaxRetries:    1,
+		BudgetPercent: 100,
+	})
+
+	return w, gotIn, func() {
+		for _, l := range servers {
+			require.Nil(t, l.Close())
+		}
+		require.Nil(t, w.stop())
+	}
+}
+
+func testRetries(bad http.HandlerFunc, t *testing.T) {
+	w, gotIn, stop := newRetryHarness(bad, t)
+	defer stop()
+	client := noKeepAlivesClient()
+
+	// Every GET should end up with the good server, whichever is
+	// picked first
+	for i := 0; i < 20; i++ {
+		res, err := client.Get(w.baseUrl)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "good", readAll(res.Body, t))
+		require.Equal(t, "", <-gotIn)
+		<-w.exchanges
+	}
+
+	// The body of a request is sent again when it is retried
+	for i := 0; i < 20; i++ {
+		body := fmt.Sprint("put ", i)
+		req, err := http.NewRequest("PUT", w.baseUrl, bytes.NewBufferString(body))
+		require.Nil(t, err)
+		res, err := client.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		readAll(res.Body, t)
+		require.Equal(t, body, <-gotIn)
+		<-w.exchanges
+	}
+
+	// POSTs are not retried
+	failed := 0
+	for i := 0; i < 20; i++ {
+		res, err := client.Post(w.baseUrl, "text/plain", bytes.NewBufferString("post"))
+		if err != nil || res.StatusCode != http.StatusOK {
+			failed++
+			continue
+		}
+		readAll(res.Body, t)
+	}
+	require.NotZero(t, failed)
+}
+
+func TestHttpRetryUnavailable(t *testing.T) {
+	testRetries(func(w http.ResponseWriter, req *http.Request) {
+		readAll(req.Body, t)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, t)
+}
+
+func TestHttpRetryNoResponse(t *testing.T) {
+	testRetries(func(w http.ResponseWriter, req *http.Request) {
+		readAll(req.Body, t)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.Nil(t, err)
+		conn.Close()
+	}, t)
+}
+
+// Serve http requests, counting the connections made
+func countingServer(h http.HandlerFunc, t *testing.T) (*net.TCPAddr, *int, func()) {
+	l, err := net.ListenTCP("tcp", nil)
+	require.Nil(t, err)
+
+	conns := 0
+	server := &http.Server{
+		Handler: h,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns++
+			}
+		},
+	}
+	go server.Serve(l)
+	return l.Addr().(*net.TCPAddr), &conns, func() { require.Nil(t, l.Close()) }
+}
+
+func TestHttpBalancePerRequest(t *testing.T) {
+	var targets []*net.TCPAddr
+	var conns []*int
+	for i := 1; i <= 2; i++ {
+		name := fmt.Sprint("inst", i)
+		addr, count, stop := countingServer(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name))
+		}, t)
+		defer stop()
+		targets = append(targets, addr)
+		conns = append(conns, count)
+	}
+
+	w := wrapShim(httpShim, t, targets...)
+	defer w.stop()
+	w.fwd.SetStrategy("round-robin")
+
+	// Requests on the one client connection are shared out between
+	// the instances, over one kept-alive connection to each
+	client := &http.Client{Transport: &http.Transport{}}
+	got := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		res, err := client.Get(w.baseUrl)
+		require.Nil(t, err)
+		got[readAll(res.Body, t)]++
+		<-w.exchanges
+	}
+
+	require.Equal(t, map[string]int{"inst1": 10, "inst2": 10}, got)
+	require.Equal(t, 1, w.connections)
+	require.Equal(t, 1, *conns[0])
+	require.Equal(t, 1, *conns[1])
+}
+
+func TestHttpStaleConnection(t *testing.T) {
+	// A server that closes each connection after one request,
+	// without saying so
+	l, err := net.ListenTCP("tcp", nil)
+	require.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			}
+			conn.Close()
+		}
+	}()
+
+	w := wrapShim(httpShim, t, l.Addr().(*net.TCPAddr))
+	defer w.stop()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	for i := 0; i < 5; i++ {
+		res, err := client.Get(w.baseUrl)
+		require.Nil(t, err)
+		require.Equal(t, "ok", readAll(res.Body, t))
+		<-w.exchanges
+	}
+}
+
+func TestHttpTimeouts(t *testing.T) {
+	addr, _, stop := countingServer(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}, t)
+	defer stop()
+
+	w := wrapShim(httpShim, t, addr)
+	defer w.stop()
+	w.fwd.SetTimeouts(store.Timeouts{
+		Idle:          store.Duration(50 * time.Millisecond),
+		RequestHeader: store.Duration(50 * time.Millisecond),
+		Request:       store.Duration(100 * time.Millisecond),
+	})
+
+	// Closed after no request
+	conn, err := net.DialTCP("tcp", nil, w.addr())
+	require.Nil(t, err)
+	_, err = ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	ev := <-w.timeouts
+	require.Equal(t, events.TimeoutIdle, ev.Kind)
+	require.Equal(t, "", ev.InstanceName)
+
+	// Closed after too slow a request header
+	conn, err = net.DialTCP("tcp", nil, w.addr())
+	require.Nil(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	require.Nil(t, err)
+	_, err = ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, events.TimeoutRequestHeader, (<-w.timeouts).Kind)
+
+	// A request that is fast enough, then one that is too slow
+	client := &http.Client{Transport: &http.Transport{}}
+	res, err := client.Get(w.baseUrl)
+	require.Nil(t, err)
+	require.Equal(t, "ok", readAll(res.Body, t))
+	<-w.exchanges
+
+	res, err = client.Get(w.baseUrl + "slow")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+	readAll(res.Body, t)
+	ev = <-w.timeouts
+	require.Equal(t, events.TimeoutRequest, ev.Kind)
+	require.Equal(t, "inst1", ev.InstanceName)
+
+	// All three connections were closed because of the timeouts
+	for i := 0; i < 3; i++ {
+		require.Equal(t, events.ClosedByTimeout, (<-w.closed).Reason)
+	}
+}
+
+func TestHttpConnectionClosed(t *testing.T) {
+	h := newHarness(t)
+	defer h.stop(t)
+	h.expectOut = "Hello World"
+
+	client := &http.Client{Transport: &http.Transport{}}
+	require.Equal(t, "Hello World", h.get(client, t))
+	require.Equal(t, "Hello World", h.get(client, t))
+	client.Transport.(*http.Transport).CloseIdleConnections()
+
+	// Both requests went over the one connection
+	ev := <-h.closed
+	require.Equal(t, events.ClosedByClient, ev.Reason)
+	require.Equal(t, "inst1", ev.InstanceName)
+	require.True(t, ev.BytesIn > 0)
+	require.True(t, ev.BytesOut > 2*int64(len("Hello World")))
+	require.Empty(t, h.closed)
+}
+
+func TestHttpConnectionEvents(t *testing.T) {
+	h := newHarness(t)
+	defer h.stop(t)
+	h.expectOut = "Hello World"
+
+	client := &http.Client{Transport: &http.Transport{}}
+	require.Equal(t, "Hello World", h.get(client, t))
+	require.Equal(t, "Hello World", h.get(client, t))
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	<-h.closed
+
+	// One connection from the client, and one to the instance
+	ev := <-h.accepted
+	require.Equal(t, "http", ev.Protocol)
+	require.Equal(t, "", ev.InstanceName)
+	require.False(t, ev.Time.IsZero())
+	require.Empty(t, h.accepted)
+
+	dial := <-h.dials
+	require.Equal(t, "inst1", dial.InstanceName)
+	require.Equal(t, ev.Inbound, dial.Inbound)
+
+	// Another client connection reuses the connection to the
+	// instance
+	require.Equal(t, "Hello World", h.get(noKeepAlivesClient(), t))
+	<-h.closed
+	require.NotEqual(t, ev.Inbound, (<-h.accepted).Inbound)
+	require.Empty(t, h.dials)
+}
+
+func TestHttpDrainForwarder(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	require.Nil(t, err)
+	defer l.Close()
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/quick", func(w http.ResponseWriter, req *http.Request) {})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-finish
+	})
+	go http.Serve(l, mux)
+
+	// Without a drain timeout, the forwarder still drains while
+	// clients keep their connections alive
+	fwd := newTestForwarder(t, map[string]*net.TCPListener{"inst": l})
+	fwd.SetProtocol("http")
+	fwd.SetTimeouts(store.Timeouts{})
+
+	idle, err := net.DialTCP("tcp", nil, fwd.Addr())
+	require.Nil(t, err)
+	idlerd := bufio.NewReader(idle)
+	_, err = idle.Write([]byte("GET /quick HTTP/1.1\r\nHost: service\r\n\r\n"))
+	require.Nil(t, err)
+	resp, err := http.ReadResponse(idlerd, nil)
+	require.Nil(t, err)
+	require.False(t, resp.Close)
+
+	busy, err := net.DialTCP("tcp", nil, fwd.Addr())
+	require.Nil(t, err)
+	busyrd := bufio.NewReader(busy)
+	_, err = busy.Write([]byte("GET /slow HTTP/1.1\r\nHost: service\r\n\r\n"))
+	require.Nil(t, err)
+	<-started
+
+	fwd.Drain()
+	fwd.lock.Lock()
+	drained := fwd.drained
+	fwd.lock.Unlock()
+	require.NotNil(t, drained)
+
+	// A connection waiting for a request is closed straight away
+	_, err = idlerd.ReadByte()
+	require.Equal(t, io.EOF, err)
+
+	// A connection in the middle of an exchange is closed after
+	// the response, which tells the client so
+	close(finish)
+	resp, err = http.ReadResponse(busyrd, nil)
+	require.Nil(t, err)
+	require.True(t, resp.Close)
+	_, err = busyrd.ReadByte()
+	require.Equal(t, io.EOF, err)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("forwarder did not drain")
+	}
+}
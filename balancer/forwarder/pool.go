@@ -3,20 +3,51 @@ package forwarder
 import (
 	"container/heap"
 	"math/rand"
+	"net"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/weaveworks/flux/balancer/model"
 	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
 )
 
 const retry_interval_base = 1 * time.Second
 
+// The time an instance is ejected for doubles each time it is ejected
+// again without having given a good response, up to this many times
+const max_ejection_doublings = 6
+
 type pooledInstance struct {
 	Name      string
 	Address   netutil.IPPort
 	index     int
 	failures  uint
 	retryTime time.Time
+
+	// Always positive
+	weight int
+
+	// The rule that selected the instance
+	rule string
+
+	// The number of connections currently open to the instance
+	active int
+
+	// Set once the instance has been removed from the pool, while
+	// connections to it may still be draining
+	removed bool
+
+	// For the round-robin strategy
+	current int
+
+	// The number of responses in a row that count towards
+	// ejecting the instance, and the number of times it has been
+	// ejected since its last good response
+	serverErrors  int
+	gatewayErrors int
+	ejections     uint
 }
 
 type instancePool struct {
@@ -29,6 +60,16 @@ type instancePool struct {
 	}
 	stopped chan struct{}
 
+	// How to choose amongst the ready instances
+	strategy strategy
+
+	// The percentage of traffic for each rule given one
+	traffic map[string]int
+
+	// With defaults filled in; nil if instances are not ejected
+	// for the responses they give
+	outliers *store.OutlierDetection
+
 	// Instances that are ready for connections
 	ready []*pooledInstance
 
@@ -41,9 +82,10 @@ type retryQueue struct {
 
 func NewInstancePool() *instancePool {
 	return &instancePool{
-		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
-		now:     time.Now,
-		stopped: make(chan struct{}),
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:      time.Now,
+		strategy: randomStrategy{},
+		stopped:  make(chan struct{}),
 	}
 }
 
@@ -55,15 +97,67 @@ func (p *instancePool) Stop() {
 	}
 }
 
-// Pick an instance from the pool; ideally, from amongst the active
-// instances, but failing that, from those waiting to be retried.
+// Set the strategy used to pick amongst ready instances, returning
+// false if there is no such strategy.
+func (p *instancePool) SetStrategy(name string) bool {
+	makeStrategy := strategies[name]
+	if makeStrategy == nil {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.strategy = makeStrategy()
+	return true
+}
+
+// Set the shares of traffic for rules, as percentages
+func (p *instancePool) SetTraffic(traffic map[string]int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.traffic = traffic
+}
+
+// Set how instances are picked out for ejection from their
+// responses, or nil to not eject instances
+func (p *instancePool) SetOutlierDetection(od *store.OutlierDetection) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.outliers = od
+}
+
 func (p *instancePool) PickInstance() *pooledInstance {
+	return p.PickInstanceFor(nil)
+}
+
+// Pick an instance from the pool for a connection from the client
+// given (which may be nil if not known); ideally, from amongst the
+// active instances, but failing that, from those waiting to be
+// retried.
+func (p *instancePool) PickInstanceFor(client net.IP) *pooledInstance {
+	return p.PickInstanceExcept(client, nil)
+}
+
+// Pick an instance as PickInstanceFor does, but other than those
+// given, e.g., because a request to them has already failed.
+func (p *instancePool) PickInstanceExcept(client net.IP, except []*pooledInstance) *pooledInstance {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	// Normal case: Pick a random ready instance.
-	if len(p.ready) != 0 {
-		inst := p.ready[p.rng.Intn(len(p.ready))]
+	ready, retry := p.ready, p.retry
+	if len(except) != 0 {
+		ready, retry = without(ready, except), without(retry, except)
+	}
+
+	// Normal case: Pick a ready instance according to the
+	// strategy, from amongst those of a rule chosen according to
+	// the traffic split.
+	if len(ready) != 0 {
+		if len(p.traffic) != 0 {
+			ready = p.splitTraffic(client, ready)
+		}
+
+		inst := p.strategy.pick(p.rng, ready, client)
 		if inst.failures != 0 {
 			// Retrying a suspect instance, so presume its
 			// failure in order to prevent other threads
@@ -77,22 +171,112 @@ func (p *instancePool) PickInstance() *pooledInstance {
 	}
 
 	// No ready instances, so try one from the retry queue
-	if len(p.retry) != 0 {
+	if len(retry) != 0 {
 		// We don't want to disturb the retry schedule, but we
 		// want some kind of fairness when resorting to failed
 		// instances.  So pick one at random, and don't
 		// reschedule it.
-		return p.retry[p.rng.Intn(len(p.retry))]
+		return retry[p.rng.Intn(len(retry))]
 	}
 
 	// None available
 	return nil
 }
 
+func without(insts, except []*pooledInstance) []*pooledInstance {
+	var res []*pooledInstance
+outer:
+	for _, inst := range insts {
+		for _, ex := range except {
+			if inst == ex {
+				continue outer
+			}
+		}
+		res = append(res, inst)
+	}
+	return res
+}
+
+// Choose the ready instances of one rule, according to the shares of
+// traffic given to rules.  Rules without a share divide whatever is
+// left over between them, in proportion to the weights of their
+// instances.  Rules without ready instances drop out, and the shares
+// of the rest are scaled up to make up for them.
+func (p *instancePool) splitTraffic(client net.IP, ready []*pooledInstance) []*pooledInstance {
+	groups := make(map[string][]*pooledInstance)
+	var rules []string
+	for _, inst := range ready {
+		if groups[inst.rule] == nil {
+			rules = append(rules, inst.rule)
+		}
+		groups[inst.rule] = append(groups[inst.rule], inst)
+	}
+	sort.Strings(rules)
+
+	leftOver := 100
+	for _, share := range p.traffic {
+		leftOver -= share
+	}
+	if leftOver < 0 {
+		leftOver = 0
+	}
+
+	groupWeight := func(rule string) (weight int) {
+		for _, inst := range groups[rule] {
+			weight += inst.weight
+		}
+		return
+	}
+
+	unsharedWeight := 0
+	for _, rule := range rules {
+		if _, found := p.traffic[rule]; !found {
+			unsharedWeight += groupWeight(rule)
+		}
+	}
+
+	shares := make([]float64, len(rules))
+	total := 0.0
+	for i, rule := range rules {
+		if share, found := p.traffic[rule]; found {
+			shares[i] = float64(share)
+		} else {
+			shares[i] = float64(leftOver*groupWeight(rule)) / float64(unsharedWeight)
+		}
+		total += shares[i]
+	}
+
+	if total == 0 {
+		return ready
+	}
+
+	// When the strategy keeps clients on the same instance, they
+	// need to be kept to the same rule too
+	var u float64
+	if _, sticky := p.strategy.(ipHashStrategy); sticky && client != nil {
+		u = hashUnit(client, "")
+	} else {
+		u = p.rng.Float64()
+	}
+
+	u *= total
+	for i, rule := range rules {
+		if u < shares[i] {
+			return groups[rule]
+		}
+		u -= shares[i]
+	}
+	return groups[rules[len(rules)-1]]
+}
+
 func (p *instancePool) Succeeded(inst *pooledInstance) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	if inst.removed {
+		return
+	}
+
 	inst.failures = 0
 
 	if !inst.retryTime.IsZero() {
@@ -104,22 +288,101 @@ func (p *instancePool) Succeeded(inst *pooledInstance) {
 	}
 }
 
+// Record that a connection to the instance has been opened, or
+// closed; the strategy may take the number open into account.
+func (p *instancePool) Connected(inst *pooledInstance) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	inst.active++
+}
+
+func (p *instancePool) Disconnected(inst *pooledInstance) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	inst.active--
+}
+
 func (p *instancePool) Failed(inst *pooledInstance) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	if inst.retryTime.IsZero() {
+	if inst.retryTime.IsZero() && !inst.removed {
 		p.fail(inst)
 	}
 }
 
 func (p *instancePool) fail(inst *pooledInstance) {
+	p.removeReady(inst)
+	p.reschedule(inst)
+	heap.Push(&p.retryQueue, inst)
+	p.resetTimer(p.now())
+}
+
+func (p *instancePool) removeReady(inst *pooledInstance) {
 	// inst must already be ready, i.e. inst.retryTime.isZero()
-	p.ready[inst.index] = p.ready[len(p.ready)-1]
+	last := p.ready[len(p.ready)-1]
+	p.ready[inst.index] = last
+	last.index = inst.index
 	p.ready = p.ready[:len(p.ready)-1]
-	p.reschedule(inst)
+}
+
+// Record the status of a response from the instance, or 0 if there
+// was no response to a request.  If outlier detection is on, and the
+// instance has given enough bad responses in a row, it is ejected to
+// the retry queue; the return value says whether it was.
+func (p *instancePool) Responded(inst *pooledInstance, status int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.outliers == nil || inst.removed {
+		return false
+	}
+
+	switch {
+	case status == 0 || status == 502 || status == 503 || status == 504:
+		inst.gatewayErrors++
+		inst.serverErrors++
+	case status >= 500:
+		inst.gatewayErrors = 0
+		inst.serverErrors++
+	default:
+		inst.gatewayErrors = 0
+		inst.serverErrors = 0
+		inst.ejections = 0
+		return false
+	}
+
+	if inst.serverErrors < p.outliers.Consecutive5xx &&
+		inst.gatewayErrors < p.outliers.ConsecutiveGatewayErrors {
+		return false
+	}
+
+	// Leave it be if it is already out of use, or if enough other
+	// instances are
+	if !inst.retryTime.IsZero() || !p.mayEject() {
+		return false
+	}
+
+	inst.gatewayErrors = 0
+	inst.serverErrors = 0
+	p.removeReady(inst)
+	inst.retryTime = p.now().Add((1 << inst.ejections) * retry_interval_base)
+	if inst.ejections < max_ejection_doublings {
+		inst.ejections++
+	}
 	heap.Push(&p.retryQueue, inst)
 	p.resetTimer(p.now())
+	return true
+}
+
+// Whether another instance may be ejected, without exceeding the
+// maximum percentage of instances out of use
+func (p *instancePool) mayEject() bool {
+	allowed := (len(p.ready) + len(p.retry)) * p.outliers.MaxEjectionPercent / 100
+	if allowed < 1 {
+		allowed = 1
+	}
+	return len(p.retry) < allowed
 }
 
 func (p *instancePool) reschedule(inst *pooledInstance) {
@@ -128,21 +391,29 @@ func (p *instancePool) reschedule(inst *pooledInstance) {
 	inst.retryTime = p.now().Add(delay)
 }
 
-func (p *instancePool) UpdateInstances(instances map[string]netutil.IPPort) {
+// Replace the instances in the pool, returning those that have been
+// removed
+func (p *instancePool) UpdateInstances(instances map[string]model.Instance) []*pooledInstance {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	wantInsts := make(map[string]netutil.IPPort)
-	for name, addr := range instances {
-		wantInsts[name] = addr
+	wantInsts := make(map[string]model.Instance)
+	for name, inst := range instances {
+		wantInsts[name] = inst
 	}
 
 	// Copy any common instances across
-	var ready, retry []*pooledInstance
+	var ready, retry, removed []*pooledInstance
 	keepInsts := func(insts []*pooledInstance) {
 		for _, inst := range insts {
-			if _, found := wantInsts[inst.Name]; found {
+			want, found := wantInsts[inst.Name]
+			if !found {
+				inst.removed = true
+				removed = append(removed, inst)
+			} else {
 				delete(wantInsts, inst.Name)
+				inst.weight = instanceWeight(want)
+				inst.rule = want.Rule
 				if inst.retryTime.IsZero() {
 					inst.index = len(ready)
 					ready = append(ready, inst)
@@ -158,11 +429,13 @@ func (p *instancePool) UpdateInstances(instances map[string]netutil.IPPort) {
 	keepInsts(p.retry)
 
 	// Add new instances
-	for name, addr := range wantInsts {
+	for name, want := range wantInsts {
 		ready = append(ready, &pooledInstance{
 			Name:    name,
-			Address: addr,
+			Address: want.Address,
 			index:   len(ready),
+			weight:  instanceWeight(want),
+			rule:    want.Rule,
 		})
 	}
 
@@ -170,6 +443,14 @@ func (p *instancePool) UpdateInstances(instances map[string]netutil.IPPort) {
 	p.retry = retry
 	heap.Init(&p.retryQueue)
 	p.resetTimer(p.now())
+	return removed
+}
+
+func instanceWeight(inst model.Instance) int {
+	if inst.Weight <= 0 {
+		return store.DefaultWeight
+	}
+	return inst.Weight
 }
 
 func (p *instancePool) resetTimer(now time.Time) {
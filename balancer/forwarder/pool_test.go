@@ -6,7 +6,9 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/weaveworks/flux/balancer/model"
 	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
 )
 
 func TestPoolOfOne(t *testing.T) {
@@ -19,7 +21,7 @@ func TestPoolOfOne(t *testing.T) {
 
 	// Add an instance
 	addr, _ := netutil.ParseIPPort("192.168.3.135:32768")
-	pool.UpdateInstances(map[string]netutil.IPPort{"foo": addr})
+	pool.UpdateInstances(map[string]model.Instance{"foo": {Address: addr}})
 	picked := pool.PickInstance()
 	require.Equal(t, addr, picked.Address)
 
@@ -68,7 +70,7 @@ func TestFailAndRetryInstance(t *testing.T) {
 	inst2, _ := netutil.ParseIPPort("192.168.3.102:1002")
 	inst3, _ := netutil.ParseIPPort("192.168.3.103:1003")
 
-	pool.UpdateInstances(map[string]netutil.IPPort{"inst1": inst1})
+	pool.UpdateInstances(map[string]model.Instance{"inst1": {Address: inst1}})
 	picked1 := pool.PickInstance()
 	require.Equal(t, inst1, picked1.Address)
 	pool.Failed(picked1)
@@ -76,9 +78,9 @@ func TestFailAndRetryInstance(t *testing.T) {
 
 	// incidentally test that failed instances remain failed, when
 	// included in an update
-	pool.UpdateInstances(map[string]netutil.IPPort{
-		"inst1": inst1,
-		"inst2": inst2,
+	pool.UpdateInstances(map[string]model.Instance{
+		"inst1": {Address: inst1},
+		"inst2": {Address: inst2},
 	})
 
 	// check that inst2 (ready) is preferred to inst1 (failed)
@@ -98,10 +100,10 @@ func TestFailAndRetryInstance(t *testing.T) {
 	require.Equal(t, inst1, picked1.Address)
 
 	// Add a ready inst3
-	pool.UpdateInstances(map[string]netutil.IPPort{
-		"inst1": inst1,
-		"inst2": inst2,
-		"inst3": inst3,
+	pool.UpdateInstances(map[string]model.Instance{
+		"inst1": {Address: inst1},
+		"inst2": {Address: inst2},
+		"inst3": {Address: inst3},
 	})
 
 	// check that inst3 (ready) is preferred to inst1 (retrying)
@@ -113,10 +115,12 @@ func TestFailAndRetryInstance(t *testing.T) {
 	}
 
 	pool.Succeeded(picked1)
-	pool.UpdateInstances(map[string]netutil.IPPort{
-		"inst1": inst1,
-		"inst2": inst2,
+	removed := pool.UpdateInstances(map[string]model.Instance{
+		"inst1": {Address: inst1},
+		"inst2": {Address: inst2},
 	})
+	require.Len(t, removed, 1)
+	require.Equal(t, inst3, removed[0].Address)
 
 	// inst3 has gone, inst2 is failed, so inst1 is preferred
 	for i := 0; i < 20; i++ {
@@ -135,7 +139,7 @@ func TestRetryBackoff(t *testing.T) {
 	pool.now = tm.now
 
 	addr, _ := netutil.ParseIPPort("192.168.3.135:32768")
-	pool.UpdateInstances(map[string]netutil.IPPort{"foo": addr})
+	pool.UpdateInstances(map[string]model.Instance{"foo": {Address: addr}})
 
 	for i := uint(0); i < 5; i++ {
 		// invariant: the instance is ready here
@@ -149,3 +153,123 @@ func TestRetryBackoff(t *testing.T) {
 
 	pool.Stop()
 }
+
+func findInstance(pool *instancePool, name string) *pooledInstance {
+	for _, insts := range [][]*pooledInstance{pool.ready, pool.retry} {
+		for _, inst := range insts {
+			if inst.Name == name {
+				return inst
+			}
+		}
+	}
+	return nil
+}
+
+func TestOutlierEjection(t *testing.T) {
+	pool := NewInstancePool()
+	tm := timer{Time: time.Now()}
+	pool.timer = &tm
+	pool.now = tm.now
+	pool.UpdateInstances(makeInstances(4))
+	inst1 := findInstance(pool, "inst1")
+
+	// Nothing is ejected without outlier detection
+	for i := 0; i < 10; i++ {
+		require.False(t, pool.Responded(inst1, 500))
+	}
+
+	od := store.OutlierDetection{Consecutive5xx: 3, ConsecutiveGatewayErrors: 2}.WithDefaults()
+	pool.SetOutlierDetection(&od)
+
+	// A good response breaks a run of errors
+	require.False(t, pool.Responded(inst1, 500))
+	require.False(t, pool.Responded(inst1, 500))
+	require.False(t, pool.Responded(inst1, 404))
+	require.False(t, pool.Responded(inst1, 500))
+	require.False(t, pool.Responded(inst1, 500))
+	require.True(t, pool.Responded(inst1, 500))
+	require.Len(t, pool.ready, 3)
+	require.Equal(t, tm.Add(retry_interval_base), tm.next)
+
+	// Gateway errors have a threshold of their own
+	inst2 := findInstance(pool, "inst2")
+	require.False(t, pool.Responded(inst2, 502))
+	require.True(t, pool.Responded(inst2, 0))
+	require.Len(t, pool.ready, 2)
+
+	// No more than half the instances are ejected
+	inst3 := findInstance(pool, "inst3")
+	for i := 0; i < 5; i++ {
+		require.False(t, pool.Responded(inst3, 503))
+	}
+	require.Len(t, pool.ready, 2)
+
+	// An instance ejected again, without a good response in
+	// between, is ejected for longer
+	tm.Time = tm.next
+	pool.processRetries(tm.Time)
+	require.Len(t, pool.ready, 4)
+	for i := 0; i < 2; i++ {
+		pool.Responded(inst1, 500)
+	}
+	require.True(t, pool.Responded(inst1, 500))
+	require.Equal(t, tm.Add(2*retry_interval_base), inst1.retryTime)
+
+	pool.Stop()
+}
+
+func TestRemovedInstance(t *testing.T) {
+	pool := NewInstancePool()
+	tm := timer{Time: time.Now()}
+	pool.timer = &tm
+	pool.now = tm.now
+	od := store.OutlierDetection{Consecutive5xx: 1}.WithDefaults()
+	pool.SetOutlierDetection(&od)
+	pool.UpdateInstances(makeInstances(3))
+	inst2 := findInstance(pool, "inst2")
+
+	// Connections to a removed instance may still be draining,
+	// but what happens on them leaves the pool alone
+	insts := makeInstances(3)
+	delete(insts, "inst2")
+	pool.UpdateInstances(insts)
+	require.False(t, pool.Responded(inst2, 500))
+	pool.Failed(inst2)
+	pool.Succeeded(inst2)
+
+	require.Len(t, pool.ready, 2)
+	require.Empty(t, pool.retry)
+	require.NotNil(t, findInstance(pool, "inst1"))
+	require.NotNil(t, findInstance(pool, "inst3"))
+
+	pool.Stop()
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	pool := NewInstancePool()
+	od := store.OutlierDetection{Consecutive5xx: 1, MaxEjectionPercent: 10}.WithDefaults()
+	pool.SetOutlierDetection(&od)
+
+	// One instance may always be ejected
+	pool.UpdateInstances(makeInstances(2))
+	require.True(t, pool.Responded(findInstance(pool, "inst1"), 500))
+	require.False(t, pool.Responded(findInstance(pool, "inst2"), 500))
+
+	pool.Stop()
+}
+
+func TestPickInstanceExcept(t *testing.T) {
+	pool := NewInstancePool()
+	pool.UpdateInstances(makeInstances(2))
+	inst1 := findInstance(pool, "inst1")
+
+	for i := 0; i < 20; i++ {
+		require.Equal(t, "inst2", pool.PickInstanceExcept(nil, []*pooledInstance{inst1}).Name)
+	}
+
+	// Unlike when picking from failed instances, an instance that
+	// has been tried is never picked again
+	require.Nil(t, pool.PickInstanceExcept(nil, []*pooledInstance{inst1, findInstance(pool, "inst2")}))
+
+	pool.Stop()
+}
@@ -0,0 +1,103 @@
+package forwarder
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+// The most retries that can be saved up in the budget.  This lets a
+// few requests be retried straight away, while stopping a long quiet
+// spell being followed by a long stretch of retries.
+const retry_budget_cap = 10
+
+// Limits retries to a percentage of the requests made.  Each request
+// adds a fraction to the balance, and each retry takes one from it.
+type retryBudget struct {
+	lock sync.Mutex
+	// With defaults filled in; nil if requests are not retried
+	policy  *store.RetryPolicy
+	balance float64
+}
+
+func (b *retryBudget) setPolicy(policy *store.RetryPolicy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if policy == nil {
+		b.policy = nil
+		return
+	}
+
+	if b.policy == nil {
+		b.balance = retry_budget_cap
+	}
+	rp := policy.WithDefaults()
+	b.policy = &rp
+}
+
+// Count a request towards the budget, and return the retry policy
+// for it, or nil if it is not to be retried.
+func (b *retryBudget) policyFor(req *http.Request) *store.RetryPolicy {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.policy == nil {
+		return nil
+	}
+
+	b.balance += float64(b.policy.BudgetPercent) / 100
+	if b.balance > retry_budget_cap {
+		b.balance = retry_budget_cap
+	}
+
+	if !b.policy.Idempotent(req.Method) {
+		return nil
+	}
+	return b.policy
+}
+
+// Take a retry from the budget, returning false if there is not one
+// to take
+func (b *retryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// Read the body of a request so that it can be sent again, returning
+// nil if it is larger than max.  In that case, what was read is put
+// back in front of the rest of the body, so the request can still be
+// sent once.
+func bufferBody(req *http.Request, max int64) ([]byte, error) {
+	if req.Body == nil {
+		return []byte{}, nil
+	}
+	if req.ContentLength > max {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > max {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, nil
+	}
+
+	req.Body.Close()
+	return buf, nil
+}
@@ -0,0 +1,63 @@
+package forwarder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+func TestRetryBudget(t *testing.T) {
+	var b retryBudget
+	get, _ := http.NewRequest("GET", "http://example.com/", nil)
+	post, _ := http.NewRequest("POST", "http://example.com/", nil)
+
+	// No retries without a policy
+	require.Nil(t, b.policyFor(get))
+
+	b.setPolicy(&store.RetryPolicy{BudgetPercent: 50})
+	require.Nil(t, b.policyFor(post))
+	require.Equal(t, 2, b.policyFor(get).MaxRetries)
+
+	// The budget starts full, and can't be overfilled
+	for i := 0; i < retry_budget_cap; i++ {
+		require.True(t, b.withdraw())
+	}
+	require.False(t, b.withdraw())
+
+	// Each request adds half a retry
+	b.policyFor(get)
+	require.False(t, b.withdraw())
+	b.policyFor(post)
+	require.True(t, b.withdraw())
+	require.False(t, b.withdraw())
+
+	b.setPolicy(nil)
+	require.Nil(t, b.policyFor(get))
+}
+
+func TestBufferBody(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "http://example.com/", bytes.NewBufferString("0123456789"))
+	body, err := bufferBody(req, 10)
+	require.Nil(t, err)
+	require.Equal(t, "0123456789", string(body))
+
+	// Too large from the content length
+	req, _ = http.NewRequest("PUT", "http://example.com/", bytes.NewBufferString("0123456789"))
+	body, err = bufferBody(req, 9)
+	require.Nil(t, err)
+	require.Nil(t, body)
+
+	// Too large from reading it; the body is left intact
+	req, _ = http.NewRequest("PUT", "http://example.com/", ioutil.NopCloser(bytes.NewBufferString("0123456789")))
+	body, err = bufferBody(req, 5)
+	require.Nil(t, err)
+	require.Nil(t, body)
+	rest, err := ioutil.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Equal(t, "0123456789", string(rest))
+}
@@ -0,0 +1,168 @@
+package forwarder
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+// A strategy chooses which of the ready instances a connection
+// should go to.  Strategies are called with the pool lock held, and
+// ready is never empty.
+type strategy interface {
+	pick(rng *rand.Rand, ready []*pooledInstance, client net.IP) *pooledInstance
+}
+
+var strategies = map[string]func() strategy{
+	"":                       func() strategy { return randomStrategy{} },
+	store.StrategyRandom:     func() strategy { return randomStrategy{} },
+	store.StrategyRoundRobin: func() strategy { return roundRobinStrategy{} },
+	store.StrategyLeastConn:  func() strategy { return leastConnStrategy{} },
+	store.StrategyP2C:        func() strategy { return p2cStrategy{} },
+	store.StrategyIPHash:     func() strategy { return ipHashStrategy{} },
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) pick(rng *rand.Rand, ready []*pooledInstance, _ net.IP) *pooledInstance {
+	return weightedRandom(rng, ready, nil)
+}
+
+// Pick an instance at random in proportion to the weights, other than
+// exclude
+func weightedRandom(rng *rand.Rand, ready []*pooledInstance, exclude *pooledInstance) *pooledInstance {
+	total := 0
+	for _, inst := range ready {
+		if inst != exclude {
+			total += inst.weight
+		}
+	}
+
+	n := rng.Intn(total)
+	for _, inst := range ready {
+		if inst == exclude {
+			continue
+		}
+		if n < inst.weight {
+			return inst
+		}
+		n -= inst.weight
+	}
+	panic("unreachable")
+}
+
+// Smooth weighted round-robin, as in nginx: each instance accumulates
+// its weight on every pick, and the one with the most accumulated is
+// picked and has the total taken off.  This interleaves the instances
+// rather than sending runs of connections to the heavier ones.
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) pick(_ *rand.Rand, ready []*pooledInstance, _ net.IP) *pooledInstance {
+	var best *pooledInstance
+	total := 0
+	for _, inst := range ready {
+		inst.current += inst.weight
+		total += inst.weight
+		if best == nil || inst.current > best.current {
+			best = inst
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// Is a less loaded than b, taking their weights into account?
+func lessLoaded(a, b *pooledInstance) bool {
+	return a.active*b.weight < b.active*a.weight
+}
+
+// Pick the instance with the fewest active connections relative to
+// its weight, choosing randomly amongst those tied
+type leastConnStrategy struct{}
+
+func (leastConnStrategy) pick(rng *rand.Rand, ready []*pooledInstance, _ net.IP) *pooledInstance {
+	var best *pooledInstance
+	ties := 0
+	for _, inst := range ready {
+		switch {
+		case best == nil || lessLoaded(inst, best):
+			best = inst
+			ties = inst.weight
+		case !lessLoaded(best, inst):
+			ties += inst.weight
+			if rng.Intn(ties) < inst.weight {
+				best = inst
+			}
+		}
+	}
+	return best
+}
+
+// "The power of two choices": pick two instances at random, and use
+// the one with fewer active connections.  This gets most of the
+// benefit of least-conn, without herding onto one instance when
+// several balancers have the same view.  Both choices are weighted,
+// and the first wins ties, so that an idle pool is used in proportion
+// to the weights.
+type p2cStrategy struct{}
+
+func (p2cStrategy) pick(rng *rand.Rand, ready []*pooledInstance, _ net.IP) *pooledInstance {
+	if len(ready) == 1 {
+		return ready[0]
+	}
+
+	a := weightedRandom(rng, ready, nil)
+	b := weightedRandom(rng, ready, a)
+	if lessLoaded(b, a) {
+		return b
+	}
+	return a
+}
+
+// Send connections from the same client IP to the same instance,
+// using rendezvous hashing so that when instances come and go, only
+// the clients of those instances move.  Each instance's score is
+// scaled according to its weight, so that it gets its share of
+// clients.
+type ipHashStrategy struct{}
+
+func (ipHashStrategy) pick(rng *rand.Rand, ready []*pooledInstance, client net.IP) *pooledInstance {
+	if client == nil {
+		return randomStrategy{}.pick(rng, ready, client)
+	}
+
+	var best *pooledInstance
+	var bestScore float64
+	for _, inst := range ready {
+		// A hash in (0, 1) gives a score in (0, +Inf)
+		u := hashUnit(client, inst.Name)
+		if score := -float64(inst.weight) / math.Log(u); best == nil || score > bestScore {
+			best = inst
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// Hash a client address and a name to a number in (0, 1)
+func hashUnit(client net.IP, name string) float64 {
+	h := fnv.New64a()
+	h.Write(client.To16())
+	h.Write([]byte(name))
+	return (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+}
+
+// FNV leaves the high bits poorly mixed when inputs differ only at the
+// end, as the instance names tend to; this is the finaliser from
+// splitmix64, which fixes that.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,333 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/balancer/model"
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+// Make instances inst1, inst2, ... with the weights given, or the
+// default weight if none are given
+func makeInstances(n int, weights ...int) map[string]model.Instance {
+	insts := make(map[string]model.Instance)
+	for i := 1; i <= n; i++ {
+		addr, _ := netutil.ParseIPPort(fmt.Sprintf("192.168.3.%d:%d", 100+i, 1000+i))
+		inst := model.Instance{Address: addr}
+		if len(weights) != 0 {
+			inst.Weight = weights[i-1]
+		}
+		insts[fmt.Sprintf("inst%d", i)] = inst
+	}
+	return insts
+}
+
+func weightedPool(t *testing.T, strategy string, weights ...int) *instancePool {
+	pool := NewInstancePool()
+	require.True(t, pool.SetStrategy(strategy))
+	pool.UpdateInstances(makeInstances(len(weights), weights...))
+	return pool
+}
+
+// Count the instances picked for n connections
+func countPicks(pool *instancePool, n int, pick func(i int) *pooledInstance) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[pick(i).Name]++
+	}
+	return counts
+}
+
+func strategyPool(t *testing.T, strategy string, n int) *instancePool {
+	pool := NewInstancePool()
+	require.True(t, pool.SetStrategy(strategy))
+	pool.UpdateInstances(makeInstances(n))
+	return pool
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	pool := NewInstancePool()
+	require.False(t, pool.SetStrategy("bogus"))
+	for _, s := range store.Strategies {
+		require.True(t, pool.SetStrategy(s))
+	}
+	require.True(t, pool.SetStrategy(""))
+	pool.Stop()
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool := strategyPool(t, store.StrategyRoundRobin, 3)
+	defer pool.Stop()
+
+	// Each instance is picked once in every three
+	var first []string
+	for i := 0; i < 3; i++ {
+		first = append(first, pool.PickInstance().Name)
+	}
+	require.Len(t, map[string]bool{first[0]: true, first[1]: true, first[2]: true}, 3)
+	for i := 0; i < 9; i++ {
+		require.Equal(t, first[i%3], pool.PickInstance().Name)
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	pool := strategyPool(t, store.StrategyLeastConn, 3)
+	defer pool.Stop()
+
+	// Connections are spread evenly when none close
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		inst := pool.PickInstance()
+		pool.Connected(inst)
+		counts[inst.Name]++
+	}
+	require.Equal(t, map[string]int{"inst1": 10, "inst2": 10, "inst3": 10}, counts)
+
+	// Closing connections to an instance makes it the preferred
+	// one
+	var inst2 *pooledInstance
+	for _, inst := range pool.ready {
+		if inst.Name == "inst2" {
+			inst2 = inst
+		}
+	}
+	pool.Disconnected(inst2)
+	pool.Disconnected(inst2)
+	for i := 0; i < 2; i++ {
+		inst := pool.PickInstance()
+		require.Equal(t, "inst2", inst.Name)
+		pool.Connected(inst)
+	}
+}
+
+func TestP2C(t *testing.T) {
+	pool := strategyPool(t, store.StrategyP2C, 2)
+	defer pool.Stop()
+
+	// With two instances, both are always compared, so the one
+	// with fewer connections always wins
+	busy := pool.PickInstance()
+	pool.Connected(busy)
+	for i := 0; i < 20; i++ {
+		require.NotEqual(t, busy.Name, pool.PickInstance().Name)
+	}
+
+	pool.UpdateInstances(makeInstances(1))
+	require.Equal(t, "inst1", pool.PickInstance().Name)
+}
+
+func TestIPHash(t *testing.T) {
+	pool := strategyPool(t, store.StrategyIPHash, 5)
+	defer pool.Stop()
+
+	clients := make([]net.IP, 50)
+	before := make([]string, len(clients))
+	for i := range clients {
+		clients[i] = net.IPv4(10, 0, byte(i/256), byte(i%256))
+		before[i] = pool.PickInstanceFor(clients[i]).Name
+		// The same client gets the same instance each time
+		require.Equal(t, before[i], pool.PickInstanceFor(clients[i]).Name)
+	}
+
+	// Removing an instance only moves the clients that were using
+	// it
+	insts := makeInstances(5)
+	delete(insts, "inst3")
+	pool.UpdateInstances(insts)
+	for i, client := range clients {
+		after := pool.PickInstanceFor(client).Name
+		require.NotEqual(t, "inst3", after)
+		if before[i] != "inst3" {
+			require.Equal(t, before[i], after)
+		}
+	}
+
+	// Without a client address, any instance will do
+	require.NotNil(t, pool.PickInstanceFor(nil))
+}
+
+func TestStrategyFailAndRetry(t *testing.T) {
+	for _, s := range store.Strategies {
+		pool := NewInstancePool()
+		tm := timer{Time: time.Now()}
+		pool.timer = &tm
+		pool.now = tm.now
+		require.True(t, pool.SetStrategy(s))
+		pool.UpdateInstances(makeInstances(2))
+
+		client := net.ParseIP("10.0.0.1")
+		failed := pool.PickInstanceFor(client)
+		pool.Failed(failed)
+
+		// Failed instances are avoided whatever the strategy
+		for i := 0; i < 10; i++ {
+			inst := pool.PickInstanceFor(client)
+			require.NotEqual(t, failed.Name, inst.Name, s)
+			pool.Succeeded(inst)
+		}
+
+		// and are picked again once they are retried
+		tm.Time = tm.next
+		pool.processRetries(tm.Time)
+		found := false
+		for i := 0; i < 20 && !found; i++ {
+			inst := pool.PickInstance()
+			pool.Succeeded(inst)
+			found = inst.Name == failed.Name
+		}
+		require.True(t, found, s)
+		pool.Stop()
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	for _, strategy := range []string{store.StrategyRandom, store.StrategyP2C} {
+		pool := weightedPool(t, strategy, 95, 5)
+		counts := countPicks(pool, 10000, func(int) *pooledInstance {
+			return pool.PickInstance()
+		})
+		// Expect 500; this is about eight standard deviations
+		// either side
+		require.InDelta(t, 500, counts["inst2"], 175, strategy)
+		pool.Stop()
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	pool := weightedPool(t, store.StrategyRoundRobin, 300, 100)
+	defer pool.Stop()
+
+	counts := countPicks(pool, 40, func(int) *pooledInstance {
+		return pool.PickInstance()
+	})
+	require.Equal(t, map[string]int{"inst1": 30, "inst2": 10}, counts)
+
+	// The lighter instance is interleaved, rather than being
+	// picked in a run
+	var last string
+	for i := 0; i < 40; i++ {
+		name := pool.PickInstance().Name
+		require.False(t, name == "inst2" && last == "inst2")
+		last = name
+	}
+}
+
+func TestWeightedLeastConn(t *testing.T) {
+	pool := weightedPool(t, store.StrategyLeastConn, 200, 100)
+	defer pool.Stop()
+
+	counts := countPicks(pool, 30, func(int) *pooledInstance {
+		inst := pool.PickInstance()
+		pool.Connected(inst)
+		return inst
+	})
+	require.Equal(t, map[string]int{"inst1": 20, "inst2": 10}, counts)
+}
+
+func TestWeightedIPHash(t *testing.T) {
+	pool := weightedPool(t, store.StrategyIPHash, 300, 100)
+	defer pool.Stop()
+
+	counts := countPicks(pool, 2000, func(i int) *pooledInstance {
+		return pool.PickInstanceFor(net.IPv4(10, 1, byte(i/256), byte(i%256)))
+	})
+	require.InDelta(t, 500, counts["inst2"], 150)
+}
+
+func TestWeightUpdate(t *testing.T) {
+	pool := weightedPool(t, store.StrategyRoundRobin, 100, 100)
+	defer pool.Stop()
+
+	// Changing the weight of an existing instance takes effect
+	pool.UpdateInstances(makeInstances(2, 100, 300))
+	counts := countPicks(pool, 40, func(int) *pooledInstance {
+		return pool.PickInstance()
+	})
+	require.Equal(t, map[string]int{"inst1": 10, "inst2": 30}, counts)
+}
+
+// Make instances named after their rules, e.g., stable1, stable2, ...
+func ruleInstances(counts map[string]int) map[string]model.Instance {
+	insts := make(map[string]model.Instance)
+	i := 0
+	for rule, n := range counts {
+		for j := 1; j <= n; j++ {
+			i++
+			addr, _ := netutil.ParseIPPort(fmt.Sprintf("192.168.3.%d:%d", 100+i, 1000+i))
+			insts[fmt.Sprintf("%s%d", rule, j)] = model.Instance{Address: addr, Rule: rule}
+		}
+	}
+	return insts
+}
+
+func countRules(pool *instancePool, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[pool.PickInstance().rule]++
+	}
+	return counts
+}
+
+func TestTrafficSplit(t *testing.T) {
+	pool := NewInstancePool()
+	defer pool.Stop()
+
+	// The canary gets its share however few instances it has
+	pool.UpdateInstances(ruleInstances(map[string]int{"stable": 9, "canary": 1}))
+	pool.SetTraffic(map[string]int{"canary": 50})
+	require.InDelta(t, 5000, countRules(pool, 10000)["canary"], 400)
+
+	// ... or however many
+	pool.UpdateInstances(ruleInstances(map[string]int{"stable": 1, "canary": 3}))
+	pool.SetTraffic(map[string]int{"canary": 10})
+	require.InDelta(t, 1000, countRules(pool, 10000)["canary"], 250)
+
+	// Shares are scaled if they add up to more than 100%
+	pool.SetTraffic(map[string]int{"canary": 100, "stable": 300})
+	require.InDelta(t, 2500, countRules(pool, 10000)["canary"], 350)
+
+	// Rules without ready instances drop out
+	pool.UpdateInstances(ruleInstances(map[string]int{"stable": 2}))
+	pool.SetTraffic(map[string]int{"canary": 10})
+	require.Equal(t, map[string]int{"stable": 100}, countRules(pool, 100))
+
+	// Only some instances of a rule being ready does not change
+	// the rule's share
+	pool.UpdateInstances(ruleInstances(map[string]int{"stable": 2, "canary": 2}))
+	pool.SetTraffic(map[string]int{"canary": 20})
+	for _, inst := range pool.ready {
+		if inst.Name == "canary1" {
+			pool.Failed(inst)
+			break
+		}
+	}
+	require.InDelta(t, 2000, countRules(pool, 10000)["canary"], 300)
+}
+
+func TestTrafficSplitStrategies(t *testing.T) {
+	for _, s := range store.Strategies {
+		pool := NewInstancePool()
+		require.True(t, pool.SetStrategy(s))
+		pool.UpdateInstances(ruleInstances(map[string]int{"blue": 3, "green": 3}))
+		pool.SetTraffic(map[string]int{"green": 25})
+
+		counts := make(map[string]int)
+		for i := 0; i < 4000; i++ {
+			client := net.IPv4(10, 2, byte(i/256), byte(i%256))
+			inst := pool.PickInstanceFor(client)
+			counts[inst.rule]++
+			if s == store.StrategyIPHash {
+				// Clients stick to an instance
+				require.Equal(t, inst, pool.PickInstanceFor(client))
+			}
+		}
+		require.InDelta(t, 1000, counts["green"], 200, s)
+		pool.Stop()
+	}
+}
@@ -3,16 +3,44 @@ package model
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 
 	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
 )
 
 type Service struct {
 	Name string
 	// Protocol, e.g. "http".  "" for simple tcp forwarding.
-	Protocol  string
+	Protocol string
+	// Load-balancing strategy; "" for the default
+	Strategy  string
 	Address   *netutil.IPPort
-	Instances map[string]netutil.IPPort // map from name to address
+	Instances map[string]Instance // map from name to instance
+	// map from rule name to percentage, for the rules that have
+	// been given a share of traffic
+	Traffic map[string]int
+	// With defaults filled in; nil if instances are not to be
+	// ejected for the responses they give
+	OutlierDetection *store.OutlierDetection
+	// With defaults filled in; nil if requests are not to be
+	// retried
+	Retries *store.RetryPolicy
+	// Zero if there are none
+	Timeouts store.Timeouts
+}
+
+type Instance struct {
+	Address netutil.IPPort
+	// Relative to other instances; 0 means store.DefaultWeight
+	Weight int
+	// The name of the rule that selected the instance
+	Rule string
+}
+
+func (a Instance) Equal(b Instance) bool {
+	return a.Address.Equal(b.Address) && a.Weight == b.Weight &&
+		a.Rule == b.Rule
 }
 
 func (svc *Service) Description() string {
@@ -26,28 +54,54 @@ func (svc *Service) Description() string {
 func (svc *Service) Summary() string {
 	var buf bytes.Buffer
 
-	fmt.Fprintf(&buf, "%s %s/%s {", svc.Name, svc.Address, svc.Protocol)
+	fmt.Fprintf(&buf, "%s %s/%s", svc.Name, svc.Address, svc.Protocol)
+	if svc.Strategy != "" {
+		fmt.Fprintf(&buf, " (%s)", svc.Strategy)
+	}
+	buf.WriteString(" {")
 
 	comma := ""
-	for name, addr := range svc.Instances {
-		fmt.Fprintf(&buf, "%s%s %s", comma, name, addr)
+	for name, inst := range svc.Instances {
+		fmt.Fprintf(&buf, "%s%s %s", comma, name, inst.Address)
+		if inst.Weight != 0 {
+			fmt.Fprintf(&buf, "*%d", inst.Weight)
+		}
 		comma = ", "
 	}
 
 	buf.WriteString("}")
+
+	if len(svc.Traffic) != 0 {
+		buf.WriteString(" traffic {")
+		comma = ""
+		for rule, share := range svc.Traffic {
+			fmt.Fprintf(&buf, "%s%s %d%%", comma, rule, share)
+			comma = ", "
+		}
+		buf.WriteString("}")
+	}
+
 	return buf.String()
 }
 
 func (a *Service) Equal(b *Service) bool {
 	if a.Name != b.Name || a.Protocol != b.Protocol ||
+		a.Strategy != b.Strategy ||
 		(a.Address == nil) != (b.Address == nil) ||
 		!a.Address.Equal(*b.Address) {
 		return false
 	}
 
-	for name, aAddr := range a.Instances {
-		bAddr, found := b.Instances[name]
-		if !found || !aAddr.Equal(bAddr) {
+	if (a.OutlierDetection == nil) != (b.OutlierDetection == nil) ||
+		(a.OutlierDetection != nil && *a.OutlierDetection != *b.OutlierDetection) ||
+		!reflect.DeepEqual(a.Retries, b.Retries) ||
+		a.Timeouts != b.Timeouts {
+		return false
+	}
+
+	for name, aInst := range a.Instances {
+		bInst, found := b.Instances[name]
+		if !found || !aInst.Equal(bInst) {
 			return false
 		}
 	}
@@ -58,6 +112,15 @@ func (a *Service) Equal(b *Service) bool {
 		}
 	}
 
+	if len(a.Traffic) != len(b.Traffic) {
+		return false
+	}
+	for rule, share := range a.Traffic {
+		if bShare, found := b.Traffic[rule]; !found || share != bShare {
+			return false
+		}
+	}
+
 	return true
 }
 
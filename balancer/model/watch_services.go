@@ -1,12 +1,13 @@
 package model
 
 import (
+	"time"
+
 	"github.com/weaveworks/flux/common/daemon"
-	"github.com/weaveworks/flux/common/netutil"
 	"github.com/weaveworks/flux/common/store"
 )
 
-func WatchServicesStartFunc(st store.Store, filterAddressless bool, updates chan<- ServiceUpdate) daemon.StartFunc {
+func WatchServicesStartFunc(st store.Store, retryInterval time.Duration, filterAddressless bool, updates chan<- ServiceUpdate) daemon.StartFunc {
 	sendUpdate := func(su store.ServiceUpdate, stop <-chan struct{}) {
 		update := make(map[string]*Service)
 		for name, svc := range su.Services {
@@ -22,8 +23,8 @@ func WatchServicesStartFunc(st store.Store, filterAddressless bool, updates chan
 		case <-stop:
 		}
 	}
-	return store.WatchServicesIndirectStartFunc(st,
-		store.QueryServiceOptions{WithInstances: true},
+	return store.WatchServicesIndirectStartFunc(st, retryInterval,
+		store.QueryServiceOptions{WithInstances: true, WithContainerRules: true},
 		sendUpdate)
 }
 
@@ -32,17 +33,55 @@ func translateService(name string, svc *store.ServiceInfo, filterAddressless boo
 		return nil
 	}
 
-	insts := make(map[string]netutil.IPPort)
+	insts := make(map[string]Instance)
 	for instName, instance := range svc.Instances {
-		if instance.Address != nil {
-			insts[instName] = *instance.Address
+		// Only live instances get traffic; e.g., not those
+		// without an address, or failing health checks
+		if instance.Label(store.StateLabel) == store.StateLive {
+			insts[instName] = Instance{
+				Address: *instance.Address,
+				Weight:  instance.Weight,
+				Rule:    instance.ContainerRule,
+			}
 		}
 	}
 
+	var traffic map[string]int
+	for ruleName, rule := range svc.ContainerRules {
+		if rule.Traffic > 0 {
+			if traffic == nil {
+				traffic = make(map[string]int)
+			}
+			traffic[ruleName] = rule.Traffic
+		}
+	}
+
+	var outliers *store.OutlierDetection
+	if svc.OutlierDetection != nil {
+		od := svc.OutlierDetection.WithDefaults()
+		outliers = &od
+	}
+
+	var retries *store.RetryPolicy
+	if svc.Retries != nil {
+		rp := svc.Retries.WithDefaults()
+		retries = &rp
+	}
+
+	var timeouts store.Timeouts
+	if svc.Timeouts != nil {
+		timeouts = *svc.Timeouts
+	}
+
 	return &Service{
-		Name:      name,
-		Protocol:  svc.Protocol,
-		Address:   svc.Address,
-		Instances: insts,
+		Name:             name,
+		Protocol:         svc.Protocol,
+		Strategy:         svc.Strategy,
+		Address:          svc.Address,
+		Instances:        insts,
+		Traffic:          traffic,
+		OutlierDetection: outliers,
+		Retries:          retries,
+		Timeouts:         timeouts,
 	}
 }
@@ -5,9 +5,11 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
 	prom "github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 
@@ -32,12 +34,13 @@ func (eventHandlerSlot) Key() daemon.DependencyKey {
 }
 
 func (s eventHandlerSlot) Assign(value interface{}) {
-	*s.slot = value.(events.Handler)
+	*s.slot, _ = value.(events.Handler)
 }
 
 type eventHandlerConfig struct {
 	listenAddr    string
 	advertiseAddr string
+	httpBuckets   string
 	etcdClient    etcdutil.Client
 	hostIP        net.IP
 }
@@ -49,10 +52,13 @@ func (eventHandlerKey) MakeConfig() daemon.DependencyConfig {
 func (cf *eventHandlerConfig) Populate(deps *daemon.Dependencies) {
 	deps.StringVar(&cf.listenAddr,
 		"listen-prometheus", ":9000",
-		"listen for connections from Prometheus on this IP address and port; e.g., :9000")
+		"listen for connections from Prometheus on this IP address and port; e.g., :9000; empty to not export metrics")
 	deps.StringVar(&cf.advertiseAddr,
 		"advertise-prometheus", "",
 		"IP address and port to advertise to Prometheus; e.g. 192.168.42.221:9000")
+	deps.StringVar(&cf.httpBuckets,
+		"prometheus-http-buckets", "0.001,0.0025,0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10",
+		"comma-separated upper bounds, in seconds, of the buckets for HTTP response time histograms")
 
 	deps.Dependency(etcdutil.ClientDependency(&cf.etcdClient))
 	deps.Dependency(netutil.HostIPDependency(&cf.hostIP))
@@ -63,12 +69,21 @@ type eventHandler struct {
 
 	events.DiscardOthers
 	connections   *prom.CounterVec
+	dials         *prom.CounterVec
+	bytesIn       *prom.CounterVec
+	bytesOut      *prom.CounterVec
+	duration      *prom.HistogramVec
 	http          *prom.CounterVec
-	httpRoundtrip *prom.SummaryVec
-	httpTotal     *prom.SummaryVec
+	httpRoundtrip *prom.HistogramVec
+	httpTotal     *prom.HistogramVec
+	timeouts      *prom.CounterVec
 }
 
 func (cf *eventHandlerConfig) MakeValue() (interface{}, daemon.StartFunc, error) {
+	if cf.listenAddr == "" {
+		return nil, nil, nil
+	}
+
 	// Default the prom AdvertiseAddr based on the host IP
 	if cf.advertiseAddr == "" {
 		_, port, err := net.SplitHostPort(cf.listenAddr)
@@ -87,35 +102,87 @@ func (cf *eventHandlerConfig) MakeValue() (interface{}, daemon.StartFunc, error)
 		cf.advertiseAddr = address
 	}
 
-	httpLabels := []string{"individual", "src", "dst", "method", "code"}
+	httpBuckets, err := parseBuckets(cf.httpBuckets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	connLabels := []string{"service", "individual", "src", "dst", "protocol"}
+	httpLabels := []string{"service", "individual", "src", "dst", "method", "code"}
 	h := &eventHandler{
 		eventHandlerConfig: cf,
 
 		connections: prom.NewCounterVec(prom.CounterOpts{
 			Name: "flux_connections_total",
-			Help: "Number of TCP connections established",
-		}, []string{"individual", "src", "dst", "protocol"}),
+			Help: "Number of TCP connections accepted from clients",
+		}, []string{"service", "src", "protocol"}),
+
+		dials: prom.NewCounterVec(prom.CounterOpts{
+			Name: "flux_instance_dials_total",
+			Help: "Number of TCP connections made to instances",
+		}, []string{"service", "individual", "dst", "protocol"}),
+
+		bytesIn: prom.NewCounterVec(prom.CounterOpts{
+			Name: "flux_connection_bytes_in_total",
+			Help: "Bytes received from clients over connections that have closed",
+		}, connLabels),
+
+		bytesOut: prom.NewCounterVec(prom.CounterOpts{
+			Name: "flux_connection_bytes_out_total",
+			Help: "Bytes sent to clients over connections that have closed",
+		}, connLabels),
+
+		duration: prom.NewHistogramVec(prom.HistogramOpts{
+			Name: "flux_connection_duration_seconds",
+			Help: "How long connections were open for, by how they were closed",
+			// From 10ms to about 45 minutes
+			Buckets: prom.ExponentialBuckets(0.01, 4, 12),
+		}, append(connLabels, "reason")),
 
 		http: prom.NewCounterVec(prom.CounterOpts{
 			Name: "flux_http_total",
 			Help: "Number of HTTP request/response exchanges",
 		}, httpLabels),
 
-		httpRoundtrip: prom.NewSummaryVec(prom.SummaryOpts{
-			Name: "flux_http_roundtrip_usec",
-			Help: "HTTP response roundtrip time in microseconds",
+		httpRoundtrip: prom.NewHistogramVec(prom.HistogramOpts{
+			Name:    "flux_http_roundtrip_seconds",
+			Help:    "HTTP response roundtrip time in seconds",
+			Buckets: httpBuckets,
 		}, httpLabels),
 
-		httpTotal: prom.NewSummaryVec(prom.SummaryOpts{
-			Name: "flux_http_total_usec",
-			Help: "HTTP total response time in microseconds",
+		httpTotal: prom.NewHistogramVec(prom.HistogramOpts{
+			Name:    "flux_http_total_seconds",
+			Help:    "HTTP total response time in seconds",
+			Buckets: httpBuckets,
 		}, httpLabels),
+
+		timeouts: prom.NewCounterVec(prom.CounterOpts{
+			Name: "flux_timeouts_total",
+			Help: "Number of timeouts of forwarded traffic",
+		}, []string{"service", "individual", "src", "dst", "kind"}),
 	}
 
 	return h, daemon.Aggregate(h.listenStartFunc,
 		cf.advertiseStartFunc()), nil
 }
 
+// Parse a comma-separated list of bucket upper bounds, which must be
+// in increasing order
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad histogram bucket %q", f)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("histogram buckets not in increasing order: %s", s)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
 func (h *eventHandler) listenStartFunc(errs daemon.ErrorSink) daemon.Component {
 	stopped := false
 
@@ -151,12 +218,32 @@ func (h *eventHandler) listenStartFunc(errs daemon.ErrorSink) daemon.Component {
 }
 
 func (h *eventHandler) collectors() []prom.Collector {
-	return []prom.Collector{h.connections, h.http, h.httpRoundtrip,
-		h.httpTotal}
+	return []prom.Collector{h.connections, h.dials, h.bytesIn, h.bytesOut,
+		h.duration, h.http, h.httpRoundtrip, h.httpTotal, h.timeouts}
 }
 
 func (h *eventHandler) Connection(ev *events.Connection) {
-	h.connections.WithLabelValues(ev.InstanceName, ev.Inbound.IP.String(), ev.InstanceAddr.IP().String(), ev.Protocol).Inc()
+	h.connections.WithLabelValues(ev.ServiceName, ev.Inbound.IP.String(), ev.Protocol).Inc()
+}
+
+func (h *eventHandler) Dial(ev *events.Dial) {
+	h.dials.WithLabelValues(ev.ServiceName, ev.InstanceName, ev.InstanceAddr.IP().String(), ev.Protocol).Inc()
+}
+
+func (h *eventHandler) ConnectionClosed(ev *events.ConnectionClosed) {
+	src := ev.Inbound.IP.String()
+	dst := instanceIP(ev.Connection)
+	h.bytesIn.WithLabelValues(ev.ServiceName, ev.InstanceName, src, dst, ev.Protocol).Add(float64(ev.BytesIn))
+	h.bytesOut.WithLabelValues(ev.ServiceName, ev.InstanceName, src, dst, ev.Protocol).Add(float64(ev.BytesOut))
+	h.duration.WithLabelValues(ev.ServiceName, ev.InstanceName, src, dst, ev.Protocol, ev.Reason).Observe(ev.Duration.Seconds())
+}
+
+// The instance's IP address, or "" if the instance is not known
+func instanceIP(ev *events.Connection) string {
+	if ip := ev.InstanceAddr.IP(); ip != nil {
+		return ip.String()
+	}
+	return ""
 }
 
 func (h *eventHandler) HttpExchange(ev *events.HttpExchange) {
@@ -164,44 +251,94 @@ func (h *eventHandler) HttpExchange(ev *events.HttpExchange) {
 	dst := ev.InstanceAddr.IP().String()
 	method := ev.Request.Method
 	code := strconv.Itoa(ev.Response.StatusCode)
-	h.http.WithLabelValues(ev.InstanceName, src, dst, method, code).Inc()
-	h.httpRoundtrip.WithLabelValues(ev.InstanceName, src, dst, method, code).Observe(float64(ev.RoundTrip / time.Microsecond))
-	h.httpTotal.WithLabelValues(ev.InstanceName, src, dst, method, code).Observe(float64(ev.TotalTime / time.Microsecond))
+	h.http.WithLabelValues(ev.ServiceName, ev.InstanceName, src, dst, method, code).Inc()
+	h.httpRoundtrip.WithLabelValues(ev.ServiceName, ev.InstanceName, src, dst, method, code).Observe(ev.RoundTrip.Seconds())
+	h.httpTotal.WithLabelValues(ev.ServiceName, ev.InstanceName, src, dst, method, code).Observe(ev.TotalTime.Seconds())
+}
+
+func (h *eventHandler) Timeout(ev *events.Timeout) {
+	h.timeouts.WithLabelValues(ev.ServiceName, ev.InstanceName, ev.Inbound.IP.String(), instanceIP(ev.Connection), ev.Kind).Inc()
 }
 
 const TTL = 5 * time.Minute
 
 func (cf *eventHandlerConfig) advertiseStartFunc() daemon.StartFunc {
-	run := func(stop <-chan struct{}, errs daemon.ErrorSink) {
-		ctx := context.Background()
+	run := cf.advertiseV2
+	if cf.etcdClient.Config().API == etcdutil.API_V3 {
+		run = cf.advertiseV3
+	}
+	return daemon.Restart(TTL/10, daemon.SimpleComponent(run))
+}
 
-		resp, err := cf.etcdClient.CreateInOrder(ctx,
-			"/weave-flux/prometheus-targets", cf.advertiseAddr,
-			&etcd.CreateInOrderOptions{TTL: TTL})
+func (cf *eventHandlerConfig) advertiseV2(stop <-chan struct{}, errs daemon.ErrorSink) {
+	ctx := context.Background()
+
+	resp, err := cf.etcdClient.CreateInOrder(ctx,
+		cf.etcdClient.Prefix+"prometheus-targets", cf.advertiseAddr,
+		&etcd.CreateInOrderOptions{TTL: TTL})
+	if err != nil {
+		errs.Post(err)
+		return
+	}
+
+	key := resp.Node.Key
+	t := time.NewTicker(TTL / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		_, err := cf.etcdClient.Set(ctx, key,
+			cf.advertiseAddr, &etcd.SetOptions{TTL: TTL})
 		if err != nil {
 			errs.Post(err)
 			return
 		}
+	}
+}
 
-		key := resp.Node.Key
-		t := time.NewTicker(TTL / 2)
-		defer t.Stop()
+// With the v3 API, the address is put under a key named for a lease,
+// which is kept alive while advertising, so that the key goes away
+// with it.
+func (cf *eventHandlerConfig) advertiseV3(stop <-chan struct{}, errs daemon.ErrorSink) {
+	c, err := cf.etcdClient.Config().NewV3Client()
+	if err != nil {
+		errs.Post(err)
+		return
+	}
+	defer c.Close()
 
-		for {
-			select {
-			case <-stop:
-				return
-			case <-t.C:
-			}
+	ctx := context.Background()
+	lease, err := c.Grant(ctx, int64(TTL/time.Second))
+	if err != nil {
+		errs.Post(err)
+		return
+	}
 
-			_, err := cf.etcdClient.Set(ctx, key,
-				cf.advertiseAddr, &etcd.SetOptions{TTL: TTL})
-			if err != nil {
-				errs.Post(err)
-				return
-			}
-		}
+	key := fmt.Sprintf("%sprometheus-targets/%x", cf.etcdClient.Prefix, int64(lease.ID))
+	_, err = c.Put(ctx, key, cf.advertiseAddr, clientv3.WithLease(lease.ID))
+	if err != nil {
+		errs.Post(err)
+		return
 	}
 
-	return daemon.Restart(TTL/10, daemon.SimpleComponent(run))
+	t := time.NewTicker(TTL / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		if _, err := c.KeepAliveOnce(ctx, lease.ID); err != nil {
+			errs.Post(err)
+			return
+		}
+	}
 }
@@ -0,0 +1,18 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBuckets(t *testing.T) {
+	buckets, err := parseBuckets("0.01, 0.1,1,10")
+	require.Nil(t, err)
+	require.Equal(t, []float64{0.01, 0.1, 1, 10}, buckets)
+
+	for _, bad := range []string{"", "0.1,x", "1,0.5", "1,1"} {
+		_, err = parseBuckets(bad)
+		require.NotNil(t, err, bad)
+	}
+}
@@ -6,8 +6,9 @@ import (
 
 	"github.com/weaveworks/flux/agent"
 	"github.com/weaveworks/flux/balancer/events"
+	"github.com/weaveworks/flux/balancer/eventsinks"
 	"github.com/weaveworks/flux/balancer/forwarder"
-	"github.com/weaveworks/flux/balancer/prometheus"
+	"github.com/weaveworks/flux/balancer/model"
 	"github.com/weaveworks/flux/common/daemon"
 	"github.com/weaveworks/flux/common/netutil"
 	"github.com/weaveworks/flux/common/store"
@@ -31,7 +32,7 @@ type Config struct {
 
 func (cf *Config) Populate(deps *daemon.Dependencies) {
 	deps.Dependency(etcdstore.StoreDependency(&cf.store))
-	deps.Dependency(prometheus.EventHandlerDependency(&cf.eventHandler))
+	deps.Dependency(eventsinks.EventHandlerDependency(&cf.eventHandler))
 	deps.Dependency(netutil.HostIPDependency(&cf.hostIP))
 }
 
@@ -46,7 +47,7 @@ type service struct {
 	service   *store.Service
 	forwarder *forwarder.Forwarder
 	addr      netutil.IPPort
-	instances map[string]netutil.IPPort
+	instances map[string]model.Instance
 }
 
 func (cf *Config) Prepare() (daemon.StartFunc, error) {
@@ -60,10 +61,9 @@ func (cf *Config) Prepare() (daemon.StartFunc, error) {
 
 		startFuncs = append(startFuncs,
 			daemon.Reset(serviceUpdatesReset,
-				daemon.Restart(10*time.Second,
-					store.WatchServicesStartFunc(cf.store,
-						store.QueryServiceOptions{},
-						serviceUpdates))))
+				store.WatchServicesStartFunc(cf.store,
+					10*time.Second, store.QueryServiceOptions{},
+					serviceUpdates)))
 	}
 
 	return daemon.Aggregate(startFuncs...), nil
@@ -127,7 +127,7 @@ func (ss *serverSide) processServiceUpdate(update store.ServiceUpdate) {
 }
 
 func (ss *serverSide) processInstanceReset(update agent.InstanceUpdate) {
-	svcs := make(map[string]map[string]netutil.IPPort)
+	svcs := make(map[string]map[string]model.Instance)
 	for key, inst := range update.Instances {
 		if inst.Address == nil {
 			continue
@@ -135,11 +135,14 @@ func (ss *serverSide) processInstanceReset(update agent.InstanceUpdate) {
 
 		insts := svcs[key.Service]
 		if insts == nil {
-			insts = make(map[string]netutil.IPPort)
+			insts = make(map[string]model.Instance)
 			svcs[key.Service] = insts
 		}
 
-		insts[key.Instance] = *inst.Address
+		insts[key.Instance] = model.Instance{
+			Address: *inst.Address,
+			Weight:  inst.Weight,
+		}
 	}
 
 	for svcName, insts := range svcs {
@@ -150,7 +153,7 @@ func (ss *serverSide) processInstanceReset(update agent.InstanceUpdate) {
 
 	for svcName, svc := range ss.services {
 		if svcs[svcName] == nil {
-			svc.instances = make(map[string]netutil.IPPort)
+			svc.instances = make(map[string]model.Instance)
 			ss.updateService(svcName, svc)
 		}
 	}
@@ -164,7 +167,10 @@ func (ss *serverSide) processInstanceUpdate(update agent.InstanceUpdate) {
 			delete(svc.instances, key.Instance)
 			ss.updateService(key.Service, svc)
 		} else if inst.Address != nil {
-			svc.instances[key.Instance] = *inst.Address
+			svc.instances[key.Instance] = model.Instance{
+				Address: *inst.Address,
+				Weight:  inst.Weight,
+			}
 			ss.updateService(key.Service, svc)
 		}
 	}
@@ -173,7 +179,7 @@ func (ss *serverSide) processInstanceUpdate(update agent.InstanceUpdate) {
 func (ss *serverSide) getService(svcName string) *service {
 	svc := ss.services[svcName]
 	if svc == nil {
-		svc = &service{instances: make(map[string]netutil.IPPort)}
+		svc = &service{instances: make(map[string]model.Instance)}
 		ss.services[svcName] = svc
 	}
 
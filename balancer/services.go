@@ -228,6 +228,11 @@ func (svc *service) startForwarding(s *model.Service) (serviceState, error) {
 	}
 
 	fwd.SetProtocol(s.Protocol)
+	fwd.SetStrategy(s.Strategy)
+	fwd.SetTraffic(s.Traffic)
+	fwd.SetOutlierDetection(s.OutlierDetection)
+	fwd.SetRetries(s.Retries)
+	fwd.SetTimeouts(s.Timeouts)
 	fwd.SetInstances(s.Instances)
 
 	rule := []interface{}{
@@ -246,9 +251,11 @@ func (svc *service) startForwarding(s *model.Service) (serviceState, error) {
 	return forwarding{svc: svc, service: s, forwarder: fwd, rule: rule}, nil
 }
 
+// Connections already forwarded are left to finish, while new ones
+// go to whatever replaces the forwarder
 func (fwd forwarding) stop() {
-	fwd.forwarder.Stop()
 	fwd.svc.ipTables.deleteRule("nat", fwd.rule)
+	fwd.forwarder.Drain()
 }
 
 func (fwd forwarding) update(s *model.Service) (bool, error) {
@@ -269,6 +276,11 @@ func (fwd forwarding) update(s *model.Service) (bool, error) {
 
 	log.Info("forwarding service: ", s.Summary())
 	fwd.forwarder.SetProtocol(s.Protocol)
+	fwd.forwarder.SetStrategy(s.Strategy)
+	fwd.forwarder.SetTraffic(s.Traffic)
+	fwd.forwarder.SetOutlierDetection(s.OutlierDetection)
+	fwd.forwarder.SetRetries(s.Retries)
+	fwd.forwarder.SetTimeouts(s.Timeouts)
 	fwd.forwarder.SetInstances(s.Instances)
 	return true, nil
 }
@@ -71,15 +71,15 @@ func TestServices(t *testing.T) {
 		Name:     "service",
 		Protocol: "tcp",
 		Address:  &addr,
-		Instances: map[string]netutil.IPPort{
-			"foo": *netutil.ParseIPPortPtr("127.0.0.1:10000"),
+		Instances: map[string]model.Instance{
+			"foo": {Address: *netutil.ParseIPPortPtr("127.0.0.1:10000")},
 		},
 	}
 	update(svc, true)
 	requireForwarding(t, &mipt)
 
-	insts := map[string]netutil.IPPort{
-		"foo": *netutil.ParseIPPortPtr("127.0.0.1:10001"),
+	insts := map[string]model.Instance{
+		"foo": {Address: *netutil.ParseIPPortPtr("127.0.0.1:10001")},
 	}
 
 	// Update it
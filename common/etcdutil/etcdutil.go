@@ -3,19 +3,137 @@ package etcdutil
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/pkg/transport"
 
 	"github.com/weaveworks/flux/common/daemon"
 )
 
-type Client struct {
-	Client etcd.Client
-	etcd.KeysAPI
+// The prefix under which Flux keeps its keys, unless told otherwise
+const DEFAULT_PREFIX = "/weave-flux/"
+
+const DialTimeout = 30 * time.Second
+
+// The versions of the etcd API that Flux can use
+const (
+	API_V2 = "v2"
+	API_V3 = "v3"
+)
+
+// How to reach etcd, and the credentials to present to it
+type Config struct {
+	// Several endpoints may be given, for failover
+	Endpoints []string
+
+	// A client certificate and key, for TLS client authentication
+	CertFile, KeyFile string
+	// A CA certificate with which to verify the etcd server, if not
+	// one of the system's CAs
+	CAFile string
+
+	Username, Password string
+
+	Prefix string
+
+	// Which etcd API to use, API_V2 or API_V3; empty means API_V2
+	API string
 }
 
-func NewClient(endpoints ...string) (Client, error) {
-	c, err := etcd.New(etcd.Config{Endpoints: endpoints})
+// Get the etcd configuration from the environment:
+//
+//   - ETCD_ADDRESS: the etcd endpoints, separated by commas
+//   - ETCD_CERT_FILE, ETCD_KEY_FILE: a client certificate and key
+//   - ETCD_CA_FILE: a CA certificate for verifying the server
+//   - ETCD_USERNAME, ETCD_PASSWORD: credentials for etcd's auth
+//   - ETCD_PREFIX: the prefix for Flux's keys
+//   - ETCD_API: the etcd API version to use
+func ConfigFromEnv() Config {
+	return Config{
+		Endpoints: SplitEndpoints(os.Getenv("ETCD_ADDRESS")),
+		CertFile:  os.Getenv("ETCD_CERT_FILE"),
+		KeyFile:   os.Getenv("ETCD_KEY_FILE"),
+		CAFile:    os.Getenv("ETCD_CA_FILE"),
+		Username:  os.Getenv("ETCD_USERNAME"),
+		Password:  os.Getenv("ETCD_PASSWORD"),
+		Prefix:    PrefixFromEnv(),
+		API:       os.Getenv("ETCD_API"),
+	}
+}
+
+// Split a comma-separated list of endpoints, ignoring blanks.
+func SplitEndpoints(s string) []string {
+	var endpoints []string
+	for _, ep := range strings.Split(s, ",") {
+		if ep = strings.TrimSpace(ep); ep != "" {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+func (cfg Config) check() error {
+	if len(cfg.Endpoints) == 0 {
+		return fmt.Errorf("ETCD_ADDRESS environment variable not set; expected the address of the etcd server")
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return fmt.Errorf("an etcd client certificate needs both a certificate file and a key file")
+	}
+
+	if cfg.Password != "" && cfg.Username == "" {
+		return fmt.Errorf("an etcd password was given without a username")
+	}
+
+	switch cfg.API {
+	case "", API_V2, API_V3:
+	default:
+		return fmt.Errorf(`unknown etcd API version "%s"; expected "%s" or "%s"`, cfg.API, API_V2, API_V3)
+	}
+
+	return nil
+}
+
+func (cfg Config) tlsInfo() (transport.TLSInfo, bool) {
+	info := transport.TLSInfo{
+		CertFile:      cfg.CertFile,
+		KeyFile:       cfg.KeyFile,
+		TrustedCAFile: cfg.CAFile,
+	}
+
+	useTLS := cfg.CertFile != "" || cfg.CAFile != ""
+	for _, ep := range cfg.Endpoints {
+		useTLS = useTLS || strings.HasPrefix(ep, "https://")
+	}
+
+	return info, useTLS
+}
+
+// Make a client for the etcd v2 API.
+func (cfg Config) NewClient() (Client, error) {
+	if err := cfg.check(); err != nil {
+		return Client{}, err
+	}
+
+	etcdCfg := etcd.Config{
+		Endpoints: cfg.Endpoints,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+	}
+
+	if info, useTLS := cfg.tlsInfo(); useTLS {
+		tr, err := transport.NewTransport(info, DialTimeout)
+		if err != nil {
+			return Client{}, err
+		}
+
+		etcdCfg.Transport = tr
+	}
+
+	c, err := etcd.New(etcdCfg)
 	if err != nil {
 		return Client{}, err
 	}
@@ -23,16 +141,84 @@ func NewClient(endpoints ...string) (Client, error) {
 	return Client{
 		Client:  c,
 		KeysAPI: etcd.NewKeysAPI(c),
+		Prefix:  NormalizePrefix(cfg.Prefix),
+		config:  cfg,
 	}, nil
 }
 
+// Make a client for the etcd v3 API.
+func (cfg Config) NewV3Client() (*clientv3.Client, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+
+	v3Cfg := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: DialTimeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	}
+
+	if info, useTLS := cfg.tlsInfo(); useTLS {
+		tlsCfg, err := info.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		v3Cfg.TLS = tlsCfg
+	}
+
+	return clientv3.New(v3Cfg)
+}
+
+type Client struct {
+	Client etcd.Client
+	etcd.KeysAPI
+
+	// The prefix for Flux's keys; several Flux clusters can share
+	// an etcd by using different prefixes
+	Prefix string
+
+	config Config
+}
+
+func NewClient(endpoints ...string) (Client, error) {
+	return Config{Endpoints: endpoints}.NewClient()
+}
+
 func NewClientFromEnv() (Client, error) {
-	addr := os.Getenv("ETCD_ADDRESS")
-	if addr == "" {
-		return Client{}, fmt.Errorf("ETCD_ADDRESS environment variable not set; expected the address of the etcd server")
+	return ConfigFromEnv().NewClient()
+}
+
+// Get the key prefix from ETCD_PREFIX in the environment, or the
+// default if it is not set.
+func PrefixFromEnv() string {
+	return NormalizePrefix(os.Getenv("ETCD_PREFIX"))
+}
+
+// Make a key prefix into the form "/a/b/", supplying the default if
+// it is empty.
+func NormalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return DEFAULT_PREFIX
 	}
 
-	return NewClient(addr)
+	return "/" + prefix + "/"
+}
+
+func NewV3Client(endpoints ...string) (*clientv3.Client, error) {
+	return Config{Endpoints: endpoints}.NewV3Client()
+}
+
+func NewV3ClientFromEnv() (*clientv3.Client, error) {
+	return ConfigFromEnv().NewV3Client()
+}
+
+// The configuration the client was made with, e.g., so that a v3
+// client can be made to the same etcd
+func (c *Client) Config() Config {
+	return c.config
 }
 
 func (c *Client) EtcdClient() etcd.Client {
@@ -57,14 +243,45 @@ func (s dependencySlot) Assign(value interface{}) {
 	*s.slot = value.(Client)
 }
 
+type dependencyConfig struct {
+	Config
+	endpoints string
+}
+
 func (k dependencyKey) MakeConfig() daemon.DependencyConfig {
-	return k
+	return &dependencyConfig{}
 }
 
-func (dependencyKey) Populate(*daemon.Dependencies) {
+func (cf *dependencyConfig) Populate(deps *daemon.Dependencies) {
+	deps.StringVar(&cf.endpoints, "etcd-address", "", "etcd endpoints, separated by commas (default from ETCD_ADDRESS in environment)")
+	deps.StringVar(&cf.CertFile, "etcd-cert-file", "", "client certificate for TLS connections to etcd (default from ETCD_CERT_FILE in environment)")
+	deps.StringVar(&cf.KeyFile, "etcd-key-file", "", "key for the etcd client certificate (default from ETCD_KEY_FILE in environment)")
+	deps.StringVar(&cf.CAFile, "etcd-ca-file", "", "CA certificate with which to verify etcd (default from ETCD_CA_FILE in environment)")
+	deps.StringVar(&cf.Username, "etcd-username", "", "username for etcd authentication (default from ETCD_USERNAME in environment)")
+	deps.StringVar(&cf.Password, "etcd-password", "", "password for etcd authentication (default from ETCD_PASSWORD in environment, which is preferable)")
+	deps.StringVar(&cf.API, "etcd-api", "", fmt.Sprintf(`etcd API version to use, either "%s" or "%s" (default from ETCD_API in environment, otherwise "%s")`, API_V2, API_V3, API_V2))
+	deps.StringVar(&cf.Prefix, "etcd-prefix", "", fmt.Sprintf(`prefix for keys in etcd, so that several Flux clusters can share an etcd (default from ETCD_PREFIX in environment, otherwise "%s")`, DEFAULT_PREFIX))
 }
 
-func (dependencyKey) MakeValue() (interface{}, daemon.StartFunc, error) {
-	client, err := NewClientFromEnv()
+func (cf *dependencyConfig) MakeValue() (interface{}, daemon.StartFunc, error) {
+	// Flags take precedence over the environment
+	cfg := ConfigFromEnv()
+	if cf.endpoints != "" {
+		cfg.Endpoints = SplitEndpoints(cf.endpoints)
+	}
+	override := func(s *string, flag string) {
+		if flag != "" {
+			*s = flag
+		}
+	}
+	override(&cfg.CertFile, cf.CertFile)
+	override(&cfg.KeyFile, cf.KeyFile)
+	override(&cfg.CAFile, cf.CAFile)
+	override(&cfg.Username, cf.Username)
+	override(&cfg.Password, cf.Password)
+	override(&cfg.Prefix, cf.Prefix)
+	override(&cfg.API, cf.API)
+
+	client, err := cfg.NewClient()
 	return client, nil, err
 }
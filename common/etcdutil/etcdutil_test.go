@@ -0,0 +1,53 @@
+package etcdutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitEndpoints(t *testing.T) {
+	require.Nil(t, SplitEndpoints(""))
+	require.Equal(t, []string{"http://a:2379"}, SplitEndpoints("http://a:2379"))
+	require.Equal(t, []string{"http://a:2379", "https://b:2379"},
+		SplitEndpoints(" http://a:2379,, https://b:2379 "))
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	require.Equal(t, DEFAULT_PREFIX, NormalizePrefix(""))
+	require.Equal(t, DEFAULT_PREFIX, NormalizePrefix("/"))
+	require.Equal(t, "/foo/bar/", NormalizePrefix("foo/bar"))
+	require.Equal(t, "/foo/", NormalizePrefix("/foo/"))
+}
+
+func TestConfigCheck(t *testing.T) {
+	require.NotNil(t, Config{}.check())
+
+	cfg := Config{Endpoints: []string{"https://a:2379"}}
+	require.Nil(t, cfg.check())
+
+	_, useTLS := cfg.tlsInfo()
+	require.True(t, useTLS)
+
+	cfg.CertFile = "cert.pem"
+	require.NotNil(t, cfg.check())
+	cfg.KeyFile = "key.pem"
+	require.Nil(t, cfg.check())
+
+	cfg.Password = "secret"
+	require.NotNil(t, cfg.check())
+	cfg.Username = "flux"
+	require.Nil(t, cfg.check())
+
+	cfg.API = "v4"
+	require.NotNil(t, cfg.check())
+	cfg.API = API_V3
+	require.Nil(t, cfg.check())
+
+	cfg = Config{Endpoints: []string{"http://a:2379"}}
+	_, useTLS = cfg.tlsInfo()
+	require.False(t, useTLS)
+	cfg.CAFile = "ca.pem"
+	_, useTLS = cfg.tlsInfo()
+	require.True(t, useTLS)
+}
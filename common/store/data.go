@@ -1,7 +1,11 @@
 package store
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/weaveworks/flux/common/netutil"
 )
@@ -26,12 +30,264 @@ type HostChange struct {
 type ContainerRule struct {
 	Selector     Selector `json:"selector,omitempty"`
 	InstancePort int      `json:"instancePort,omitempty"`
+	// The weight given to the instances selected, unless a
+	// container has its own WeightLabel; 0 means DefaultWeight
+	Weight int `json:"weight,omitempty"`
+	// The percentage of the service's traffic to send to the
+	// instances selected, however many there are; 0 means the
+	// rule shares whatever is not given to other rules
+	Traffic int `json:"traffic,omitempty"`
 }
 
+// Load-balancing strategies, for Service.Strategy.  The default
+// (also given as "") is to pick a ready instance at random.
+const (
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "round-robin"
+	// The instance with the fewest active connections
+	StrategyLeastConn = "least-conn"
+	// The less loaded of two instances picked at random
+	StrategyP2C = "p2c"
+	// Consistent hashing on the client IP address
+	StrategyIPHash = "ip-hash"
+)
+
+var Strategies = []string{StrategyRandom, StrategyRoundRobin, StrategyLeastConn, StrategyP2C, StrategyIPHash}
+
 type Service struct {
-	Address      *netutil.IPPort `json:"address,omitempty"`
-	InstancePort int             `json:"instancePort,omitempty"`
-	Protocol     string          `json:"protocol,omitempty"`
+	Address          *netutil.IPPort   `json:"address,omitempty"`
+	InstancePort     int               `json:"instancePort,omitempty"`
+	Protocol         string            `json:"protocol,omitempty"`
+	Strategy         string            `json:"strategy,omitempty"`
+	HealthCheck      *HealthCheck      `json:"healthCheck,omitempty"`
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty"`
+	Retries          *RetryPolicy      `json:"retries,omitempty"`
+	Timeouts         *Timeouts         `json:"timeouts,omitempty"`
+}
+
+// A time.Duration that is written as a string in JSON, e.g., "1m30s"
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	*d = Duration(dur)
+	return err
+}
+
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
+// How the agents check the health of a service's instances.  An
+// instance becomes unhealthy after failing UnhealthyThreshold checks
+// in a row, and healthy again after passing HealthyThreshold in a
+// row.  Zero values mean the defaults below.
+type HealthCheck struct {
+	// HealthCheckTCP to check that a connection can be made, or
+	// HealthCheckHTTP to GET a path
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+	// The HTTP status expected; 0 means any 2xx or 3xx status
+	Status int `json:"status,omitempty"`
+
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	HealthyThreshold   int      `json:"healthyThreshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthyThreshold,omitempty"`
+}
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthyThreshold    = 2
+	DefaultUnhealthyThreshold  = 3
+)
+
+func (hc *HealthCheck) Validate() error {
+	switch hc.Type {
+	case HealthCheckTCP:
+		if hc.Path != "" || hc.Status != 0 {
+			return fmt.Errorf("a path and status only apply to %s health checks", HealthCheckHTTP)
+		}
+	case HealthCheckHTTP:
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf(`the path for a health check must start with "/"`)
+		}
+	default:
+		return fmt.Errorf(`unknown type of health check "%s"; expected "%s" or "%s"`, hc.Type, HealthCheckTCP, HealthCheckHTTP)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health check intervals, timeouts and thresholds must not be negative")
+	}
+	return nil
+}
+
+// The settings of a health check, with defaults filled in
+func (hc HealthCheck) WithDefaults() HealthCheck {
+	if hc.Type == HealthCheckHTTP && hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval == 0 {
+		hc.Interval = Duration(DefaultHealthCheckInterval)
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = Duration(DefaultHealthCheckTimeout)
+	}
+	if hc.Timeout > hc.Interval {
+		hc.Timeout = hc.Interval
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	return hc
+}
+
+// How the balancers pick out failing instances of an http service from
+// the responses they give.  An instance is ejected, i.e., given no
+// requests for a while, after giving Consecutive5xx responses in a
+// row with a 5xx status, or ConsecutiveGatewayErrors in a row that
+// are gateway errors (a 502, 503 or 504 status, or no response at
+// all).  Zero values mean the defaults below.
+type OutlierDetection struct {
+	Consecutive5xx           int `json:"consecutive5xx,omitempty"`
+	ConsecutiveGatewayErrors int `json:"consecutiveGatewayErrors,omitempty"`
+	// No more than this percentage of the instances are ejected
+	// at once, though one always may be
+	MaxEjectionPercent int `json:"maxEjectionPercent,omitempty"`
+}
+
+const (
+	DefaultConsecutive5xx           = 5
+	DefaultConsecutiveGatewayErrors = 3
+	DefaultMaxEjectionPercent       = 50
+)
+
+func (od *OutlierDetection) Validate() error {
+	if od.Consecutive5xx < 0 || od.ConsecutiveGatewayErrors < 0 {
+		return fmt.Errorf("outlier detection thresholds must not be negative")
+	}
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		return fmt.Errorf("the maximum ejection percentage must be between 0 and 100")
+	}
+	return nil
+}
+
+// The settings of outlier detection, with defaults filled in
+func (od OutlierDetection) WithDefaults() OutlierDetection {
+	if od.Consecutive5xx == 0 {
+		od.Consecutive5xx = DefaultConsecutive5xx
+	}
+	if od.ConsecutiveGatewayErrors == 0 {
+		od.ConsecutiveGatewayErrors = DefaultConsecutiveGatewayErrors
+	}
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+	return od
+}
+
+// How the balancers retry requests to an http service on another
+// instance, when an instance resets the connection or responds with a
+// 502 or 503 status.  Only requests with an idempotent method are
+// retried: GET, HEAD, and any others listed in Methods.  Zero values
+// mean the defaults below.
+type RetryPolicy struct {
+	Methods []string `json:"methods,omitempty"`
+	// How many times a request may be retried
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// Retries may add no more than this percentage to the
+	// requests made, so that they do not swamp a struggling service
+	BudgetPercent int `json:"budgetPercent,omitempty"`
+	// Request bodies are kept so that they can be sent again;
+	// requests with larger bodies are not retried
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+}
+
+const (
+	DefaultMaxRetries    = 2
+	DefaultBudgetPercent = 20
+	DefaultMaxBodyBytes  = 64 * 1024
+)
+
+func (rp *RetryPolicy) Validate() error {
+	for _, method := range rp.Methods {
+		if method == "" || strings.ContainsAny(method, " \t,") {
+			return fmt.Errorf(`"%s" is not an HTTP method`, method)
+		}
+	}
+	if rp.MaxRetries < 0 || rp.BudgetPercent < 0 || rp.MaxBodyBytes < 0 {
+		return fmt.Errorf("retry limits must not be negative")
+	}
+	return nil
+}
+
+// The settings of a retry policy, with defaults filled in
+func (rp RetryPolicy) WithDefaults() RetryPolicy {
+	if rp.MaxRetries == 0 {
+		rp.MaxRetries = DefaultMaxRetries
+	}
+	if rp.BudgetPercent == 0 {
+		rp.BudgetPercent = DefaultBudgetPercent
+	}
+	if rp.MaxBodyBytes == 0 {
+		rp.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return rp
+}
+
+// Whether requests with the method may be retried
+func (rp *RetryPolicy) Idempotent(method string) bool {
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+	for _, m := range rp.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// How long the balancers wait on forwarded traffic before giving up.
+// Zero values mean no timeout.
+type Timeouts struct {
+	// Making a connection to an instance
+	Connect Duration `json:"connect,omitempty"`
+	// A connection with no traffic either way; for http services,
+	// waiting for the next request
+	Idle Duration `json:"idle,omitempty"`
+	// Reading the header of an http request, once it has started
+	RequestHeader Duration `json:"requestHeader,omitempty"`
+	// An http request and its response, from the end of the
+	// request header to the end of the response
+	Request Duration `json:"request,omitempty"`
+	// Connections to instances that have been removed, and to a
+	// service address that has changed, are given this long to
+	// finish before they are closed
+	Drain Duration `json:"drain,omitempty"`
+}
+
+func (t *Timeouts) Validate() error {
+	if t.Connect < 0 || t.Idle < 0 || t.RequestHeader < 0 || t.Request < 0 || t.Drain < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
 }
 
 type ServiceInfo struct {
@@ -39,12 +295,46 @@ type ServiceInfo struct {
 	Instances        map[string]Instance
 	ContainerRules   map[string]ContainerRule
 	IngressInstances map[netutil.IPPort]IngressInstance
+
+	// The versions of the service definition and of each
+	// container rule, for use with UpdateService and
+	// UpdateContainerRule
+	Version               uint64
+	ContainerRuleVersions map[string]uint64
 }
 
 const (
-	HostLabel  = "host"
-	StateLabel = "state"
-	RuleLabel  = "rule"
+	HostLabel   = "host"
+	StateLabel  = "state"
+	RuleLabel   = "rule"
+	HealthLabel = "health"
+)
+
+// The values of StateLabel.  Only live instances are given traffic.
+const (
+	StateLive      = "live"
+	StateNoAddress = "no address"
+	StateUnhealthy = "unhealthy"
+	StateStarting  = "starting"
+)
+
+// The values of Instance.Health.  Instances that have not been checked
+// (yet) have no health, and are presumed to be fine.  Starting is
+// only reported by Docker, for containers with a HEALTHCHECK that
+// has not yet passed.
+const (
+	Healthy   = "healthy"
+	Unhealthy = "unhealthy"
+	Starting  = "starting"
+)
+
+// Instances receive traffic in proportion to their weights.  A
+// container can give its own weight with the label WeightLabel;
+// otherwise it gets the weight of the rule that selected it, or
+// DefaultWeight.
+const (
+	WeightLabel   = "flux.weight"
+	DefaultWeight = 100
 )
 
 type Instance struct {
@@ -52,6 +342,11 @@ type Instance struct {
 	ContainerRule string            `json:"containerRule"`
 	Address       *netutil.IPPort   `json:"address,omitempty"`
 	Labels        map[string]string `json:"labels"`
+	// 0 means DefaultWeight
+	Weight int `json:"weight,omitempty"`
+	// As determined by the service's health check, or the
+	// container's HEALTHCHECK, if either is present
+	Health string `json:"health,omitempty"`
 }
 
 type IngressInstance struct {
@@ -67,13 +362,20 @@ func (inst Instance) Label(k string) string {
 	case HostLabel:
 		return inst.Host.IP.String()
 	case StateLabel:
-		if inst.Address == nil {
-			return "no address"
-		} else {
-			return "live"
+		switch {
+		case inst.Address == nil:
+			return StateNoAddress
+		case inst.Health == Unhealthy:
+			return StateUnhealthy
+		case inst.Health == Starting:
+			return StateStarting
+		default:
+			return StateLive
 		}
 	case RuleLabel:
 		return inst.ContainerRule
+	case HealthLabel:
+		return inst.Health
 	default:
 		return inst.Labels[k]
 	}
@@ -95,4 +397,7 @@ func (spec *ContainerRule) Includes(s Labeled) bool {
 type ServiceChange struct {
 	Name           string
 	ServiceDeleted bool
+
+	// The store index at which the change happened
+	Index uint64
 }
@@ -1,9 +1,14 @@
 package store
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/netutil"
 )
 
 func toMap(vals []string) map[string]string {
@@ -44,3 +49,86 @@ func TestIncludes(t *testing.T) {
 	assert.False(spec.Includes(
 		inst("foo", "nope")))
 }
+
+func TestInstanceState(t *testing.T) {
+	inst := Instance{}
+	require.Equal(t, StateNoAddress, inst.Label(StateLabel))
+	inst.Address = netutil.ParseIPPortPtr("10.0.0.1:80")
+	require.Equal(t, StateLive, inst.Label(StateLabel))
+	inst.Health = Healthy
+	require.Equal(t, StateLive, inst.Label(StateLabel))
+	inst.Health = Unhealthy
+	require.Equal(t, StateUnhealthy, inst.Label(StateLabel))
+	require.Equal(t, Unhealthy, inst.Label(HealthLabel))
+	inst.Health = Starting
+	require.Equal(t, StateStarting, inst.Label(StateLabel))
+}
+
+func TestHealthCheckJSON(t *testing.T) {
+	hc := HealthCheck{Type: HealthCheckHTTP, Path: "/health", Interval: Duration(5 * time.Second)}
+	data, err := json.Marshal(hc)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type": "http", "path": "/health", "interval": "5s"}`, string(data))
+
+	var hc2 HealthCheck
+	require.NoError(t, json.Unmarshal(data, &hc2))
+	require.Equal(t, hc, hc2)
+
+	require.Error(t, json.Unmarshal([]byte(`{"interval": "soon"}`), &hc2))
+}
+
+func TestHealthCheckDefaults(t *testing.T) {
+	require.Error(t, (&HealthCheck{Type: "ping"}).Validate())
+	require.Error(t, (&HealthCheck{Type: HealthCheckTCP, Path: "/"}).Validate())
+	require.Error(t, (&HealthCheck{Type: HealthCheckTCP, Interval: -1}).Validate())
+	require.NoError(t, (&HealthCheck{Type: HealthCheckTCP}).Validate())
+
+	require.Equal(t, HealthCheck{
+		Type:               HealthCheckHTTP,
+		Path:               "/",
+		Interval:           Duration(DefaultHealthCheckInterval),
+		Timeout:            Duration(DefaultHealthCheckTimeout),
+		HealthyThreshold:   DefaultHealthyThreshold,
+		UnhealthyThreshold: DefaultUnhealthyThreshold,
+	}, HealthCheck{Type: HealthCheckHTTP}.WithDefaults())
+
+	// The timeout is no longer than the interval
+	hc := HealthCheck{Type: HealthCheckTCP, Interval: Duration(time.Second)}.WithDefaults()
+	require.Equal(t, Duration(time.Second), hc.Timeout)
+}
+
+func TestOutlierDetection(t *testing.T) {
+	require.NoError(t, (&OutlierDetection{}).Validate())
+	require.Error(t, (&OutlierDetection{Consecutive5xx: -1}).Validate())
+	require.Error(t, (&OutlierDetection{MaxEjectionPercent: 101}).Validate())
+
+	require.Equal(t, OutlierDetection{
+		Consecutive5xx:           10,
+		ConsecutiveGatewayErrors: DefaultConsecutiveGatewayErrors,
+		MaxEjectionPercent:       DefaultMaxEjectionPercent,
+	}, OutlierDetection{Consecutive5xx: 10}.WithDefaults())
+}
+
+func TestRetryPolicy(t *testing.T) {
+	require.NoError(t, (&RetryPolicy{Methods: []string{"PUT"}}).Validate())
+	require.Error(t, (&RetryPolicy{Methods: []string{"PUT,DELETE"}}).Validate())
+	require.Error(t, (&RetryPolicy{MaxRetries: -1}).Validate())
+
+	rp := RetryPolicy{Methods: []string{"PUT"}, MaxRetries: 1}.WithDefaults()
+	require.Equal(t, 1, rp.MaxRetries)
+	require.Equal(t, DefaultBudgetPercent, rp.BudgetPercent)
+	require.Equal(t, int64(DefaultMaxBodyBytes), rp.MaxBodyBytes)
+
+	require.True(t, rp.Idempotent("GET"))
+	require.True(t, rp.Idempotent("PUT"))
+	require.False(t, rp.Idempotent("POST"))
+}
+
+func TestTimeouts(t *testing.T) {
+	require.NoError(t, (&Timeouts{Connect: Duration(time.Second)}).Validate())
+	require.Error(t, (&Timeouts{Idle: Duration(-time.Second)}).Validate())
+
+	b, err := json.Marshal(Timeouts{Request: Duration(90 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, `{"request":"1m30s"}`, string(b))
+}
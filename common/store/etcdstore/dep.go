@@ -1,6 +1,7 @@
 package etcdstore
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/weaveworks/flux/common/daemon"
@@ -42,8 +43,23 @@ func (cf *dependencyConfig) Populate(deps *daemon.Dependencies) {
 }
 
 func (cf *dependencyConfig) MakeValue() (interface{}, daemon.StartFunc, error) {
-	st := newEtcdStore(cf.client)
-	return st, cf.startFunc(st), nil
+	switch api := cf.client.Config().API; api {
+	case "", API_V2:
+		st := newEtcdStore(cf.client)
+		return st, cf.startFunc(st), nil
+
+	case API_V3:
+		c, err := cf.client.Config().NewV3Client()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		st := newEtcdV3Store(c, cf.client.Prefix)
+		return st, cf.v3StartFunc(st), nil
+
+	default:
+		return nil, nil, fmt.Errorf(`unknown etcd API version "%s"; expected "%s" or "%s"`, api, API_V2, API_V3)
+	}
 }
 
 func (cf *dependencyConfig) startFunc(st *etcdStore) daemon.StartFunc {
@@ -62,3 +78,16 @@ func (cf *dependencyConfig) startFunc(st *etcdStore) daemon.StartFunc {
 			errs.Post(st.doCollection())
 		})))
 }
+
+func (cf *dependencyConfig) v3StartFunc(st *etcdV3Store) daemon.StartFunc {
+	// Records are attached to a lease, so etcd takes care of
+	// removing them when it expires; all we need to do is keep
+	// it alive.
+	ttl := time.Duration(cf.ttl) * time.Second
+	hb := &heartbeat.HeartbeatConfig{
+		Cluster: st,
+		TTL:     ttl,
+	}
+
+	return daemon.Restart(ttl/2, hb.StartFunc())
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base32"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +21,7 @@ import (
 
 type etcdStore struct {
 	etcdutil.Client
+	keyspace
 	ctx          context.Context
 	session      string
 	sessionReady chan struct{}
@@ -41,13 +43,30 @@ type sessionHost struct {
 	Session string
 }
 
-func NewFromEnv() (*etcdStore, error) {
-	c, err := etcdutil.NewClientFromEnv()
-	if err != nil {
-		return nil, err
-	}
+// Make a store using the etcd address given in the environment.  The
+// etcd API version is taken from ETCD_API ("v2" or "v3"), defaulting
+// to v2, and the key prefix from ETCD_PREFIX.
+func NewFromEnv() (store.Store, error) {
+	switch api := os.Getenv("ETCD_API"); api {
+	case "", API_V2:
+		c, err := etcdutil.NewClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		return newEtcdStore(c), nil
+
+	case API_V3:
+		c, err := etcdutil.NewV3ClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		return newEtcdV3Store(c, etcdutil.PrefixFromEnv()), nil
 
-	return newEtcdStore(c), nil
+	default:
+		return nil, fmt.Errorf(`unknown etcd API version "%s" in ETCD_API; expected "%s" or "%s"`, api, API_V2, API_V3)
+	}
 }
 
 func New(c etcdutil.Client) store.Store {
@@ -57,6 +76,7 @@ func New(c etcdutil.Client) store.Store {
 func newEtcdStore(c etcdutil.Client) *etcdStore {
 	return &etcdStore{
 		Client:       c,
+		keyspace:     newKeyspace(c.Prefix),
 		ctx:          context.Background(),
 		sessionReady: make(chan struct{}),
 	}
@@ -75,34 +95,78 @@ func (es *etcdStore) Ping() error {
 }
 
 const (
-	ROOT                  = "/weave-flux/"
-	SERVICE_ROOT          = ROOT + "service/"
-	HOST_ROOT             = ROOT + "host/"
-	SESSION_ROOT          = ROOT + "session/"
+	API_V2 = etcdutil.API_V2
+	API_V3 = etcdutil.API_V3
+)
+
+const (
+	SERVICE_PATH          = "service/"
+	HOST_PATH             = "host/"
+	SESSION_PATH          = "session/"
+	HISTORY_PATH          = "history/"
 	INSTANCE_PATH         = "instances"
 	DETAIL_PATH           = "spec"
 	RULE_PATH             = "rules"
 	INGRESS_INSTANCE_PATH = "ingress-instances"
 )
 
-func serviceRootKey(serviceName string) string {
-	return SERVICE_ROOT + serviceName
+// The keys used by the store all live under a prefix, so that several
+// Flux clusters can share an etcd.  The history of each service is
+// kept apart from the service, so that it is not read along with the
+// service, and outlives it.
+type keyspace struct {
+	root        string
+	serviceRoot string
+	hostRoot    string
+	sessionRoot string
+	historyRoot string
 }
 
-func serviceKey(serviceName string) string {
-	return fmt.Sprintf("%s%s/%s", SERVICE_ROOT, serviceName, DETAIL_PATH)
+func newKeyspace(prefix string) keyspace {
+	root := etcdutil.NormalizePrefix(prefix)
+	return keyspace{
+		root:        root,
+		serviceRoot: root + SERVICE_PATH,
+		hostRoot:    root + HOST_PATH,
+		sessionRoot: root + SESSION_PATH,
+		historyRoot: root + HISTORY_PATH,
+	}
 }
 
-func ruleKey(serviceName, ruleName string) string {
-	return fmt.Sprintf("%s%s/%s/%s", SERVICE_ROOT, serviceName, RULE_PATH, ruleName)
+func (ks keyspace) serviceRootKey(serviceName string) string {
+	return ks.serviceRoot + serviceName
 }
 
-func instanceKey(serviceName, instanceName string) string {
-	return fmt.Sprintf("%s%s/%s/%s", SERVICE_ROOT, serviceName, INSTANCE_PATH, instanceName)
+func (ks keyspace) serviceKey(serviceName string) string {
+	return fmt.Sprintf("%s%s/%s", ks.serviceRoot, serviceName, DETAIL_PATH)
 }
 
-func ingressInstanceKey(serviceName string, addr netutil.IPPort) string {
-	return fmt.Sprintf("%s%s/%s/%s", SERVICE_ROOT, serviceName, INGRESS_INSTANCE_PATH, addr)
+func (ks keyspace) ruleKey(serviceName, ruleName string) string {
+	return fmt.Sprintf("%s%s/%s/%s", ks.serviceRoot, serviceName, RULE_PATH, ruleName)
+}
+
+func (ks keyspace) instanceKey(serviceName, instanceName string) string {
+	return fmt.Sprintf("%s%s/%s/%s", ks.serviceRoot, serviceName, INSTANCE_PATH, instanceName)
+}
+
+func (ks keyspace) ingressInstanceKey(serviceName string, addr netutil.IPPort) string {
+	return fmt.Sprintf("%s%s/%s/%s", ks.serviceRoot, serviceName, INGRESS_INSTANCE_PATH, addr)
+}
+
+func (ks keyspace) historyRootKey(serviceName string) string {
+	return ks.historyRoot + serviceName
+}
+
+func (ks keyspace) historyKey(serviceName string, revision int) string {
+	return fmt.Sprintf("%s/%d", ks.historyRootKey(serviceName), revision)
+}
+
+func (ks keyspace) hostKey(identity string) string {
+	return ks.hostRoot + identity
+}
+
+func (ks keyspace) sessionKey(id string) string {
+	return ks.sessionRoot + id
 }
 
 type parsedRootKey struct {
@@ -145,12 +209,12 @@ func (k parsedIngressInstanceKey) relevantTo(opts store.QueryServiceOptions) (bo
 
 // Parse a path to find its type
 
-func parseKey(key string) interface{} {
-	if len(key) <= len(SERVICE_ROOT) {
+func (ks keyspace) parseKey(key string) interface{} {
+	if len(key) <= len(ks.serviceRoot) {
 		return parsedRootKey{}
 	}
 
-	p := strings.Split(key[len(SERVICE_ROOT):], "/")
+	p := strings.Split(key[len(ks.serviceRoot):], "/")
 	if len(p) == 1 {
 		return parsedServiceRootKey{p[0]}
 	}
@@ -179,7 +243,7 @@ func parseKey(key string) interface{} {
 }
 
 func (es *etcdStore) CheckRegisteredService(serviceName string) error {
-	_, err := es.Get(es.ctx, serviceRootKey(serviceName), nil)
+	_, err := es.Get(es.ctx, es.serviceRootKey(serviceName), nil)
 	return err
 }
 
@@ -189,16 +253,20 @@ func (es *etcdStore) AddService(name string, details store.Service) error {
 		return fmt.Errorf("Failed to encode: %s", err)
 	}
 
-	_, err = es.Set(es.ctx, serviceKey(name), string(json), nil)
+	_, err = es.Set(es.ctx, es.serviceKey(name), string(json), nil)
 	return err
 }
 
+func (es *etcdStore) UpdateService(name string, details store.Service, version uint64) error {
+	return es.setJSONIfVersion(es.serviceKey(name), &details, version)
+}
+
 func (es *etcdStore) RemoveService(serviceName string) error {
-	return es.deleteRecursive(serviceRootKey(serviceName))
+	return es.deleteRecursive(es.serviceRootKey(serviceName))
 }
 
 func (es *etcdStore) RemoveAllServices() error {
-	return es.deleteRecursive(SERVICE_ROOT)
+	return es.deleteRecursive(es.serviceRoot)
 }
 
 func (es *etcdStore) deleteRecursive(key string) error {
@@ -213,7 +281,7 @@ func (es *etcdStore) GetService(serviceName string, opts store.QueryServiceOptio
 		return nil, err
 	}
 
-	node, _, err := es.getDirNode(serviceRootKey(serviceName), false,
+	node, _, err := es.getDirNode(es.serviceRootKey(serviceName), false,
 		opts.WithInstances || opts.WithContainerRules ||
 			opts.WithIngressInstances)
 	if err != nil {
@@ -229,7 +297,7 @@ func (es *etcdStore) GetAllServices(opts store.QueryServiceOptions) (map[string]
 		return nil, err
 	}
 
-	node, _, err := es.getDirNode(SERVICE_ROOT, true, true)
+	node, _, err := es.getDirNode(es.serviceRoot, true, true)
 	if err != nil {
 		return nil, err
 	}
@@ -295,7 +363,7 @@ func serviceInfoFromNode(node *etcd.Node, opts store.QueryServiceOptions, liveSe
 		return nil, fmt.Errorf("missing services details in etcd node %s", node.Key)
 	}
 
-	svc := &store.ServiceInfo{}
+	svc := &store.ServiceInfo{Version: details.ModifiedIndex}
 	if err := json.Unmarshal([]byte(details.Value), &svc.Service); err != nil {
 		return nil, err
 	}
@@ -316,6 +384,7 @@ func serviceInfoFromNode(node *etcd.Node, opts store.QueryServiceOptions, liveSe
 
 	if opts.WithContainerRules {
 		svc.ContainerRules = make(map[string]store.ContainerRule)
+		svc.ContainerRuleVersions = make(map[string]uint64)
 		for name, n := range indexDir(dir[RULE_PATH]) {
 			var gs store.ContainerRule
 			if err := json.Unmarshal([]byte(n.Value), &gs); err != nil {
@@ -323,6 +392,7 @@ func serviceInfoFromNode(node *etcd.Node, opts store.QueryServiceOptions, liveSe
 			}
 
 			svc.ContainerRules[name] = gs
+			svc.ContainerRuleVersions[name] = n.ModifiedIndex
 		}
 	}
 
@@ -349,26 +419,59 @@ func serviceInfoFromNode(node *etcd.Node, opts store.QueryServiceOptions, liveSe
 }
 
 func (es *etcdStore) SetContainerRule(serviceName string, ruleName string, spec store.ContainerRule) error {
-	return es.setJSON(ruleKey(serviceName, ruleName), spec)
+	return es.setJSON(es.ruleKey(serviceName, ruleName), spec)
+}
+
+func (es *etcdStore) UpdateContainerRule(serviceName string, ruleName string, spec store.ContainerRule, version uint64) error {
+	return es.setJSONIfVersion(es.ruleKey(serviceName, ruleName), spec, version)
 }
 
 func (es *etcdStore) RemoveContainerRule(serviceName string, ruleName string) error {
-	return es.deleteRecursive(ruleKey(serviceName, ruleName))
+	return es.deleteRecursive(es.ruleKey(serviceName, ruleName))
+}
+
+func (es *etcdStore) RemoveContainerRuleIfVersion(serviceName string, ruleName string, version uint64) error {
+	key := es.ruleKey(serviceName, ruleName)
+	var err error
+	if version == 0 {
+		// Nothing to remove, provided there is still nothing
+		// there
+		if _, err = es.Get(es.ctx, key, nil); err == nil {
+			return store.ErrVersionConflict
+		}
+	} else {
+		_, err = es.Delete(es.ctx, key,
+			&etcd.DeleteOptions{PrevIndex: version})
+	}
+
+	if cerr, ok := err.(etcd.Error); ok {
+		switch cerr.Code {
+		case etcd.ErrorCodeKeyNotFound:
+			if version == 0 {
+				return nil
+			}
+			return store.ErrVersionConflict
+		case etcd.ErrorCodeTestFailed:
+			return store.ErrVersionConflict
+		}
+	}
+
+	return err
 }
 
 func (es *etcdStore) AddInstance(serviceName string, instanceName string, instance store.Instance) error {
 	<-es.sessionReady
-	return es.setJSON(instanceKey(serviceName, instanceName),
+	return es.setJSON(es.instanceKey(serviceName, instanceName),
 		sessionInstance{Instance: instance, Session: es.session})
 }
 
 func (es *etcdStore) RemoveInstance(serviceName, instanceName string) error {
-	return es.deleteRecursive(instanceKey(serviceName, instanceName))
+	return es.deleteRecursive(es.instanceKey(serviceName, instanceName))
 }
 
 func (es *etcdStore) AddIngressInstance(serviceName string, addr netutil.IPPort, details store.IngressInstance) error {
 	<-es.sessionReady
-	return es.setJSON(ingressInstanceKey(serviceName, addr),
+	return es.setJSON(es.ingressInstanceKey(serviceName, addr),
 		sessionIngressInstance{
 			IngressInstance: details,
 			Session:         es.session,
@@ -376,7 +479,7 @@ func (es *etcdStore) AddIngressInstance(serviceName string, addr netutil.IPPort,
 }
 
 func (es *etcdStore) RemoveIngressInstance(serviceName string, addr netutil.IPPort) error {
-	return es.deleteRecursive(ingressInstanceKey(serviceName, addr))
+	return es.deleteRecursive(es.ingressInstanceKey(serviceName, addr))
 }
 
 func (es *etcdStore) setJSON(key string, val interface{}) error {
@@ -389,82 +492,131 @@ func (es *etcdStore) setJSON(key string, val interface{}) error {
 	return err
 }
 
+// Set a key only if its ModifiedIndex is the version given, or if it
+// doesn't exist when the version is zero.
+func (es *etcdStore) setJSONIfVersion(key string, val interface{}, version uint64) error {
+	json, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("Failed to encode: %s", err)
+	}
+
+	opts := &etcd.SetOptions{PrevIndex: version}
+	if version == 0 {
+		opts = &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+	}
+
+	_, err = es.Set(es.ctx, key, string(json), opts)
+	if cerr, ok := err.(etcd.Error); ok {
+		switch cerr.Code {
+		case etcd.ErrorCodeTestFailed, etcd.ErrorCodeNodeExist, etcd.ErrorCodeKeyNotFound:
+			return store.ErrVersionConflict
+		}
+	}
+
+	return err
+}
+
+func (es *etcdStore) CurrentIndex() (uint64, error) {
+	_, index, err := es.getDirNode(es.serviceRoot, true, false)
+	return index, err
+}
+
 func (es *etcdStore) WatchServices(ctx context.Context, resCh chan<- store.ServiceChange, errorSink daemon.ErrorSink, opts store.QueryServiceOptions) {
+	es.watchServices(ctx, 0, resCh, errorSink, opts)
+}
+
+func (es *etcdStore) WatchServicesFrom(ctx context.Context, index uint64, resCh chan<- store.ServiceChange, errorSink daemon.ErrorSink, opts store.QueryServiceOptions) {
+	es.watchServices(ctx, index, resCh, errorSink, opts)
+}
+
+// Watch services, from the index given, or from the current index if
+// it is zero.
+func (es *etcdStore) watchServices(ctx context.Context, fromIndex uint64, resCh chan<- store.ServiceChange, errorSink daemon.ErrorSink, opts store.QueryServiceOptions) {
 	if ctx == nil {
 		ctx = es.ctx
 	}
 
 	svcs := make(map[string]struct{})
 
-	handleResponse := func(r *etcd.Response) {
+	// Get the initial service list, so that we can report them as
+	// deleted if the root node is deleted.  This also gets the
+	// initial index for the watch. (Though perhaps that should
+	// really be based on the ModifieedIndex of the nodes
+	// themselves?)
+	node, listIndex, err := es.getDirNode(es.serviceRoot, true, false)
+	if err != nil {
+		errorSink.Post(err)
+		return
+	}
+
+	for name := range indexDir(node) {
+		svcs[name] = struct{}{}
+	}
+
+	startIndex := listIndex
+	if fromIndex != 0 {
+		startIndex = fromIndex
+	}
+
+	handleResponse := func(r *etcd.Response) error {
+		index := r.Node.ModifiedIndex
+		change := func(name string, deleted bool) {
+			resCh <- store.ServiceChange{
+				Name:           name,
+				ServiceDeleted: deleted,
+				Index:          index,
+			}
+		}
+
 		switch r.Action {
 		case "delete":
-			switch key := parseKey(r.Node.Key).(type) {
+			switch key := es.parseKey(r.Node.Key).(type) {
 			case parsedRootKey:
+				if index <= listIndex {
+					// The services that went with the
+					// root were deleted before we
+					// listed them, so we can't
+					// report them.
+					return store.ErrHistoryCompacted
+				}
+
 				for name := range svcs {
-					resCh <- store.ServiceChange{
-						Name:           name,
-						ServiceDeleted: true,
-					}
+					change(name, true)
 				}
 				svcs = make(map[string]struct{})
 
 			case parsedServiceRootKey:
 				delete(svcs, key.serviceName)
-				resCh <- store.ServiceChange{
-					Name:           key.serviceName,
-					ServiceDeleted: true,
-				}
+				change(key.serviceName, true)
 
 			case interface {
 				relevantTo(opts store.QueryServiceOptions) (bool, string)
 			}:
 				if relevant, service := key.relevantTo(opts); relevant {
-					resCh <- store.ServiceChange{
-						Name:           service,
-						ServiceDeleted: false,
-					}
+					change(service, false)
 				}
 			}
 
 		case "set":
-			switch key := parseKey(r.Node.Key).(type) {
+			switch key := es.parseKey(r.Node.Key).(type) {
 			case parsedServiceKey:
 				svcs[key.serviceName] = struct{}{}
-				resCh <- store.ServiceChange{
-					Name:           key.serviceName,
-					ServiceDeleted: false,
-				}
+				change(key.serviceName, false)
 
 			case interface {
 				relevantTo(opts store.QueryServiceOptions) (bool, string)
 			}:
 				if relevant, service := key.relevantTo(opts); relevant {
-					resCh <- store.ServiceChange{
-						Name:           service,
-						ServiceDeleted: false,
-					}
+					change(service, false)
 				}
 			}
 		}
-	}
 
-	// Get the initial service list, so that we can report them as
-	// deleted if the root node is deleted.  This also gets the
-	// initial index for the watch. (Though perhaps that should
-	// really be based on the ModifieedIndex of the nodes
-	// themselves?)
-	node, startIndex, err := es.getDirNode(SERVICE_ROOT, true, false)
-	if err != nil {
-		errorSink.Post(err)
-		return
+		return nil
 	}
 
-	for name := range indexDir(node) {
-		svcs[name] = struct{}{}
-	}
 	go func() {
-		watcher := es.Watcher(SERVICE_ROOT,
+		watcher := es.Watcher(es.serviceRoot,
 			&etcd.WatcherOptions{
 				AfterIndex: startIndex,
 				Recursive:  true,
@@ -473,33 +625,101 @@ func (es *etcdStore) WatchServices(ctx context.Context, resCh chan<- store.Servi
 		for {
 			next, err := watcher.Next(ctx)
 			if err != nil {
+				if cerr, ok := err.(etcd.Error); ok && cerr.Code == etcd.ErrorCodeEventIndexCleared {
+					err = store.ErrHistoryCompacted
+				}
 				if err != context.Canceled {
 					errorSink.Post(err)
 				}
 				break
 			}
 
-			handleResponse(next)
+			if err := handleResponse(next); err != nil {
+				errorSink.Post(err)
+				break
+			}
 		}
 	}()
 }
 
-/* Host methods */
+func (es *etcdStore) AddServiceRevision(serviceName string, rev store.ServiceRevision) error {
+	for {
+		history, err := es.GetServiceHistory(serviceName)
+		if err != nil {
+			return err
+		}
+
+		rev.Revision = nextRevision(history)
+		err = es.setJSONIfVersion(es.historyKey(serviceName, rev.Revision), rev, 0)
+		if err == store.ErrVersionConflict {
+			// Someone else took that revision number
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, old := range expiredRevisions(history) {
+			if err := es.deleteRecursive(es.historyKey(serviceName, old.Revision)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func (es *etcdStore) GetServiceHistory(serviceName string) ([]store.ServiceRevision, error) {
+	node, _, err := es.getDirNode(es.historyRootKey(serviceName), true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []store.ServiceRevision
+	for _, n := range node.Nodes {
+		var rev store.ServiceRevision
+		if err := json.Unmarshal([]byte(n.Value), &rev); err != nil {
+			return nil, err
+		}
+
+		history = append(history, rev)
+	}
+
+	store.SortRevisions(history)
+	return history, nil
+}
+
+// The number to give to a revision added to the history
+func nextRevision(history []store.ServiceRevision) int {
+	if len(history) == 0 {
+		return 1
+	}
 
-func hostKey(identity string) string {
-	return HOST_ROOT + identity
+	return history[len(history)-1].Revision + 1
 }
 
+// The revisions to discard once another has been added to the history
+func expiredRevisions(history []store.ServiceRevision) []store.ServiceRevision {
+	excess := len(history) + 1 - store.MaxServiceRevisions
+	if excess <= 0 {
+		return nil
+	}
+
+	return history[:excess]
+}
+
+/* Host methods */
+
 func (es *etcdStore) RegisterHost(identity string, details *store.Host) error {
 	<-es.sessionReady
-	return es.setJSON(hostKey(identity), sessionHost{
+	return es.setJSON(es.hostKey(identity), sessionHost{
 		Host:    details,
 		Session: es.session,
 	})
 }
 
 func (es *etcdStore) DeregisterHost(identity string) error {
-	return es.deleteRecursive(hostKey(identity))
+	return es.deleteRecursive(es.hostKey(identity))
 }
 
 func (es *etcdStore) GetHosts() ([]*store.Host, error) {
@@ -508,7 +728,7 @@ func (es *etcdStore) GetHosts() ([]*store.Host, error) {
 		return nil, err
 	}
 
-	node, _, err := es.getDirNode(HOST_ROOT, true, false)
+	node, _, err := es.getDirNode(es.hostRoot, true, false)
 	if err != nil {
 		return nil, err
 	}
@@ -539,7 +759,7 @@ func (es *etcdStore) WatchHosts(ctx context.Context, changes chan<- store.HostCh
 	}
 
 	hosts := make(map[string]struct{})
-	node, startIndex, err := es.getDirNode(HOST_ROOT, true, false)
+	node, startIndex, err := es.getDirNode(es.hostRoot, true, false)
 	if err != nil {
 		errs.Post(err)
 		return
@@ -547,7 +767,7 @@ func (es *etcdStore) WatchHosts(ctx context.Context, changes chan<- store.HostCh
 
 	handleResponse := func(r *etcd.Response) {
 		fmt.Printf("Change %+v\n", r)
-		hostID := r.Node.Key[len(HOST_ROOT):]
+		hostID := r.Node.Key[len(es.hostRoot):]
 		switch r.Action {
 		case "delete", "expire":
 			delete(hosts, hostID)
@@ -569,7 +789,7 @@ func (es *etcdStore) WatchHosts(ctx context.Context, changes chan<- store.HostCh
 		hosts[name] = struct{}{}
 	}
 	go func() {
-		watcher := es.Watcher(HOST_ROOT,
+		watcher := es.Watcher(es.hostRoot,
 			&etcd.WatcherOptions{
 				AfterIndex: startIndex,
 				Recursive:  true,
@@ -589,26 +809,22 @@ func (es *etcdStore) WatchHosts(ctx context.Context, changes chan<- store.HostCh
 
 /* store.Cluster methods */
 
-func sessionKey(id string) string {
-	return SESSION_ROOT + id
-}
-
 func (es *etcdStore) Heartbeat(ttl time.Duration) error {
 	es.initSession.Do(func() {
 		es.session = makeSessionID()
 		close(es.sessionReady)
 	})
-	_, err := es.Set(es.ctx, sessionKey(es.session), es.session, &etcd.SetOptions{TTL: ttl})
+	_, err := es.Set(es.ctx, es.sessionKey(es.session), es.session, &etcd.SetOptions{TTL: ttl})
 	return err
 }
 
 func (es *etcdStore) EndSession() error {
-	_, err := es.Delete(es.ctx, sessionKey(es.session), &etcd.DeleteOptions{Recursive: false})
+	_, err := es.Delete(es.ctx, es.sessionKey(es.session), &etcd.DeleteOptions{Recursive: false})
 	return err
 }
 
 func (es *etcdStore) liveSessions() (map[string]struct{}, error) {
-	node, _, err := es.getDirNode(SESSION_ROOT, true, false)
+	node, _, err := es.getDirNode(es.sessionRoot, true, false)
 	if err != nil {
 		return nil, err
 	}
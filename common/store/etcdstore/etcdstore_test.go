@@ -15,7 +15,7 @@ import (
 )
 
 func (es *etcdStore) Reset(t *testing.T) {
-	err := es.deleteRecursive(ROOT)
+	err := es.deleteRecursive(es.root)
 	if cerr, ok := err.(etcd.Error); ok && cerr.Code == etcd.ErrorCodeKeyNotFound {
 		err = nil
 	}
@@ -23,6 +23,11 @@ func (es *etcdStore) Reset(t *testing.T) {
 	require.Nil(t, err)
 }
 
+// Delete the session key, as if its TTL had run out
+func (es *etcdStore) ExpireSession(t *testing.T) {
+	require.Nil(t, es.EndSession())
+}
+
 func TestEtcdStore(t *testing.T) {
 	server, err := embeddedetcd.NewSimpleEtcd()
 	require.Nil(t, err)
@@ -45,24 +50,51 @@ func TestSessionValues(t *testing.T) {
 
 	require.Nil(t, es.Heartbeat(10*time.Second))
 	require.Nil(t, es.RegisterHost("test host", &store.Host{IP: net.ParseIP("10.11.23.45")}))
-	hostRoot, _, err := es.getDirNode(HOST_ROOT, true, true)
+	hostRoot, _, err := es.getDirNode(es.hostRoot, true, true)
 	require.Nil(t, err)
 	require.Len(t, hostRoot.Nodes, 1)
 
 	require.Nil(t, es.AddService("test service", store.Service{}))
 	require.Nil(t, es.AddInstance("test service", "test instance", store.Instance{}))
-	service, _, err := es.getDirNode(serviceRootKey("test service"), true, true)
+	service, _, err := es.getDirNode(es.serviceRootKey("test service"), true, true)
 	require.Nil(t, err)
 	require.Len(t, indexDir(service)[INSTANCE_PATH].Nodes, 1)
 
 	require.Nil(t, es.EndSession())
 	require.Nil(t, es.doCollection())
 
-	hostRoot, _, err = es.getDirNode(HOST_ROOT, true, true)
+	hostRoot, _, err = es.getDirNode(es.hostRoot, true, true)
 	require.Nil(t, err)
 	require.Empty(t, hostRoot.Nodes)
 
-	service, _, err = es.getDirNode(serviceRootKey("test service"), true, true)
+	service, _, err = es.getDirNode(es.serviceRootKey("test service"), true, true)
 	require.Nil(t, err)
 	require.Empty(t, indexDir(service)[INSTANCE_PATH].Nodes)
 }
+
+func TestPrefixIsolation(t *testing.T) {
+	server, err := embeddedetcd.NewSimpleEtcd()
+	require.Nil(t, err)
+	defer func() { require.Nil(t, server.Destroy()) }()
+
+	c, err := etcdutil.NewClient(server.URL())
+	require.Nil(t, err)
+	es1 := newEtcdStore(c)
+
+	c.Prefix = "/other/flux"
+	es2 := newEtcdStore(c)
+	require.Equal(t, "/other/flux/", es2.root)
+
+	require.Nil(t, es1.AddService("foo", store.Service{}))
+	require.Nil(t, es2.AddService("bar", store.Service{}))
+
+	svcs, err := es1.GetAllServices(store.QueryServiceOptions{})
+	require.Nil(t, err)
+	require.Len(t, svcs, 1)
+	require.NotNil(t, svcs["foo"])
+
+	svcs, err = es2.GetAllServices(store.QueryServiceOptions{})
+	require.Nil(t, err)
+	require.Len(t, svcs, 1)
+	require.NotNil(t, svcs["bar"])
+}
@@ -0,0 +1,646 @@
+package etcdstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/flux/common/daemon"
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+// A store.Store using the etcd v3 API.  This uses the same key
+// layout as the v2 store, but rather than recording a session ID
+// alongside each host and instance and culling those with expired
+// sessions, it attaches those keys to a lease, so that etcd removes
+// them when the lease expires.
+type etcdV3Store struct {
+	keyspace
+	client *clientv3.Client
+	ctx    context.Context
+	lock   sync.Mutex
+	lease  clientv3.LeaseID
+	ttl    time.Duration
+	// The values attached to the lease, so that they can be put
+	// again if it expires
+	leased       map[string]string
+	sessionReady chan struct{}
+	initSession  sync.Once
+	// How long to wait for the first heartbeat, when putting a
+	// value attached to the session
+	sessionWait time.Duration
+}
+
+const session_wait_timeout = 30 * time.Second
+
+// Make a v3 store keeping its keys under the given prefix
+func NewV3(c *clientv3.Client, prefix string) store.Store {
+	return newEtcdV3Store(c, prefix)
+}
+
+func newEtcdV3Store(c *clientv3.Client, prefix string) *etcdV3Store {
+	return &etcdV3Store{
+		keyspace:     newKeyspace(prefix),
+		client:       c,
+		ctx:          context.Background(),
+		leased:       make(map[string]string),
+		sessionReady: make(chan struct{}),
+		sessionWait:  session_wait_timeout,
+	}
+}
+
+// Check if we can talk to etcd
+func (es *etcdV3Store) Ping() error {
+	_, err := es.client.MemberList(es.ctx)
+	return err
+}
+
+func (es *etcdV3Store) CheckRegisteredService(serviceName string) error {
+	resp, err := es.client.Get(es.ctx, es.serviceKey(serviceName),
+		clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+
+	if resp.Count == 0 {
+		return fmt.Errorf(`service "%s" not found`, serviceName)
+	}
+
+	return nil
+}
+
+func (es *etcdV3Store) AddService(name string, details store.Service) error {
+	return es.putJSON(es.serviceKey(name), &details)
+}
+
+func (es *etcdV3Store) UpdateService(name string, details store.Service, version uint64) error {
+	return es.putJSONIfVersion(es.serviceKey(name), &details, version)
+}
+
+func (es *etcdV3Store) RemoveService(serviceName string) error {
+	return es.deletePrefix(es.serviceRootKey(serviceName) + "/")
+}
+
+func (es *etcdV3Store) RemoveAllServices() error {
+	return es.deletePrefix(es.serviceRoot)
+}
+
+func (es *etcdV3Store) deletePrefix(prefix string) error {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	for key := range es.leased {
+		if strings.HasPrefix(key, prefix) {
+			delete(es.leased, key)
+		}
+	}
+
+	_, err := es.client.Delete(es.ctx, prefix, clientv3.WithPrefix())
+	return err
+}
+
+func (es *etcdV3Store) GetService(serviceName string, opts store.QueryServiceOptions) (*store.ServiceInfo, error) {
+	resp, err := es.client.Get(es.ctx, es.serviceRootKey(serviceName)+"/",
+		clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	svcs, err := es.serviceInfosFromKVs(resp.Kvs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := svcs[serviceName]
+	if svc == nil {
+		return nil, fmt.Errorf(`service "%s" not found`, serviceName)
+	}
+
+	return svc, nil
+}
+
+func (es *etcdV3Store) GetAllServices(opts store.QueryServiceOptions) (map[string]*store.ServiceInfo, error) {
+	resp, err := es.client.Get(es.ctx, es.serviceRoot, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	return es.serviceInfosFromKVs(resp.Kvs, opts)
+}
+
+type keyValue struct {
+	key         interface{}
+	value       []byte
+	modRevision int64
+}
+
+// Assemble ServiceInfos from the keys under es.serviceRoot.  Keys
+// belonging to services without a spec are ignored.
+func (ks keyspace) serviceInfosFromKVs(kvs []*mvccpb.KeyValue, opts store.QueryServiceOptions) (map[string]*store.ServiceInfo, error) {
+	svcs := make(map[string]*store.ServiceInfo)
+	var rest []keyValue
+
+	for _, kv := range kvs {
+		switch key := ks.parseKey(string(kv.Key)).(type) {
+		case parsedServiceKey:
+			svc := &store.ServiceInfo{Version: uint64(kv.ModRevision)}
+			if err := json.Unmarshal(kv.Value, &svc.Service); err != nil {
+				return nil, err
+			}
+
+			if opts.WithInstances {
+				svc.Instances = make(map[string]store.Instance)
+			}
+			if opts.WithContainerRules {
+				svc.ContainerRules = make(map[string]store.ContainerRule)
+				svc.ContainerRuleVersions = make(map[string]uint64)
+			}
+			if opts.WithIngressInstances {
+				svc.IngressInstances = make(map[netutil.IPPort]store.IngressInstance)
+			}
+
+			svcs[key.serviceName] = svc
+
+		default:
+			rest = append(rest, keyValue{key, kv.Value, kv.ModRevision})
+		}
+	}
+
+	for _, kv := range rest {
+		switch key := kv.key.(type) {
+		case parsedRuleKey:
+			svc := svcs[key.serviceName]
+			if svc == nil || !opts.WithContainerRules {
+				continue
+			}
+
+			var rule store.ContainerRule
+			if err := json.Unmarshal(kv.value, &rule); err != nil {
+				return nil, err
+			}
+
+			svc.ContainerRules[key.ruleName] = rule
+			svc.ContainerRuleVersions[key.ruleName] = uint64(kv.modRevision)
+
+		case parsedInstanceKey:
+			svc := svcs[key.serviceName]
+			if svc == nil || !opts.WithInstances {
+				continue
+			}
+
+			var inst store.Instance
+			if err := json.Unmarshal(kv.value, &inst); err != nil {
+				return nil, err
+			}
+
+			svc.Instances[key.instanceName] = inst
+
+		case parsedIngressInstanceKey:
+			svc := svcs[key.serviceName]
+			if svc == nil || !opts.WithIngressInstances {
+				continue
+			}
+
+			addr, err := netutil.ParseIPPort(key.ingressInstanceName)
+			if err != nil {
+				return nil, err
+			}
+
+			var inst store.IngressInstance
+			if err := json.Unmarshal(kv.value, &inst); err != nil {
+				return nil, err
+			}
+
+			svc.IngressInstances[addr] = inst
+		}
+	}
+
+	return svcs, nil
+}
+
+func (es *etcdV3Store) SetContainerRule(serviceName string, ruleName string, spec store.ContainerRule) error {
+	return es.putJSON(es.ruleKey(serviceName, ruleName), spec)
+}
+
+func (es *etcdV3Store) UpdateContainerRule(serviceName string, ruleName string, spec store.ContainerRule, version uint64) error {
+	return es.putJSONIfVersion(es.ruleKey(serviceName, ruleName), spec, version)
+}
+
+func (es *etcdV3Store) RemoveContainerRule(serviceName string, ruleName string) error {
+	_, err := es.client.Delete(es.ctx, es.ruleKey(serviceName, ruleName))
+	return err
+}
+
+func (es *etcdV3Store) RemoveContainerRuleIfVersion(serviceName string, ruleName string, version uint64) error {
+	key := es.ruleKey(serviceName, ruleName)
+	resp, err := es.client.Txn(es.ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(version))).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return store.ErrVersionConflict
+	}
+
+	return nil
+}
+
+func (es *etcdV3Store) AddInstance(serviceName string, instanceName string, instance store.Instance) error {
+	return es.putLeasedJSON(es.instanceKey(serviceName, instanceName),
+		instance)
+}
+
+func (es *etcdV3Store) RemoveInstance(serviceName, instanceName string) error {
+	return es.deleteLeased(es.instanceKey(serviceName, instanceName))
+}
+
+func (es *etcdV3Store) AddIngressInstance(serviceName string, addr netutil.IPPort, details store.IngressInstance) error {
+	return es.putLeasedJSON(es.ingressInstanceKey(serviceName, addr),
+		details)
+}
+
+func (es *etcdV3Store) RemoveIngressInstance(serviceName string, addr netutil.IPPort) error {
+	return es.deleteLeased(es.ingressInstanceKey(serviceName, addr))
+}
+
+func (es *etcdV3Store) putJSON(key string, val interface{}, opts ...clientv3.OpOption) error {
+	json, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("Failed to encode: %s", err)
+	}
+
+	_, err = es.client.Put(es.ctx, key, string(json), opts...)
+	return err
+}
+
+// Put a value only if the key's ModRevision is the version given.  A
+// key that doesn't exist has a ModRevision of zero.
+func (es *etcdV3Store) putJSONIfVersion(key string, val interface{}, version uint64) error {
+	json, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("Failed to encode: %s", err)
+	}
+
+	resp, err := es.client.Txn(es.ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(version))).
+		Then(clientv3.OpPut(key, string(json))).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return store.ErrVersionConflict
+	}
+
+	return nil
+}
+
+// Put a value attached to the current lease, so that it goes away
+// with the session.
+func (es *etcdV3Store) putLeasedJSON(key string, val interface{}) error {
+	select {
+	case <-es.sessionReady:
+	case <-time.After(es.sessionWait):
+		return fmt.Errorf("No session after waiting %s; has there been a heartbeat?", es.sessionWait)
+	}
+	json, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("Failed to encode: %s", err)
+	}
+
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	if err := es.ensureLease(); err != nil {
+		return err
+	}
+
+	_, err = es.client.Put(es.ctx, key, string(json),
+		clientv3.WithLease(es.lease))
+	if err == nil {
+		es.leased[key] = string(json)
+	}
+	return err
+}
+
+func (es *etcdV3Store) deleteLeased(key string) error {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	delete(es.leased, key)
+	_, err := es.client.Delete(es.ctx, key)
+	return err
+}
+
+func (es *etcdV3Store) CurrentIndex() (uint64, error) {
+	resp, err := es.client.Get(es.ctx, es.serviceRoot, clientv3.WithPrefix(),
+		clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(resp.Header.Revision), nil
+}
+
+func (es *etcdV3Store) WatchServices(ctx context.Context, resCh chan<- store.ServiceChange, errorSink daemon.ErrorSink, opts store.QueryServiceOptions) {
+	// Get the current revision, so that the watch starts from
+	// a known point.
+	rev, err := es.CurrentIndex()
+	if err != nil {
+		errorSink.Post(err)
+		return
+	}
+
+	es.WatchServicesFrom(ctx, rev, resCh, errorSink, opts)
+}
+
+func (es *etcdV3Store) WatchServicesFrom(ctx context.Context, index uint64, resCh chan<- store.ServiceChange, errorSink daemon.ErrorSink, opts store.QueryServiceOptions) {
+	if ctx == nil {
+		ctx = es.ctx
+	}
+
+	// Send a change, unless the watch has been cancelled
+	send := func(change store.ServiceChange) bool {
+		select {
+		case resCh <- change:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	handleResponse := func(r clientv3.WatchResponse) bool {
+		// Deleting a service deletes all the keys under it in
+		// one revision, and the spec key sorts last.  So
+		// note the services deleted in each revision first,
+		// in order to avoid reporting changes to them.
+		deleted := make(map[int64]map[string]struct{})
+		for _, ev := range r.Events {
+			if ev.Type != clientv3.EventTypeDelete {
+				continue
+			}
+
+			if key, ok := es.parseKey(string(ev.Kv.Key)).(parsedServiceKey); ok {
+				rev := ev.Kv.ModRevision
+				if deleted[rev] == nil {
+					deleted[rev] = make(map[string]struct{})
+				}
+				deleted[rev][key.serviceName] = struct{}{}
+			}
+		}
+
+		for _, ev := range r.Events {
+			switch key := es.parseKey(string(ev.Kv.Key)).(type) {
+			case parsedServiceKey:
+				if !send(store.ServiceChange{
+					Name:           key.serviceName,
+					ServiceDeleted: ev.Type == clientv3.EventTypeDelete,
+					Index:          uint64(ev.Kv.ModRevision),
+				}) {
+					return false
+				}
+
+			case interface {
+				relevantTo(opts store.QueryServiceOptions) (bool, string)
+			}:
+				relevant, service := key.relevantTo(opts)
+				if !relevant {
+					continue
+				}
+
+				if _, found := deleted[ev.Kv.ModRevision][service]; found {
+					continue
+				}
+
+				if !send(store.ServiceChange{
+					Name:           service,
+					ServiceDeleted: false,
+					Index:          uint64(ev.Kv.ModRevision),
+				}) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	go func() {
+		watchCh := es.client.Watch(ctx, es.serviceRoot,
+			clientv3.WithPrefix(), clientv3.WithRev(int64(index)+1))
+		for r := range watchCh {
+			if r.CompactRevision != 0 {
+				errorSink.Post(store.ErrHistoryCompacted)
+				return
+			}
+			if err := r.Err(); err != nil {
+				errorSink.Post(err)
+				return
+			}
+
+			if !handleResponse(r) {
+				return
+			}
+		}
+	}()
+}
+
+func (es *etcdV3Store) AddServiceRevision(serviceName string, rev store.ServiceRevision) error {
+	for {
+		history, err := es.GetServiceHistory(serviceName)
+		if err != nil {
+			return err
+		}
+
+		rev.Revision = nextRevision(history)
+		err = es.putJSONIfVersion(es.historyKey(serviceName, rev.Revision), rev, 0)
+		if err == store.ErrVersionConflict {
+			// Someone else took that revision number
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, old := range expiredRevisions(history) {
+			_, err := es.client.Delete(es.ctx,
+				es.historyKey(serviceName, old.Revision))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func (es *etcdV3Store) GetServiceHistory(serviceName string) ([]store.ServiceRevision, error) {
+	resp, err := es.client.Get(es.ctx, es.historyRootKey(serviceName)+"/",
+		clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var history []store.ServiceRevision
+	for _, kv := range resp.Kvs {
+		var rev store.ServiceRevision
+		if err := json.Unmarshal(kv.Value, &rev); err != nil {
+			return nil, err
+		}
+
+		history = append(history, rev)
+	}
+
+	store.SortRevisions(history)
+	return history, nil
+}
+
+/* Host methods */
+
+func (es *etcdV3Store) RegisterHost(identity string, details *store.Host) error {
+	return es.putLeasedJSON(es.hostKey(identity), details)
+}
+
+func (es *etcdV3Store) DeregisterHost(identity string) error {
+	return es.deleteLeased(es.hostKey(identity))
+}
+
+func (es *etcdV3Store) GetHosts() ([]*store.Host, error) {
+	resp, err := es.client.Get(es.ctx, es.hostRoot, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []*store.Host
+	for _, kv := range resp.Kvs {
+		var host store.Host
+		if err := json.Unmarshal(kv.Value, &host); err != nil {
+			return nil, err
+		}
+
+		hosts = append(hosts, &host)
+	}
+
+	return hosts, nil
+}
+
+func (es *etcdV3Store) WatchHosts(ctx context.Context, changes chan<- store.HostChange, errs daemon.ErrorSink) {
+	if ctx == nil {
+		ctx = es.ctx
+	}
+
+	resp, err := es.client.Get(es.ctx, es.hostRoot, clientv3.WithPrefix(),
+		clientv3.WithCountOnly())
+	if err != nil {
+		errs.Post(err)
+		return
+	}
+
+	startRev := resp.Header.Revision + 1
+	go func() {
+		watchCh := es.client.Watch(ctx, es.hostRoot,
+			clientv3.WithPrefix(), clientv3.WithRev(startRev))
+		for r := range watchCh {
+			if err := r.Err(); err != nil {
+				errs.Post(err)
+				return
+			}
+
+			for _, ev := range r.Events {
+				select {
+				case changes <- store.HostChange{
+					Name:         string(ev.Kv.Key[len(es.hostRoot):]),
+					HostDeparted: ev.Type == clientv3.EventTypeDelete,
+				}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+}
+
+/* store.Cluster methods */
+
+// The session is represented by a lease.  The first heartbeat grants
+// the lease, and subsequent heartbeats keep it alive.  If the lease
+// has expired in the meantime, etcd will have deleted everything
+// attached to it, so a new one is granted and those values are put
+// again.
+func (es *etcdV3Store) Heartbeat(ttl time.Duration) error {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	es.ttl = ttl
+	if es.lease != 0 {
+		_, err := es.client.KeepAliveOnce(es.ctx, es.lease)
+		if err != rpctypes.ErrLeaseNotFound {
+			return err
+		}
+		es.lease = 0
+	}
+
+	if err := es.ensureLease(); err != nil {
+		return err
+	}
+
+	es.initSession.Do(func() {
+		close(es.sessionReady)
+	})
+	return nil
+}
+
+// Grant a lease if there is none, and attach the values from the
+// session to it.  es.lock must be held.
+func (es *etcdV3Store) ensureLease() error {
+	if es.lease != 0 {
+		return nil
+	}
+
+	secs := int64(es.ttl / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	resp, err := es.client.Grant(es.ctx, secs)
+	if err != nil {
+		return err
+	}
+
+	for key, val := range es.leased {
+		_, err := es.client.Put(es.ctx, key, val,
+			clientv3.WithLease(resp.ID))
+		if err != nil {
+			// Leave it to the next heartbeat to try again
+			return err
+		}
+	}
+
+	es.lease = resp.ID
+	return nil
+}
+
+func (es *etcdV3Store) EndSession() error {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	es.leased = make(map[string]string)
+	if es.lease == 0 {
+		return nil
+	}
+
+	_, err := es.client.Revoke(es.ctx, es.lease)
+	es.lease = 0
+	return err
+}
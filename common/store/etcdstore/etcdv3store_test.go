@@ -0,0 +1,71 @@
+package etcdstore
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/integration"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/etcdutil"
+	"github.com/weaveworks/flux/common/store"
+	"github.com/weaveworks/flux/common/store/test"
+)
+
+func (es *etcdV3Store) Reset(t *testing.T) {
+	require.Nil(t, es.deletePrefix(es.root))
+}
+
+// Revoke the lease behind the store's back, as if it had expired
+func (es *etcdV3Store) ExpireSession(t *testing.T) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	_, err := es.client.Revoke(es.ctx, es.lease)
+	require.Nil(t, err)
+}
+
+func TestEtcdV3Store(t *testing.T) {
+	cluster := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer cluster.Terminate(t)
+
+	test.RunStoreTestSuite(newEtcdV3Store(cluster.RandClient(), etcdutil.DEFAULT_PREFIX), t)
+}
+
+func TestLeasedValues(t *testing.T) {
+	cluster := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer cluster.Terminate(t)
+
+	c := cluster.RandClient()
+	es := newEtcdV3Store(c, etcdutil.DEFAULT_PREFIX)
+
+	require.Nil(t, es.Heartbeat(10*time.Second))
+	require.Nil(t, es.RegisterHost("test host", &store.Host{IP: net.ParseIP("10.11.23.45")}))
+	require.Nil(t, es.AddService("test service", store.Service{}))
+	require.Nil(t, es.AddInstance("test service", "test instance", store.Instance{}))
+
+	resp, err := c.Get(es.ctx, es.root, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	require.Nil(t, err)
+	require.Equal(t, int64(3), resp.Count)
+
+	// Ending the session revokes the lease, taking the host and
+	// instance with it
+	require.Nil(t, es.EndSession())
+
+	resp, err = c.Get(es.ctx, es.root, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	require.Nil(t, err)
+	require.Equal(t, int64(1), resp.Count)
+
+	hosts, err := es.GetHosts()
+	require.Nil(t, err)
+	require.Empty(t, hosts)
+}
+
+func TestLeasedValueWithoutSession(t *testing.T) {
+	// Without a heartbeat there is no lease to attach values to,
+	// which is an error rather than waiting forever
+	es := newEtcdV3Store(nil, etcdutil.DEFAULT_PREFIX)
+	es.sessionWait = 10 * time.Millisecond
+	require.Error(t, es.AddInstance("test service", "test instance", store.Instance{}))
+}
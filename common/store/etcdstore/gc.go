@@ -11,12 +11,12 @@ type SessionValue struct {
 }
 
 func (es *etcdStore) doCollection() error {
-	hostRoot, _, err := es.getDirNode(HOST_ROOT, true, true)
+	hostRoot, _, err := es.getDirNode(es.hostRoot, true, true)
 	if err != nil {
 		return err
 	}
 
-	serviceRoot, _, err := es.getDirNode(SERVICE_ROOT, true, true)
+	serviceRoot, _, err := es.getDirNode(es.serviceRoot, true, true)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// How many revisions of each service's configuration are kept
+const MaxServiceRevisions = 20
+
+// A revision of a service's configuration, as kept in its history
+type ServiceRevision struct {
+	Revision       int                      `json:"revision"`
+	Time           time.Time                `json:"time"`
+	Author         string                   `json:"author,omitempty"`
+	Description    string                   `json:"description,omitempty"`
+	Service        Service                  `json:"service"`
+	ContainerRules map[string]ContainerRule `json:"rules,omitempty"`
+}
+
+// Record a configuration of a service in its history.  This is given
+// the configuration as it was written, rather than reading it back,
+// since by then it may include changes made by someone else.
+func RecordServiceRevision(st Store, serviceName, author, description string, svc Service, rules map[string]ContainerRule) error {
+	return st.AddServiceRevision(serviceName, ServiceRevision{
+		Time:           time.Now().UTC(),
+		Author:         author,
+		Description:    description,
+		Service:        svc,
+		ContainerRules: rules,
+	})
+}
+
+// Record the configuration of a service as read before changing it,
+// if the service has no history yet, so that the first change
+// recorded can be rolled back.
+func RecordInitialRevision(st Store, serviceName string, info *ServiceInfo) error {
+	history, err := st.GetServiceHistory(serviceName)
+	if err != nil || len(history) > 0 {
+		return err
+	}
+
+	return RecordServiceRevision(st, serviceName, "", "initial",
+		info.Service, info.ContainerRules)
+}
+
+type revisionsByNumber []ServiceRevision
+
+func (revs revisionsByNumber) Len() int           { return len(revs) }
+func (revs revisionsByNumber) Less(i, j int) bool { return revs[i].Revision < revs[j].Revision }
+func (revs revisionsByNumber) Swap(i, j int)      { revs[i], revs[j] = revs[j], revs[i] }
+
+// Sort revisions into order, oldest first.
+func SortRevisions(revs []ServiceRevision) {
+	sort.Sort(revisionsByNumber(revs))
+}
@@ -36,6 +36,9 @@ func NewInMem() *InMem {
 	return &InMem{
 		services:         make(map[string]store.Service),
 		groupSpecs:       make(map[string]map[string]store.ContainerRule),
+		serviceVersions:  make(map[string]uint64),
+		groupVersions:    make(map[string]map[string]uint64),
+		history:          make(map[string][]store.ServiceRevision),
 		instances:        make(map[string]map[string]sessionInstance),
 		ingressInstances: make(map[string]map[netutil.IPPort]sessionIngressInstance),
 		hosts:            make(map[string]*sessionHost),
@@ -47,6 +50,10 @@ func NewInMem() *InMem {
 type InMem struct {
 	services         map[string]store.Service
 	groupSpecs       map[string]map[string]store.ContainerRule
+	serviceVersions  map[string]uint64
+	groupVersions    map[string]map[string]uint64
+	lastVersion      uint64
+	history          map[string][]store.ServiceRevision
 	instances        map[string]map[string]sessionInstance
 	ingressInstances map[string]map[netutil.IPPort]sessionIngressInstance
 	hosts            map[string]*sessionHost
@@ -54,7 +61,24 @@ type InMem struct {
 	heartbeatTimers  map[string]*time.Timer
 	watchersLock     sync.Mutex
 	watchers         []Watcher
-	injectedError    error
+
+	// Set under watchersLock, since watches started from other
+	// goroutines read it
+	injectedError error
+
+	// The index of the last change, and the changes retained for
+	// resuming watches (protected by watchersLock)
+	index        uint64
+	changes      []serviceEvent
+	changesStart uint64
+}
+
+// How many service changes to keep for resuming watches
+const maxChanges = 1000
+
+type serviceEvent struct {
+	store.ServiceChange
+	optsFilter func(store.QueryServiceOptions) bool
 }
 
 func (s *InMem) GetHeartbeat(identity string) (int, error) {
@@ -169,6 +193,10 @@ type serviceWatcher struct {
 	watcher
 	ch   chan<- store.ServiceChange
 	opts store.QueryServiceOptions
+
+	// Held while replaying history to the watcher, so that
+	// subsequent changes are delivered after it
+	lock *sync.Mutex
 }
 
 type hostWatcher struct {
@@ -179,6 +207,10 @@ type hostWatcher struct {
 func (s *InMem) addWatcher(watcher Watcher) {
 	s.watchersLock.Lock()
 	defer s.watchersLock.Unlock()
+	s.addWatcherLocked(watcher)
+}
+
+func (s *InMem) addWatcherLocked(watcher Watcher) {
 	s.watchers = append(s.watchers, watcher)
 
 	// discard the watcher upon cancellation
@@ -198,32 +230,61 @@ func (s *InMem) addWatcher(watcher Watcher) {
 }
 
 func (s *InMem) fireServiceChange(name string, deleted bool, optsFilter func(store.QueryServiceOptions) bool) {
-	ev := store.ServiceChange{Name: name, ServiceDeleted: deleted}
-
 	s.watchersLock.Lock()
+	s.index++
+	ev := serviceEvent{
+		ServiceChange: store.ServiceChange{
+			Name:           name,
+			ServiceDeleted: deleted,
+			Index:          s.index,
+		},
+		optsFilter: optsFilter,
+	}
+
+	s.changes = append(s.changes, ev)
+	if len(s.changes) > maxChanges {
+		s.changes = s.changes[len(s.changes)-maxChanges:]
+	}
+	s.changesStart = s.changes[0].Index
 	watchers := s.watchers
 	s.watchersLock.Unlock()
 
 	for _, w := range watchers {
 		if watcher, isService := w.(serviceWatcher); isService {
-			if optsFilter == nil || optsFilter(watcher.opts) {
-				select {
-				case watcher.ch <- ev:
-				case <-watcher.Done():
-				}
-			}
+			watcher.send(ev)
 		}
 	}
 }
 
+func (w serviceWatcher) send(ev serviceEvent) {
+	if ev.optsFilter != nil && !ev.optsFilter(w.opts) {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	select {
+	case w.ch <- ev.ServiceChange:
+	case <-w.Done():
+	}
+}
+
+// Discard the retained history of service changes, as if it had been
+// compacted away.
+func (s *InMem) CompactHistory() {
+	s.watchersLock.Lock()
+	defer s.watchersLock.Unlock()
+	s.changes = nil
+	s.changesStart = s.index + 1
+}
+
 func (s *InMem) InjectError(err error) {
+	s.watchersLock.Lock()
+	defer s.watchersLock.Unlock()
 	s.injectedError = err
 
 	if err != nil {
 		// Tell any watchers about the error
-		s.watchersLock.Lock()
-		defer s.watchersLock.Unlock()
-
 		for _, watcher := range s.watchers {
 			watcher.PostError(err)
 		}
@@ -241,9 +302,16 @@ func (s *InMem) CheckRegisteredService(name string) error {
 	return s.injectedError
 }
 
+func (s *InMem) nextVersion() uint64 {
+	s.lastVersion++
+	return s.lastVersion
+}
+
 func (s *InMem) AddService(name string, svc store.Service) error {
 	s.services[name] = svc
+	s.serviceVersions[name] = s.nextVersion()
 	s.groupSpecs[name] = make(map[string]store.ContainerRule)
+	s.groupVersions[name] = make(map[string]uint64)
 	s.instances[name] = make(map[string]sessionInstance)
 	s.ingressInstances[name] = make(map[netutil.IPPort]sessionIngressInstance)
 
@@ -252,9 +320,26 @@ func (s *InMem) AddService(name string, svc store.Service) error {
 	return s.injectedError
 }
 
+func (s *InMem) UpdateService(name string, svc store.Service, version uint64) error {
+	if s.serviceVersions[name] != version {
+		return store.ErrVersionConflict
+	}
+
+	if version == 0 {
+		return s.AddService(name, svc)
+	}
+
+	s.services[name] = svc
+	s.serviceVersions[name] = s.nextVersion()
+	s.fireServiceChange(name, false, nil)
+	return s.injectedError
+}
+
 func (s *InMem) RemoveService(name string) error {
 	delete(s.services, name)
+	delete(s.serviceVersions, name)
 	delete(s.groupSpecs, name)
+	delete(s.groupVersions, name)
 	delete(s.instances, name)
 	delete(s.ingressInstances, name)
 
@@ -280,7 +365,7 @@ func (s *InMem) GetService(name string, opts store.QueryServiceOptions) (*store.
 }
 
 func (s *InMem) makeServiceInfo(name string, svc store.Service, opts store.QueryServiceOptions) *store.ServiceInfo {
-	info := &store.ServiceInfo{Service: svc}
+	info := &store.ServiceInfo{Service: svc, Version: s.serviceVersions[name]}
 
 	if opts.WithInstances {
 		info.Instances = make(map[string]store.Instance)
@@ -291,8 +376,10 @@ func (s *InMem) makeServiceInfo(name string, svc store.Service, opts store.Query
 
 	if opts.WithContainerRules {
 		info.ContainerRules = make(map[string]store.ContainerRule)
+		info.ContainerRuleVersions = make(map[string]uint64)
 		for n, g := range s.groupSpecs[name] {
 			info.ContainerRules[n] = g
+			info.ContainerRuleVersions[n] = s.groupVersions[name][n]
 		}
 	}
 
@@ -344,10 +431,23 @@ func (s *InMem) SetContainerRule(serviceName string, groupName string, spec stor
 	}
 
 	groupSpecs[groupName] = spec
+	s.groupVersions[serviceName][groupName] = s.nextVersion()
 	s.fireServiceChange(serviceName, false, withRuleChanges)
 	return s.injectedError
 }
 
+func (s *InMem) UpdateContainerRule(serviceName string, groupName string, spec store.ContainerRule, version uint64) error {
+	if _, found := s.groupSpecs[serviceName]; !found {
+		return fmt.Errorf(`Not found "%s"`, serviceName)
+	}
+
+	if s.groupVersions[serviceName][groupName] != version {
+		return store.ErrVersionConflict
+	}
+
+	return s.SetContainerRule(serviceName, groupName, spec)
+}
+
 func (s *InMem) RemoveContainerRule(serviceName string, groupName string) error {
 	groupSpecs, found := s.groupSpecs[serviceName]
 	if !found {
@@ -355,10 +455,47 @@ func (s *InMem) RemoveContainerRule(serviceName string, groupName string) error
 	}
 
 	delete(groupSpecs, groupName)
+	delete(s.groupVersions[serviceName], groupName)
 	s.fireServiceChange(serviceName, false, withRuleChanges)
 	return s.injectedError
 }
 
+func (s *InMem) RemoveContainerRuleIfVersion(serviceName string, groupName string, version uint64) error {
+	if _, found := s.groupSpecs[serviceName]; !found {
+		return fmt.Errorf(`Not found "%s"`, serviceName)
+	}
+
+	if s.groupVersions[serviceName][groupName] != version {
+		return store.ErrVersionConflict
+	}
+
+	return s.RemoveContainerRule(serviceName, groupName)
+}
+
+func (s *InMem) AddServiceRevision(serviceName string, rev store.ServiceRevision) error {
+	if _, found := s.services[serviceName]; !found {
+		return fmt.Errorf(`Not found "%s"`, serviceName)
+	}
+
+	history := s.history[serviceName]
+	rev.Revision = 1
+	if len(history) > 0 {
+		rev.Revision = history[len(history)-1].Revision + 1
+	}
+
+	history = append(history, rev)
+	if len(history) > store.MaxServiceRevisions {
+		history = history[len(history)-store.MaxServiceRevisions:]
+	}
+	s.history[serviceName] = history
+	return s.injectedError
+}
+
+func (s *InMem) GetServiceHistory(serviceName string) ([]store.ServiceRevision, error) {
+	return append([]store.ServiceRevision(nil), s.history[serviceName]...),
+		s.injectedError
+}
+
 func withRuleChanges(opts store.QueryServiceOptions) bool {
 	return opts.WithContainerRules
 }
@@ -385,13 +522,63 @@ func withIngressInstanceChanges(opts store.QueryServiceOptions) bool {
 }
 
 func (s *InMem) WatchServices(ctx context.Context, res chan<- store.ServiceChange, errs daemon.ErrorSink, opts store.QueryServiceOptions) {
+	s.watchersLock.Lock()
+	err := s.injectedError
+	s.watchersLock.Unlock()
+	if err != nil {
+		errs.Post(err)
+		return
+	}
+
+	w := serviceWatcher{watcher{ctx, errs}, res, opts, &sync.Mutex{}}
+	s.addWatcher(w)
+}
+
+func (s *InMem) CurrentIndex() (uint64, error) {
+	s.watchersLock.Lock()
+	defer s.watchersLock.Unlock()
+	return s.index, s.injectedError
+}
+
+func (s *InMem) WatchServicesFrom(ctx context.Context, index uint64, res chan<- store.ServiceChange, errs daemon.ErrorSink, opts store.QueryServiceOptions) {
+	s.watchersLock.Lock()
+	defer s.watchersLock.Unlock()
+
 	if s.injectedError != nil {
 		errs.Post(s.injectedError)
 		return
 	}
 
-	w := serviceWatcher{watcher{ctx, errs}, res, opts}
-	s.addWatcher(w)
+	if index+1 < s.changesStart {
+		errs.Post(store.ErrHistoryCompacted)
+		return
+	}
+
+	var replay []serviceEvent
+	for _, ev := range s.changes {
+		if ev.Index > index {
+			replay = append(replay, ev)
+		}
+	}
+
+	w := serviceWatcher{watcher{ctx, errs}, res, opts, &sync.Mutex{}}
+	s.addWatcherLocked(w)
+
+	// Replay the history while holding the watcher's lock, so
+	// that new changes wait for it
+	w.lock.Lock()
+	go func() {
+		defer w.lock.Unlock()
+		for _, ev := range replay {
+			if ev.optsFilter == nil || ev.optsFilter(w.opts) {
+				select {
+				case w.ch <- ev.ServiceChange:
+				case <-w.Done():
+					return
+				}
+			}
+		}
+	}()
 }
 
 func (s *InMem) GetHosts() ([]*store.Host, error) {
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"errors"
+
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/flux/common/daemon"
@@ -13,6 +15,14 @@ type QueryServiceOptions struct {
 	WithIngressInstances bool
 }
 
+// Posted by WatchServicesFrom when the store no longer has the
+// history needed to report the changes since the given index.
+var ErrHistoryCompacted = errors.New("store history compacted; cannot resume watch")
+
+// Returned by UpdateService and UpdateContainerRule when the version
+// given is not the current version.
+var ErrVersionConflict = errors.New("version conflict; changed since it was read")
+
 type Store interface {
 	Cluster
 
@@ -34,6 +44,21 @@ type Store interface {
 	SetContainerRule(serviceName string, ruleName string, spec ContainerRule) error
 	RemoveContainerRule(serviceName string, ruleName string) error
 
+	// Conditional versions of AddService, SetContainerRule and
+	// RemoveContainerRule: these only write if the current
+	// version is that given, where version zero means it must not
+	// exist yet, and otherwise fail with ErrVersionConflict.
+	UpdateService(name string, service Service, version uint64) error
+	UpdateContainerRule(serviceName string, ruleName string, spec ContainerRule, version uint64) error
+	RemoveContainerRuleIfVersion(serviceName string, ruleName string, version uint64) error
+
+	// Add a revision to a service's history, numbering it after
+	// the latest one.  Only the most recent MaxServiceRevisions
+	// revisions are kept.
+	AddServiceRevision(serviceName string, rev ServiceRevision) error
+	// Get the revisions in a service's history, oldest first
+	GetServiceHistory(serviceName string) ([]ServiceRevision, error)
+
 	AddInstance(serviceName, instanceName string, details Instance) error
 	RemoveInstance(serviceName, instanceName string) error
 
@@ -41,4 +66,13 @@ type Store interface {
 	RemoveIngressInstance(serviceName string, addr netutil.IPPort) error
 
 	WatchServices(ctx context.Context, resCh chan<- ServiceChange, errorSink daemon.ErrorSink, opts QueryServiceOptions)
+
+	// The current index of the store.  Querying services after
+	// obtaining the index, and then watching from it, means that
+	// no changes are missed.
+	CurrentIndex() (uint64, error)
+
+	// Like WatchServices, but reporting the changes made after
+	// the given index.
+	WatchServicesFrom(ctx context.Context, index uint64, resCh chan<- ServiceChange, errorSink daemon.ErrorSink, opts QueryServiceOptions)
 }
@@ -20,6 +20,14 @@ type TestableStore interface {
 	Reset(t *testing.T)
 }
 
+// A store whose session can be made to expire, as it would if the
+// store lost touch with the server for longer than the TTL
+type ExpirableStore interface {
+	TestableStore
+
+	ExpireSession(t *testing.T)
+}
+
 func RunStoreTestSuite(ts TestableStore, t *testing.T) {
 	ts.Reset(t)
 	testPing(ts, t)
@@ -28,15 +36,26 @@ func RunStoreTestSuite(ts TestableStore, t *testing.T) {
 	ts.Reset(t)
 	testRules(ts, t)
 	ts.Reset(t)
+	testVersions(ts, t)
+	ts.Reset(t)
+	testServiceHistory(ts, t)
+	ts.Reset(t)
 	testInstances(ts, t)
 	ts.Reset(t)
 	testIngressInstances(ts, t)
 	ts.Reset(t)
 	testWatchServices(ts, t)
 	ts.Reset(t)
+	testWatchServicesFrom(ts, t)
+	ts.Reset(t)
 	testHosts(ts, t)
 	ts.Reset(t)
 	testHostWatch(ts, t)
+
+	if es, ok := ts.(ExpirableStore); ok {
+		es.Reset(t)
+		testSessionExpiry(es, t)
+	}
 }
 
 func testPing(s store.Store, t *testing.T) {
@@ -99,6 +118,121 @@ func testRules(s store.Store, t *testing.T) {
 	require.Empty(t, svc.ContainerRules)
 }
 
+func testVersions(s store.Store, t *testing.T) {
+	opts := store.QueryServiceOptions{WithContainerRules: true}
+	getService := func() *store.ServiceInfo {
+		svc, err := s.GetService("svc", opts)
+		require.Nil(t, err)
+		return svc
+	}
+
+	// Version zero means the service must not exist yet
+	require.Nil(t, s.UpdateService("svc", testService, 0))
+	v1 := getService().Version
+	require.NotZero(t, v1)
+	require.Equal(t, store.ErrVersionConflict,
+		s.UpdateService("svc", testService, 0))
+
+	// Updating with the current version succeeds and moves the
+	// version on; updating with a stale version fails
+	svc2 := testService
+	svc2.InstancePort = 8080
+	require.Nil(t, s.UpdateService("svc", svc2, v1))
+	svc := getService()
+	require.Equal(t, svc2, svc.Service)
+	require.NotEqual(t, v1, svc.Version)
+	require.Equal(t, store.ErrVersionConflict,
+		s.UpdateService("svc", testService, v1))
+	require.Equal(t, svc2, getService().Service)
+
+	// Blind writes move the version on too
+	v2 := getService().Version
+	require.Nil(t, s.AddService("svc", testService))
+	require.NotEqual(t, v2, getService().Version)
+
+	// Likewise for rules
+	require.Nil(t, s.UpdateContainerRule("svc", "group", testRule, 0))
+	r1 := getService().ContainerRuleVersions["group"]
+	require.NotZero(t, r1)
+	require.Equal(t, store.ErrVersionConflict,
+		s.UpdateContainerRule("svc", "group", testRule, 0))
+
+	rule2 := testRule
+	rule2.InstancePort = 8080
+	require.Nil(t, s.UpdateContainerRule("svc", "group", rule2, r1))
+	svc = getService()
+	require.Equal(t, rule2, svc.ContainerRules["group"])
+	require.NotEqual(t, r1, svc.ContainerRuleVersions["group"])
+	require.Equal(t, store.ErrVersionConflict,
+		s.UpdateContainerRule("svc", "group", testRule, r1))
+
+	// And removals
+	r2 := getService().ContainerRuleVersions["group"]
+	require.Equal(t, store.ErrVersionConflict,
+		s.RemoveContainerRuleIfVersion("svc", "group", r1))
+	require.Equal(t, store.ErrVersionConflict,
+		s.RemoveContainerRuleIfVersion("svc", "group", 0))
+	require.Nil(t, s.RemoveContainerRuleIfVersion("svc", "group", r2))
+	require.Empty(t, getService().ContainerRules)
+	require.Nil(t, s.RemoveContainerRuleIfVersion("svc", "group", 0))
+	require.Nil(t, s.UpdateContainerRule("svc", "group", rule2, 0))
+
+	// Updating the service leaves its rules alone
+	require.Nil(t, s.UpdateService("svc", svc2, svc.Version))
+	require.Equal(t, map[string]store.ContainerRule{"group": rule2},
+		getService().ContainerRules)
+}
+
+func testServiceHistory(s store.Store, t *testing.T) {
+	require.Nil(t, s.AddService("svc", testService))
+	history, err := s.GetServiceHistory("svc")
+	require.Nil(t, err)
+	require.Empty(t, history)
+
+	// The configuration before the first change is recorded, but
+	// only while there is no history
+	info, err := s.GetService("svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.Nil(t, err)
+	require.Nil(t, store.RecordInitialRevision(s, "svc", info))
+	rules := map[string]store.ContainerRule{"group": testRule}
+	require.Nil(t, s.SetContainerRule("svc", "group", testRule))
+	require.Nil(t, store.RecordServiceRevision(s, "svc", "bob", "select", testService, rules))
+	require.Nil(t, store.RecordInitialRevision(s, "svc", info))
+
+	history, err = s.GetServiceHistory("svc")
+	require.Nil(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, 1, history[0].Revision)
+	require.Equal(t, "", history[0].Author)
+	require.Equal(t, "initial", history[0].Description)
+	require.Equal(t, testService, history[0].Service)
+	require.Empty(t, history[0].ContainerRules)
+	require.Equal(t, 2, history[1].Revision)
+	require.Equal(t, "bob", history[1].Author)
+	require.Equal(t, rules, history[1].ContainerRules)
+	require.False(t, history[1].Time.IsZero())
+
+	// Only the most recent revisions are kept
+	for i := 0; i < store.MaxServiceRevisions; i++ {
+		require.Nil(t, store.RecordServiceRevision(s, "svc", "carol", "again", testService, rules))
+	}
+	history, err = s.GetServiceHistory("svc")
+	require.Nil(t, err)
+	require.Len(t, history, store.MaxServiceRevisions)
+	require.Equal(t, 3, history[0].Revision)
+	require.Equal(t, store.MaxServiceRevisions+2,
+		history[len(history)-1].Revision)
+
+	// The history is not part of the service, and outlives it
+	svc, err := s.GetService("svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.Nil(t, err)
+	require.Len(t, svc.ContainerRules, 1)
+	require.Nil(t, s.RemoveService("svc"))
+	history, err = s.GetServiceHistory("svc")
+	require.Nil(t, err)
+	require.Len(t, history, store.MaxServiceRevisions)
+}
+
 var testInst = store.Instance{
 	ContainerRule: "group",
 	Address:       netutil.ParseIPPortPtr("1.2.3.4:12345"),
@@ -144,6 +278,38 @@ func testInstances(s store.Store, t *testing.T) {
 	require.Equal(t, map[string]store.Instance{}, instances())
 }
 
+// Values from a session that expires come back with the next
+// heartbeat, except for those removed in the meantime
+func testSessionExpiry(es ExpirableStore, t *testing.T) {
+	require.Nil(t, es.Heartbeat(10*time.Second))
+	require.Nil(t, es.AddService("svc", testService))
+	require.Nil(t, es.AddInstance("svc", "inst", testInst))
+	require.Nil(t, es.AddInstance("svc", "gone", testInst))
+	require.Nil(t, es.RegisterHost("host", &store.Host{IP: net.ParseIP("192.168.3.4")}))
+	require.Nil(t, es.RemoveInstance("svc", "gone"))
+
+	instances := func() map[string]store.Instance {
+		svc, err := es.GetService("svc", store.QueryServiceOptions{WithInstances: true})
+		require.Nil(t, err)
+		return svc.Instances
+	}
+	hosts := func() []*store.Host {
+		hosts, err := es.GetHosts()
+		require.Nil(t, err)
+		return hosts
+	}
+
+	es.ExpireSession(t)
+	require.Empty(t, instances())
+	require.Empty(t, hosts())
+
+	require.Nil(t, es.Heartbeat(10*time.Second))
+	require.Equal(t, map[string]store.Instance{"inst": testInst}, instances())
+	require.Len(t, hosts(), 1)
+
+	require.Nil(t, es.EndSession())
+}
+
 var testIngressInstanceAddr = *netutil.ParseIPPortPtr("1.2.3.4:1234")
 var testIngressInstance = store.IngressInstance{Weight: 42}
 
@@ -221,21 +387,40 @@ func (w *watch) stop() {
 
 type serviceWatch struct {
 	watch
+	errs    daemon.ErrorSink
 	changes []store.ServiceChange
+
+	// The indices of the changes are recorded separately, as
+	// they depend on the store
+	indices []uint64
 }
 
 func newServiceWatch(s store.Store, opts store.QueryServiceOptions) *serviceWatch {
+	return startServiceWatch(func(ctx context.Context, changes chan<- store.ServiceChange, errs daemon.ErrorSink) {
+		s.WatchServices(ctx, changes, errs, opts)
+	})
+}
+
+func newServiceWatchFrom(s store.Store, index uint64, opts store.QueryServiceOptions) *serviceWatch {
+	return startServiceWatch(func(ctx context.Context, changes chan<- store.ServiceChange, errs daemon.ErrorSink) {
+		s.WatchServicesFrom(ctx, index, changes, errs, opts)
+	})
+}
+
+func startServiceWatch(start func(context.Context, chan<- store.ServiceChange, daemon.ErrorSink)) *serviceWatch {
 	ctx, cancel := context.WithCancel(context.Background())
-	w := &serviceWatch{watch: newWatch(cancel)}
+	w := &serviceWatch{watch: newWatch(cancel), errs: daemon.NewErrorSink()}
 
 	changes := make(chan store.ServiceChange)
-	s.WatchServices(ctx, changes, daemon.NewErrorSink(), opts)
+	start(ctx, changes, w.errs)
 
 	go func() {
 		defer close(w.done)
 		for {
 			select {
 			case change := <-changes:
+				w.indices = append(w.indices, change.Index)
+				change.Index = 0
 				w.changes = append(w.changes, change)
 			case <-w.stopCh:
 				w.cancel()
@@ -257,6 +442,8 @@ func testWatchServices(s store.Store, t *testing.T) {
 		time.Sleep(100 * time.Millisecond)
 		w.stop()
 		require.Equal(t, changes, w.changes)
+		requireIndicesOrdered(t, w.indices)
+		require.Empty(t, w.errs)
 		require.Nil(t, s.RemoveAllServices())
 	}
 
@@ -328,6 +515,49 @@ func testWatchServices(s store.Store, t *testing.T) {
 
 }
 
+func requireIndicesOrdered(t *testing.T, indices []uint64) {
+	for i, index := range indices {
+		require.NotZero(t, index)
+		if i > 0 {
+			require.True(t, index >= indices[i-1])
+		}
+	}
+}
+
+func testWatchServicesFrom(s store.Store, t *testing.T) {
+	require.Nil(t, s.AddService("svc1", testService))
+	index, err := s.CurrentIndex()
+	require.Nil(t, err)
+
+	// Changes made after the index are reported, even though
+	// they happened before the watch started
+	require.Nil(t, s.AddService("svc2", testService))
+	require.Nil(t, s.RemoveService("svc1"))
+
+	w := newServiceWatchFrom(s, index, store.QueryServiceOptions{})
+	require.Nil(t, s.AddService("svc3", testService))
+	time.Sleep(100 * time.Millisecond)
+	w.stop()
+
+	require.Equal(t, []store.ServiceChange{
+		{Name: "svc2", ServiceDeleted: false},
+		{Name: "svc1", ServiceDeleted: true},
+		{Name: "svc3", ServiceDeleted: false},
+	}, w.changes)
+	requireIndicesOrdered(t, w.indices)
+	require.True(t, w.indices[0] > index)
+	require.Empty(t, w.errs)
+
+	// Resuming from the index of the last change reported gives
+	// only what happened since
+	last := w.indices[len(w.indices)-1]
+	w = newServiceWatchFrom(s, last, store.QueryServiceOptions{})
+	time.Sleep(100 * time.Millisecond)
+	w.stop()
+	require.Empty(t, w.changes)
+	require.Empty(t, w.errs)
+}
+
 func testHosts(ts TestableStore, t *testing.T) {
 	hostID := "foo host"
 	hostData := &store.Host{IP: net.ParseIP("192.168.1.65")}
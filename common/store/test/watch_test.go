@@ -1,15 +1,65 @@
 package test
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 
 	"github.com/weaveworks/flux/common/daemon"
 	"github.com/weaveworks/flux/common/store"
 	"github.com/weaveworks/flux/common/store/inmem"
 )
 
+// A store that reports the indices that watches start from, and the
+// indices that it gives out, so that tests can tell what the watcher
+// is up to
+type watchedStore struct {
+	store.Store
+	watches        chan uint64
+	currentIndices chan uint64
+}
+
+func newWatchedStore(st store.Store) watchedStore {
+	return watchedStore{
+		Store:          st,
+		watches:        make(chan uint64, 100),
+		currentIndices: make(chan uint64, 100),
+	}
+}
+
+func (st watchedStore) WatchServicesFrom(ctx context.Context, index uint64, res chan<- store.ServiceChange, errs daemon.ErrorSink, opts store.QueryServiceOptions) {
+	st.Store.WatchServicesFrom(ctx, index, res, errs, opts)
+	select {
+	case st.watches <- index:
+	default:
+	}
+}
+
+func (st watchedStore) CurrentIndex() (uint64, error) {
+	index, err := st.Store.CurrentIndex()
+	if err == nil {
+		select {
+		case st.currentIndices <- index:
+		default:
+		}
+	}
+	return index, err
+}
+
+// Make the watch fail, and wait until it has tried to resume, returning
+// the index it tried to resume from
+func (st watchedStore) failWatch(back *inmem.InMem) uint64 {
+	back.InjectError(errors.New("etcd restarting"))
+	for len(st.watches) > 0 {
+		<-st.watches
+	}
+	return <-st.watches
+}
+
 func TestWatchServices(t *testing.T) {
 	st := inmem.NewInMem().Store("test session")
 	st.AddService("foo-svc", store.Service{
@@ -18,7 +68,8 @@ func TestWatchServices(t *testing.T) {
 
 	updates := make(chan store.ServiceUpdate)
 	es := daemon.NewErrorSink()
-	c := store.WatchServicesStartFunc(st, store.QueryServiceOptions{}, updates)(es)
+	c := store.WatchServicesStartFunc(st, time.Millisecond,
+		store.QueryServiceOptions{}, updates)(es)
 
 	update := <-updates
 	require.True(t, update.Reset)
@@ -40,3 +91,85 @@ func TestWatchServices(t *testing.T) {
 
 	require.Empty(t, es)
 }
+
+func TestWatchServicesResume(t *testing.T) {
+	back := inmem.NewInMem()
+	st := newWatchedStore(back.Store("test session"))
+	st.AddService("foo-svc", store.Service{})
+
+	updates := make(chan store.ServiceUpdate)
+	es := daemon.NewErrorSink()
+	c := store.WatchServicesStartFunc(st, time.Millisecond,
+		store.QueryServiceOptions{}, updates)(es)
+
+	update := <-updates
+	require.True(t, update.Reset)
+	require.Len(t, update.Services, 1)
+
+	// Make the watch fail, and change things while it is down
+	require.NotZero(t, st.failWatch(back))
+	back.InjectError(nil)
+	st.AddService("bar-svc", store.Service{})
+
+	// The watch resumes where it left off, rather than resetting
+	update = <-updates
+	require.False(t, update.Reset)
+	require.Len(t, update.Services, 1)
+	require.NotNil(t, update.Services["bar-svc"])
+
+	// If the history needed to resume is gone, it resets
+	st.failWatch(back)
+	st.RemoveService("foo-svc")
+	back.CompactHistory()
+	back.InjectError(nil)
+
+	update = <-updates
+	require.True(t, update.Reset)
+	require.Len(t, update.Services, 1)
+	require.NotNil(t, update.Services["bar-svc"])
+
+	c.Stop()
+	require.Empty(t, es)
+}
+
+func TestWatchServicesResumeAfterUnwatchedChanges(t *testing.T) {
+	back := inmem.NewInMem()
+	st := newWatchedStore(back.Store("test session"))
+	st.AddService("foo-svc", store.Service{})
+
+	updates := make(chan store.ServiceUpdate)
+	es := daemon.NewErrorSink()
+	c := store.WatchServicesStartFunc(st, time.Millisecond,
+		store.QueryServiceOptions{}, updates)(es)
+
+	update := <-updates
+	require.True(t, update.Reset)
+
+	// Make enough changes that the watch doesn't see to push the
+	// index it started from out of the history
+	for i := 0; i < 2000; i++ {
+		st.AddInstance("foo-svc", fmt.Sprint("inst", i), store.Instance{})
+	}
+
+	// Once the watcher has noted the current index twice, it has
+	// caught up with the first
+	index, err := back.CurrentIndex()
+	require.Nil(t, err)
+	for n := 0; n < 2; {
+		if <-st.currentIndices >= index {
+			n++
+		}
+	}
+
+	require.True(t, st.failWatch(back) >= index)
+	back.InjectError(nil)
+	st.AddService("bar-svc", store.Service{})
+
+	update = <-updates
+	require.False(t, update.Reset)
+	require.Len(t, update.Services, 1)
+	require.NotNil(t, update.Services["bar-svc"])
+
+	c.Stop()
+	require.Empty(t, es)
+}
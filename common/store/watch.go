@@ -1,6 +1,9 @@
 package store
 
 import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/flux/common/daemon"
@@ -12,36 +15,51 @@ type ServiceUpdate struct {
 }
 
 type watchServices struct {
-	store     Store
-	opts      QueryServiceOptions
-	callback  func(update ServiceUpdate, stop <-chan struct{})
-	errorSink daemon.ErrorSink
-	context   context.Context
-	cancel    context.CancelFunc
-	finished  chan struct{}
+	store    Store
+	interval time.Duration
+	opts     QueryServiceOptions
+	callback func(update ServiceUpdate, stop <-chan struct{})
+	context  context.Context
+	cancel   context.CancelFunc
+	finished chan struct{}
+
+	// The index up to which changes have been seen, or zero if
+	// the next watch should start with a reset.  This is shared
+	// by successive attempts at the watch.
+	index *uint64
 }
 
-func WatchServicesIndirectStartFunc(store Store, opts QueryServiceOptions, cb func(update ServiceUpdate, stop <-chan struct{})) daemon.StartFunc {
+// Watch services, passing updates to the callback.  The first update
+// is a reset, giving the state of all services; subsequent updates
+// are incremental.  If the watch fails, it is restarted after
+// retryInterval, resuming from the last index seen where the store
+// still has the history to do so, and otherwise starting over with a
+// reset.
+func WatchServicesIndirectStartFunc(store Store, retryInterval time.Duration, opts QueryServiceOptions, cb func(update ServiceUpdate, stop <-chan struct{})) daemon.StartFunc {
 	return func(es daemon.ErrorSink) daemon.Component {
-		ctx, cancel := context.WithCancel(context.Background())
-		ws := &watchServices{
-			store:     store,
-			opts:      opts,
-			callback:  cb,
-			errorSink: es,
-			context:   ctx,
-			cancel:    cancel,
-			finished:  make(chan struct{}),
-		}
-		go func() {
-			es.Post(ws.run())
-		}()
-		return ws
+		var index uint64
+		return daemon.Restart(retryInterval, func(errs daemon.ErrorSink) daemon.Component {
+			ctx, cancel := context.WithCancel(context.Background())
+			ws := &watchServices{
+				store:    store,
+				interval: retryInterval,
+				opts:     opts,
+				callback: cb,
+				context:  ctx,
+				cancel:   cancel,
+				finished: make(chan struct{}),
+				index:    &index,
+			}
+			go func() {
+				errs.Post(ws.run())
+			}()
+			return ws
+		})(es)
 	}
 }
 
-func WatchServicesStartFunc(store Store, opts QueryServiceOptions, updates chan<- ServiceUpdate) daemon.StartFunc {
-	return WatchServicesIndirectStartFunc(store, opts, func(su ServiceUpdate, stop <-chan struct{}) {
+func WatchServicesStartFunc(store Store, retryInterval time.Duration, opts QueryServiceOptions, updates chan<- ServiceUpdate) daemon.StartFunc {
+	return WatchServicesIndirectStartFunc(store, retryInterval, opts, func(su ServiceUpdate, stop <-chan struct{}) {
 		select {
 		case updates <- su:
 		case <-stop:
@@ -51,24 +69,75 @@ func WatchServicesStartFunc(store Store, opts QueryServiceOptions, updates chan<
 
 func (ws *watchServices) run() error {
 	defer close(ws.finished)
+
+	for {
+		err := ws.watch()
+		if err != ErrHistoryCompacted {
+			return err
+		}
+
+		log.Infof("Cannot resume watching services from index %d; resetting", *ws.index)
+		*ws.index = 0
+	}
+}
+
+func (ws *watchServices) watch() error {
+	ctx, cancel := context.WithCancel(ws.context)
+	defer cancel()
+
 	changes := make(chan ServiceChange)
-	ws.store.WatchServices(ws.context, changes, ws.errorSink, ws.opts)
+	errs := daemon.NewErrorSink()
 
-	err := ws.doInitialQuery()
-	if err != nil {
-		return err
+	if *ws.index != 0 {
+		ws.store.WatchServicesFrom(ctx, *ws.index, changes, errs, ws.opts)
+	} else {
+		index, err := ws.store.CurrentIndex()
+		if err != nil {
+			return err
+		}
+
+		ws.store.WatchServicesFrom(ctx, index, changes, errs, ws.opts)
+		if err := ws.doInitialQuery(); err != nil {
+			return err
+		}
+
+		*ws.index = index
 	}
 
+	// Changes that are not of interest do not reach us, but they
+	// still use up the store's history.  So when things are
+	// quiet, note the store's index, and if nothing has arrived a
+	// while later, nothing before that index can still be on its
+	// way, and the watch can resume from there.
+	tick := time.NewTicker(ws.interval)
+	defer tick.Stop()
+	var quietIndex uint64
+
 	for {
 		var change ServiceChange
 		select {
 		case change = <-changes:
+		case err := <-errs:
+			return err
 		case <-ws.context.Done():
 			return nil
+		case <-tick.C:
+			if quietIndex > *ws.index {
+				*ws.index = quietIndex
+			}
+
+			var err error
+			if quietIndex, err = ws.store.CurrentIndex(); err != nil {
+				return err
+			}
+			continue
 		}
 
+		quietIndex = 0
+
 		var svc *ServiceInfo
 		if !change.ServiceDeleted {
+			var err error
 			if svc, err = ws.store.GetService(change.Name, ws.opts); err != nil {
 				return err
 			}
@@ -77,6 +146,10 @@ func (ws *watchServices) run() error {
 		ws.callback(ServiceUpdate{
 			Services: map[string]*ServiceInfo{change.Name: svc},
 		}, ws.context.Done())
+
+		if change.Index > *ws.index {
+			*ws.index = change.Index
+		}
 	}
 }
 
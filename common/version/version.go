@@ -12,6 +12,14 @@ var (
 	version  = "head"
 )
 
+func Version() string {
+	return version
+}
+
+func Revision() string {
+	return revision
+}
+
 func Banner() string {
 	name := path.Base(os.Args[0])
 	if !strings.HasPrefix(name, "flux") {
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+type applyOpts struct {
+	baseOpts
+
+	file  string
+	prune bool
+}
+
+func (opts *applyOpts) makeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apply -f <file>",
+		Short: "make services match a manifest",
+		Long:  "Define the services and rules described in <file> (YAML or JSON, as produced by 'fluxctl export'), updating any that differ. Services and rules not in the file are left alone, unless --prune is given.",
+		RunE:  opts.run,
+	}
+	cmd.Flags().StringVarP(&opts.file, "file", "f", "", `manifest file to apply, or "-" for stdin`)
+	cmd.Flags().BoolVar(&opts.prune, "prune", false, "remove services and rules not in the manifest")
+	return cmd
+}
+
+func (opts *applyOpts) run(_ *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Expected no arguments")
+	}
+	if opts.file == "" {
+		return fmt.Errorf("Please supply a manifest file with -f")
+	}
+
+	desired, err := readManifest(opts.file)
+	if err != nil {
+		return err
+	}
+
+	current, err := opts.store.GetAllServices(store.QueryServiceOptions{WithContainerRules: true})
+	if err != nil {
+		return fmt.Errorf("Error fetching services: %s", err)
+	}
+
+	format, err := opts.outputFormat()
+	if err != nil {
+		return err
+	}
+
+	changes := planChanges(current, desired, opts.prune)
+	changed := make(map[string]bool)
+	for _, change := range changes {
+		if !changed[change.service] {
+			opts.recordInitialRevision(change.service, current[change.service])
+		}
+		err := change.apply(opts.store)
+		if err == store.ErrVersionConflict {
+			return fmt.Errorf("Service %s was changed by someone else while applying; check 'fluxctl info', then retry", change.service)
+		}
+		if err != nil {
+			return fmt.Errorf("Error updating service %s: %s", change.service, err)
+		}
+
+		if format == OUTPUT_TABLE {
+			fmt.Fprintln(opts.getStdout(), change)
+		}
+		changed[change.service] = true
+	}
+
+	// What is recorded is the manifest's version of each service,
+	// with any rules it leaves alone
+	for _, name := range sortedKeys(desired.Services) {
+		if changed[name] {
+			want := desired.Services[name]
+			rules := copyRules(want.Rules)
+			if have := current[name]; have != nil && !opts.prune {
+				for ruleName, rule := range have.ContainerRules {
+					if _, found := rules[ruleName]; !found {
+						rules[ruleName] = rule
+					}
+				}
+			}
+			opts.recordRevision(name, "apply", want.Service, rules)
+		}
+	}
+
+	_, err = opts.printStructured(makeChangesOutput(changes))
+	return err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+func writeManifest(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "fluxctl-manifest")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+const testManifest = `
+services:
+  foo:
+    address: 10.3.4.5:80
+    protocol: http
+    rules:
+      default:
+        selector:
+          image: foo/bar
+      canary:
+        selector:
+          image: foo/bar
+          tag: canary
+        instancePort: 8080
+  bar:
+    instancePort: 9000
+`
+
+func TestApply(t *testing.T) {
+	file := writeManifest(t, testManifest)
+	defer os.Remove(file)
+
+	st, err := runOpts(&addOpts{}, []string{"baz", "--image", "baz/baz"})
+	require.NoError(t, err)
+	require.NoError(t, runOptsWithStore(&addOpts{}, st, []string{
+		"foo", "--image", "foo/old"}))
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo", "extra", "--image", "foo/extra"}))
+
+	opts := &applyOpts{}
+	bout, _ := opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{"-f", file}))
+	require.Equal(t, []string{
+		"+ service bar",
+		"~ service foo",
+		"+ rule foo/canary",
+		"~ rule foo/default",
+	}, strings.Split(strings.TrimSpace(bout.String()), "\n"))
+
+	foo, err := st.GetService("foo", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, netutil.ParseIPPortPtr("10.3.4.5:80"), foo.Address)
+	require.Equal(t, "http", foo.Protocol)
+	require.Len(t, foo.ContainerRules, 3)
+	require.Equal(t, store.ContainerRule{
+		Selector:     map[string]string{"image": "foo/bar", "tag": "canary"},
+		InstancePort: 8080,
+	}, foo.ContainerRules["canary"])
+
+	// Applying again changes nothing
+	opts = &applyOpts{}
+	bout, _ = opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{"-f", file}))
+	require.Empty(t, bout.String())
+
+	// Pruning removes what's not in the manifest
+	opts = &applyOpts{}
+	bout, _ = opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{"-f", file, "--prune"}))
+	require.Equal(t, []string{
+		"- rule foo/extra",
+		"- service baz",
+	}, strings.Split(strings.TrimSpace(bout.String()), "\n"))
+	services := allServices(t, st)
+	require.Len(t, services, 2)
+
+	history, err := st.GetServiceHistory("foo")
+	require.NoError(t, err)
+	require.Equal(t, "apply", history[len(history)-1].Description)
+}
+
+func TestApplyBadManifest(t *testing.T) {
+	_, err := runOpts(&applyOpts{}, []string{})
+	require.Error(t, err)
+
+	file := writeManifest(t, `
+services:
+  foo:
+    rules:
+      default:
+        selector: {}
+`)
+	defer os.Remove(file)
+	_, err = runOpts(&applyOpts{}, []string{"-f", file})
+	require.Error(t, err)
+
+	file = writeManifest(t, `
+services:
+  foo:
+    healthCheck:
+      type: tcp
+      path: /health
+`)
+	defer os.Remove(file)
+	_, err = runOpts(&applyOpts{}, []string{"-f", file})
+	require.Error(t, err)
+}
+
+func TestExportApply(t *testing.T) {
+	file := writeManifest(t, testManifest)
+	defer os.Remove(file)
+
+	st, err := runOpts(&applyOpts{}, []string{"-f", file})
+	require.NoError(t, err)
+
+	opts := &exportOpts{}
+	bout, _ := opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{}))
+
+	// What's exported should recreate the same services
+	exported := writeManifest(t, bout.String())
+	defer os.Remove(exported)
+	st2, err := runOpts(&applyOpts{}, []string{"-f", exported})
+	require.NoError(t, err)
+
+	query := store.QueryServiceOptions{WithContainerRules: true}
+	services, err := st.GetAllServices(query)
+	require.NoError(t, err)
+	services2, err := st2.GetAllServices(query)
+	require.NoError(t, err)
+	require.Equal(t, manifestFromServices(services), manifestFromServices(services2))
+}
+
+func TestDiff(t *testing.T) {
+	file := writeManifest(t, testManifest)
+	defer os.Remove(file)
+
+	st, err := runOpts(&addOpts{}, []string{"baz", "--image", "baz/baz"})
+	require.NoError(t, err)
+	require.NoError(t, runOptsWithStore(&addOpts{}, st, []string{
+		"foo", "--address", "10.3.4.5:80", "--protocol", "http",
+		"--image", "foo/bar", "--tag", "old"}))
+
+	opts := &diffOpts{}
+	bout, _ := opts.tapOutput()
+	err = runOptsWithStore(opts, st, []string{"-f", file})
+	require.Error(t, err)
+	require.Equal(t, 1, exitStatus(opts.makeCommand(), err))
+	require.Equal(t, `+ service bar
+    + instancePort: 9000
+~ service foo
+    - instancePort: 80
++ rule foo/canary
+    + instancePort: 8080
+    + selector.image: foo/bar
+    + selector.tag: canary
+~ rule foo/default
+    - selector.tag: old
+- service baz
+`, bout.String())
+
+	// No differences once applied
+	require.NoError(t, runOptsWithStore(&applyOpts{}, st, []string{"-f", file, "--prune"}))
+	opts = &diffOpts{}
+	bout, _ = opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{"-f", file}))
+	require.Empty(t, bout.String())
+
+	// Errors are distinguished from differences
+	opts = &diffOpts{}
+	err = runOptsWithStore(opts, st, []string{"-f", file + ".missing"})
+	require.Error(t, err)
+	require.Equal(t, 2, exitStatus(opts.makeCommand(), err))
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
 )
 
 type deselectOpts struct {
@@ -33,14 +35,22 @@ func (opts *deselectOpts) run(_ *cobra.Command, args []string) error {
 	serviceName = args[0]
 
 	// Check that the service exists
-	if err := opts.store.CheckRegisteredService(serviceName); err != nil {
+	svc, err := opts.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true})
+	if err != nil {
 		return fmt.Errorf("Error fetching service: %s", err)
 	}
 
+	opts.recordInitialRevision(serviceName, svc)
 	if err := opts.store.RemoveContainerRule(serviceName, ruleName); err != nil {
 		return fmt.Errorf("Unable to update service %s: %s", serviceName, err)
 	}
 
+	rules := copyRules(svc.ContainerRules)
+	delete(rules, ruleName)
+	opts.recordRevision(serviceName, "deselect "+ruleName, svc.Service, rules)
+	if done, err := opts.printResult(serviceName); done || err != nil {
+		return err
+	}
 	fmt.Fprintf(opts.getStdout(), ruleName)
 	return nil
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+type diffOpts struct {
+	baseOpts
+
+	file string
+}
+
+func (opts *diffOpts) makeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff -f <file>",
+		Short: "show how services differ from a manifest",
+		Long:  "Compare the services and rules described in <file> with those defined, and print the differences: what has been added to, removed from and modified in the manifest. Like diff(1), exits with status 1 if there are differences, and 2 if there is an error.",
+		RunE:  opts.run,
+	}
+	cmd.Flags().StringVarP(&opts.file, "file", "f", "", `manifest file to compare, or "-" for stdin`)
+	return cmd
+}
+
+func (opts *diffOpts) run(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Expected no arguments")
+	}
+	if opts.file == "" {
+		return fmt.Errorf("Please supply a manifest file with -f")
+	}
+
+	desired, err := readManifest(opts.file)
+	if err != nil {
+		return err
+	}
+
+	current, err := opts.store.GetAllServices(store.QueryServiceOptions{WithContainerRules: true})
+	if err != nil {
+		return fmt.Errorf("Error fetching services: %s", err)
+	}
+
+	// Everything that differs, including what apply would only
+	// remove with --prune
+	changes := planChanges(current, desired, true)
+	if done, err := opts.printStructured(makeChangesOutput(changes)); err != nil {
+		return err
+	} else if !done {
+		for _, change := range changes {
+			printChange(opts.getStdout(), change)
+		}
+	}
+
+	if len(changes) > 0 {
+		// Differences are the expected outcome, not a misuse
+		cmd.SilenceUsage = true
+		return differencesError{len(changes), opts.file}
+	}
+	return nil
+}
+
+// Returned by diff when it has done its job and found differences,
+// as distinct from when it has failed
+type differencesError struct {
+	count int
+	file  string
+}
+
+func (err differencesError) Error() string {
+	return fmt.Sprintf("%d difference(s) between %s and the services defined", err.count, err.file)
+}
+
+// Print a change and, field by field, what it changes
+func printChange(out io.Writer, change manifestChange) {
+	fmt.Fprintln(out, change)
+
+	from, to := changeFields(change.from), changeFields(change.to)
+	var names []string
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, found := from[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		before, hadBefore := from[name]
+		after, hasAfter := to[name]
+		switch {
+		case !hadBefore:
+			fmt.Fprintf(out, "    + %s: %s\n", name, after)
+		case !hasAfter:
+			fmt.Fprintf(out, "    - %s: %s\n", name, before)
+		case before != after:
+			fmt.Fprintf(out, "    ~ %s: %s -> %s\n", name, before, after)
+		}
+	}
+}
+
+// The fields of a service definition or rule, flattened into names
+// and values for comparison
+func changeFields(v interface{}) map[string]string {
+	fields := make(map[string]string)
+	setInt := func(name string, i int) {
+		if i != 0 {
+			fields[name] = fmt.Sprint(i)
+		}
+	}
+
+	switch v := v.(type) {
+	case store.Service:
+		if v.Address != nil {
+			fields["address"] = v.Address.String()
+		}
+		setInt("instancePort", v.InstancePort)
+		if v.Protocol != "" {
+			fields["protocol"] = v.Protocol
+		}
+		if v.Strategy != "" {
+			fields["strategy"] = v.Strategy
+		}
+		if v.HealthCheck != nil {
+			fields["healthCheck"] = describeHealthCheck(v.HealthCheck)
+		}
+		if v.OutlierDetection != nil {
+			fields["outlierDetection"] = describeOutlierDetection(v.OutlierDetection)
+		}
+		if v.Retries != nil {
+			fields["retries"] = describeRetries(v.Retries)
+		}
+		if v.Timeouts != nil {
+			fields["timeouts"] = describeTimeouts(v.Timeouts)
+		}
+	case store.ContainerRule:
+		for k, val := range v.Selector {
+			fields["selector."+k] = val
+		}
+		setInt("instancePort", v.InstancePort)
+		setInt("weight", v.Weight)
+		setInt("traffic", v.Traffic)
+	}
+	return fields
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+type exportOpts struct {
+	baseOpts
+}
+
+func (opts *exportOpts) makeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "print a manifest of all services",
+		Long:  "Print the definitions and rules of all services as a YAML manifest, suitable for 'fluxctl apply -f'.",
+		RunE:  opts.run,
+	}
+	return cmd
+}
+
+func (opts *exportOpts) run(_ *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Expected no arguments")
+	}
+
+	services, err := opts.store.GetAllServices(store.QueryServiceOptions{WithContainerRules: true})
+	if err != nil {
+		return fmt.Errorf("Error fetching services: %s", err)
+	}
+
+	m := manifestFromServices(services)
+	if format, err := opts.outputFormat(); err != nil {
+		return err
+	} else if format == OUTPUT_JSON {
+		_, err = opts.printStructured(m)
+		return err
+	}
+
+	// The manifest is YAML otherwise
+	out, err := m.marshalYAML()
+	if err != nil {
+		return err
+	}
+
+	opts.getStdout().Write(out)
+	return nil
+}
@@ -37,7 +37,10 @@ func runOpts(opts commandOpts, args []string) (store.Store, error) {
 
 func runOptsWithStore(opts commandOpts, store store.Store, args []string) error {
 	opts.setStore(store)
+	var output string
+	opts.setOutput(&output)
 	cmd := opts.makeCommand()
+	addOutputFlag(cmd.PersistentFlags(), &output)
 	_ = cmd.Flags().Bool("test-dummy", false, "should not be seen")
 	cmd.Flags().MarkHidden("test-dummy")
 	cmd.SetArgs(append(args, "--test-dummy"))
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type historyOpts struct {
+	baseOpts
+
+	verbose bool
+}
+
+func (opts *historyOpts) makeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history <service>",
+		Short: "show the revisions of a service's configuration",
+		Long:  "Show the recorded revisions of the configuration of <service>, oldest first, with who made each one and when. A revision can be restored with 'fluxctl rollback'.",
+		RunE:  opts.run,
+	}
+	cmd.Flags().BoolVarP(&opts.verbose, "verbose", "v", false, "show the configuration in each revision")
+	return cmd
+}
+
+func (opts *historyOpts) run(_ *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected argument <service>")
+	}
+	serviceName := args[0]
+
+	history, err := opts.store.GetServiceHistory(serviceName)
+	if err != nil {
+		return fmt.Errorf("Error fetching history: %s", err)
+	}
+
+	// The history outlives the service, so only a service with
+	// no history has to exist
+	if len(history) == 0 {
+		if err := opts.store.CheckRegisteredService(serviceName); err != nil {
+			return fmt.Errorf("Error fetching service: %s", err)
+		}
+	}
+
+	if done, err := opts.printStructured(history); done || err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(opts.getStdout(), 4, 0, 2, ' ', 0)
+	defer out.Flush()
+	fmt.Fprintln(out, "REVISION\tTIME\tAUTHOR\tDESCRIPTION")
+	for _, rev := range history {
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", rev.Revision,
+			rev.Time.Format(time.RFC3339), rev.Author, rev.Description)
+
+		if opts.verbose {
+			spec, err := json.Marshal(rev.Service)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "  Service: %s\n", spec)
+
+			for ruleName, rule := range rev.ContainerRules {
+				ruleBytes, err := json.Marshal(rule)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "  Rule: %s %s\n", ruleName, ruleBytes)
+			}
+		}
+	}
+
+	return nil
+}
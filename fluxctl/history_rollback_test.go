@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/store"
+	"github.com/weaveworks/flux/common/store/inmem"
+)
+
+func TestHistoryRollback(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{
+		"foo-svc", "--image", "foo/bar", "--instance-port", "80",
+	})
+	require.NoError(t, err)
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "--image", "foo/baz",
+	}))
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "other-rule", "--image", "foo/boo",
+	}))
+
+	opts := &historyOpts{}
+	bout, _ := opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{"foo-svc"}))
+	lines := strings.Split(strings.TrimSpace(bout.String()), "\n")
+	require.Len(t, lines, 4)
+	require.True(t, strings.HasPrefix(lines[1], "1 "))
+	require.True(t, strings.HasSuffix(lines[1], "service"))
+	require.True(t, strings.HasSuffix(lines[3], "select other-rule"))
+
+	// No such revision
+	require.Error(t, runOptsWithStore(&rollbackOpts{}, st, []string{
+		"foo-svc", "7",
+	}))
+
+	require.NoError(t, runOptsWithStore(&rollbackOpts{}, st, []string{
+		"foo-svc", "1",
+	}))
+	svc, err := st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, 80, svc.InstancePort)
+	require.Equal(t, map[string]store.ContainerRule{
+		DEFAULT_RULE: {Selector: map[string]string{"image": "foo/bar"}},
+	}, svc.ContainerRules)
+
+	// The rollback is itself recorded
+	history, err := st.GetServiceHistory("foo-svc")
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	require.Equal(t, "rollback to 1", history[3].Description)
+}
+
+// A store in which rules are always changed by someone else first
+type conflictingRulesStore struct {
+	store.Store
+}
+
+func (conflictingRulesStore) UpdateContainerRule(string, string, store.ContainerRule, uint64) error {
+	return store.ErrVersionConflict
+}
+
+func TestRollbackConflict(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{
+		"foo-svc", "--image", "foo/bar", "--instance-port", "80",
+	})
+	require.NoError(t, err)
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "--image", "foo/baz",
+	}))
+
+	// The parts done before the conflict are reported
+	err = runOptsWithStore(&rollbackOpts{}, conflictingRulesStore{st},
+		[]string{"foo-svc", "1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "changed by someone else")
+	require.Contains(t, err.Error(), "already applied: service definition")
+}
+
+func TestHistoryInitialRevision(t *testing.T) {
+	// A service with no history yet, e.g., from before history was
+	// kept
+	st := inmem.NewInMem().Store("test fluxctl history")
+	require.NoError(t, st.AddService("foo-svc", store.Service{InstancePort: 80}))
+	rule := store.ContainerRule{Selector: store.Selector{"image": "foo/bar"}}
+	require.NoError(t, st.SetContainerRule("foo-svc", DEFAULT_RULE, rule))
+
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "canary", "--image", "foo/baz",
+	}))
+	history, err := st.GetServiceHistory("foo-svc")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, "initial", history[0].Description)
+	require.Equal(t, "select canary", history[1].Description)
+	require.Len(t, history[1].ContainerRules, 2)
+
+	// So the first change can be rolled back
+	require.NoError(t, runOptsWithStore(&rollbackOpts{}, st, []string{
+		"foo-svc", "1",
+	}))
+	svc, err := st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, map[string]store.ContainerRule{DEFAULT_RULE: rule}, svc.ContainerRules)
+}
+
+func TestRollbackRemovedService(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{
+		"foo-svc", "--image", "foo/bar", "--instance-port", "80",
+	})
+	require.NoError(t, err)
+	require.NoError(t, runOptsWithStore(&rmOpts{}, st, []string{"foo-svc"}))
+
+	// The history is still there, and the service can be restored
+	// from it
+	opts := &historyOpts{}
+	bout, _ := opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{"foo-svc"}))
+	require.Len(t, strings.Split(strings.TrimSpace(bout.String()), "\n"), 2)
+
+	require.NoError(t, runOptsWithStore(&rollbackOpts{}, st, []string{
+		"foo-svc", "1",
+	}))
+	svc, err := st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, 80, svc.InstancePort)
+	require.Equal(t, map[string]store.ContainerRule{
+		DEFAULT_RULE: {Selector: map[string]string{"image": "foo/bar"}},
+	}, svc.ContainerRules)
+
+	// A service with no history has to exist
+	require.Error(t, runOptsWithStore(&historyOpts{}, st, []string{"bar-svc"}))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 
 	"github.com/spf13/cobra"
 
@@ -32,11 +33,6 @@ func (opts *infoOpts) run(_ *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	fmt.Fprint(opts.getStdout(), "HOSTS\n")
-	for _, host := range hosts {
-		fmt.Fprintln(opts.getStdout(), host.IP)
-	}
-	fmt.Fprint(opts.getStdout(), "\nSERVICES\n")
 
 	qopts := store.QueryServiceOptions{
 		WithInstances:      true,
@@ -52,6 +48,21 @@ func (opts *infoOpts) run(_ *cobra.Command, args []string) error {
 		return err
 	}
 
+	output := infoOutput{Hosts: []string{}, Services: makeServicesOutput(svcs)}
+	for _, host := range hosts {
+		output.Hosts = append(output.Hosts, host.IP.String())
+	}
+	sort.Strings(output.Hosts)
+	if done, err := opts.printStructured(output); done || err != nil {
+		return err
+	}
+
+	fmt.Fprint(opts.getStdout(), "HOSTS\n")
+	for _, host := range hosts {
+		fmt.Fprintln(opts.getStdout(), host.IP)
+	}
+	fmt.Fprint(opts.getStdout(), "\nSERVICES\n")
+
 	for name, svc := range svcs {
 		if err := printService(opts.getStdout(), name, svc); err != nil {
 			return err
@@ -62,6 +73,7 @@ func (opts *infoOpts) run(_ *cobra.Command, args []string) error {
 
 func printService(out io.Writer, name string, svc *store.ServiceInfo) error {
 	fmt.Fprintln(out, name)
+	fmt.Fprintf(out, "  Version: %d\n", svc.Version)
 
 	if svc.Address != nil {
 		fmt.Fprintf(out, "  Address: %s\n", svc.Address)
@@ -72,6 +84,21 @@ func printService(out io.Writer, name string, svc *store.ServiceInfo) error {
 	if svc.Protocol != "" {
 		fmt.Fprintf(out, "  Protocol: %s\n", svc.Protocol)
 	}
+	if svc.Strategy != "" {
+		fmt.Fprintf(out, "  Strategy: %s\n", svc.Strategy)
+	}
+	if svc.HealthCheck != nil {
+		fmt.Fprintf(out, "  Health check: %s\n", describeHealthCheck(svc.HealthCheck))
+	}
+	if svc.OutlierDetection != nil {
+		fmt.Fprintf(out, "  Outlier detection: %s\n", describeOutlierDetection(svc.OutlierDetection))
+	}
+	if svc.Retries != nil {
+		fmt.Fprintf(out, "  Retries: %s\n", describeRetries(svc.Retries))
+	}
+	if svc.Timeouts != nil {
+		fmt.Fprintf(out, "  Timeouts: %s\n", describeTimeouts(svc.Timeouts))
+	}
 
 	fmt.Fprint(out, "  RULES\n")
 	for ruleName, rule := range svc.ContainerRules {
@@ -79,11 +106,23 @@ func printService(out io.Writer, name string, svc *store.ServiceInfo) error {
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(out, "    %s %s\n", ruleName, selectBytes)
+		extra := ""
+		if rule.Weight != 0 {
+			extra += fmt.Sprintf(" weight %d", rule.Weight)
+		}
+		if rule.Traffic != 0 {
+			extra += fmt.Sprintf(" traffic %d%%", rule.Traffic)
+		}
+		fmt.Fprintf(out, "    %s %s%s (version %d)\n", ruleName, selectBytes,
+			extra, svc.ContainerRuleVersions[ruleName])
 	}
 	fmt.Fprint(out, "  INSTANCES\n")
 	for instName, inst := range svc.Instances {
-		fmt.Fprintf(out, "    %s %s\n", instName, inst.Address)
+		if inst.Weight != 0 {
+			fmt.Fprintf(out, "    %s %s weight %d\n", instName, inst.Address, inst.Weight)
+		} else {
+			fmt.Fprintf(out, "    %s %s\n", instName, inst.Address)
+		}
 	}
 	return nil
 }
@@ -22,7 +22,8 @@ const defaultFormat = "{{.Name}}"
 const defaultVerboseFormat = `{{.Name}}{{if .Address}}
   Address: {{.Address}}{{end}}{{if (ne .InstancePort 0)}}
   Instance port: {{.InstancePort}}{{end}}{{if .Protocol}}
-  Protocol: {{.Protocol}}{{end}}`
+  Protocol: {{.Protocol}}{{end}}{{if .Strategy}}
+  Strategy: {{.Strategy}}{{end}}`
 
 func (opts *listOpts) makeCommand() *cobra.Command {
 	cmd := &cobra.Command{
@@ -49,6 +50,17 @@ type ruleInfo struct {
 }
 
 func (opts *listOpts) run(_ *cobra.Command, args []string) error {
+	if format, err := opts.outputFormat(); err != nil {
+		return err
+	} else if format != OUTPUT_TABLE {
+		svcs, err := opts.store.GetAllServices(store.QueryServiceOptions{WithContainerRules: true})
+		if err != nil {
+			return fmt.Errorf("Unable to enumerate services: %s", err)
+		}
+		_, err = opts.printStructured(makeServicesOutput(svcs))
+		return err
+	}
+
 	format := opts.format
 	if format == "" {
 		format = defaultFormat
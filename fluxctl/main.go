@@ -22,26 +22,53 @@ func main() {
 		Short: "control flux",
 		Long:  `Define services and enrol instances in them`,
 	}
-	addSubCommands(topCmd, store)
+	var output string
+	addOutputFlag(topCmd.PersistentFlags(), &output)
+	// Check the output format before anything is changed
+	topCmd.PersistentPreRunE = func(*cobra.Command, []string) error {
+		return checkOutputFormat(output)
+	}
+	addSubCommands(topCmd, store, &output)
 
-	if err := topCmd.Execute(); err != nil {
+	if cmd, err := topCmd.ExecuteC(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(exitStatus(cmd, err))
+	}
+}
+
+// The status to exit with when a command fails.  Like diff(1),
+// fluxctl diff exits with 1 when it finds differences, so it uses 2
+// for errors.
+func exitStatus(cmd *cobra.Command, err error) int {
+	if _, isDiff := err.(differencesError); isDiff {
+		return 1
+	}
+	if cmd != nil && cmd.Name() == "diff" {
+		return 2
 	}
+	return 1
 }
 
-func addSubCommand(c commandOpts, cmd *cobra.Command, st store.Store) {
+func addSubCommand(c commandOpts, cmd *cobra.Command, st store.Store, output *string) {
 	c.setStore(st)
+	c.setOutput(output)
 	cmd.AddCommand(c.makeCommand())
 }
 
-func addSubCommands(cmd *cobra.Command, store store.Store) {
-	addSubCommand(&addOpts{}, cmd, store)
-	addSubCommand(&listOpts{}, cmd, store)
-	addSubCommand(&infoOpts{}, cmd, store)
-	addSubCommand(&queryOpts{}, cmd, store)
-	addSubCommand(&rmOpts{}, cmd, store)
-	addSubCommand(&selectOpts{}, cmd, store)
-	addSubCommand(&deselectOpts{}, cmd, store)
-	addSubCommand(&versionOpts{}, cmd, store)
+func addSubCommands(cmd *cobra.Command, store store.Store, output *string) {
+	addSubCommand(&addOpts{}, cmd, store, output)
+	addSubCommand(&listOpts{}, cmd, store, output)
+	addSubCommand(&infoOpts{}, cmd, store, output)
+	addSubCommand(&queryOpts{}, cmd, store, output)
+	addSubCommand(&rmOpts{}, cmd, store, output)
+	addSubCommand(&selectOpts{}, cmd, store, output)
+	addSubCommand(&deselectOpts{}, cmd, store, output)
+	addSubCommand(&historyOpts{}, cmd, store, output)
+	addSubCommand(&rollbackOpts{}, cmd, store, output)
+	addSubCommand(&applyOpts{}, cmd, store, output)
+	addSubCommand(&exportOpts{}, cmd, store, output)
+	addSubCommand(&diffOpts{}, cmd, store, output)
+	addSubCommand(&watchOpts{}, cmd, store, output)
+	addSubCommand(&rolloutOpts{}, cmd, store, output)
+	addSubCommand(&versionOpts{}, cmd, store, output)
 }
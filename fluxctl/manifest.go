@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+// A description of services and their rules, as kept in a file and
+// used by 'fluxctl apply' and 'fluxctl export'.  It's YAML, or JSON,
+// with the same field names as the store uses; e.g.,
+//
+//	services:
+//	  hello:
+//	    address: 10.128.0.1:80
+//	    protocol: http
+//	    rules:
+//	      default:
+//	        selector:
+//	          image: weaveworks/hello-world
+type manifest struct {
+	Services map[string]serviceManifest `json:"services"`
+}
+
+type serviceManifest struct {
+	store.Service
+	Rules map[string]store.ContainerRule `json:"rules,omitempty"`
+}
+
+// Read a manifest from a file, or from stdin if the filename is "-"
+func readManifest(filename string) (manifest, error) {
+	var m manifest
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return m, err
+	}
+
+	if err := unmarshalYAML(data, &m); err != nil {
+		return m, fmt.Errorf("Unable to parse %s: %s", filename, err)
+	}
+
+	for name, svc := range m.Services {
+		if name == "" {
+			return m, fmt.Errorf("Service with empty name in %s", filename)
+		}
+		if svc.Strategy != "" && !validStrategy(svc.Strategy) {
+			return m, fmt.Errorf(`Service "%s" has unknown load-balancing strategy "%s"`, name, svc.Strategy)
+		}
+		if svc.HealthCheck != nil {
+			if err := svc.HealthCheck.Validate(); err != nil {
+				return m, fmt.Errorf(`Service "%s" has an invalid health check: %s`, name, err)
+			}
+		}
+		if svc.OutlierDetection != nil {
+			if err := svc.OutlierDetection.Validate(); err != nil {
+				return m, fmt.Errorf(`Service "%s" has invalid outlier detection: %s`, name, err)
+			}
+		}
+		if svc.Retries != nil {
+			if err := svc.Retries.Validate(); err != nil {
+				return m, fmt.Errorf(`Service "%s" has invalid retries: %s`, name, err)
+			}
+		}
+		if svc.Timeouts != nil {
+			if err := svc.Timeouts.Validate(); err != nil {
+				return m, fmt.Errorf(`Service "%s" has invalid timeouts: %s`, name, err)
+			}
+		}
+		traffic := 0
+		for ruleName, rule := range svc.Rules {
+			if rule.Selector.Empty() {
+				return m, fmt.Errorf(`Rule "%s" of service "%s" has an empty selector, and so would select nothing`, ruleName, name)
+			}
+			if rule.Traffic < 0 {
+				return m, fmt.Errorf(`Rule "%s" of service "%s" has a negative traffic percentage`, ruleName, name)
+			}
+			traffic += rule.Traffic
+		}
+		if traffic > 100 {
+			return m, fmt.Errorf(`The rules of service "%s" have %d%% of its traffic between them`, name, traffic)
+		}
+	}
+
+	return m, nil
+}
+
+func manifestFromServices(services map[string]*store.ServiceInfo) manifest {
+	m := manifest{Services: make(map[string]serviceManifest)}
+	for name, info := range services {
+		svc := serviceManifest{Service: info.Service}
+		if len(info.ContainerRules) > 0 {
+			svc.Rules = info.ContainerRules
+		}
+		m.Services[name] = svc
+	}
+	return m
+}
+
+func (m manifest) marshalYAML() ([]byte, error) {
+	if m.Services == nil {
+		m.Services = map[string]serviceManifest{}
+	}
+	return marshalYAML(&m)
+}
+
+// YAML goes through JSON on the way in and out, so it has the field
+// names given by the json tags on the store's types.  Everything in
+// fluxctl that reads or writes YAML does so through these.
+func marshalYAML(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+func unmarshalYAML(data []byte, v interface{}) error {
+	return yaml.Unmarshal(data, v)
+}
+
+type manifestOp string
+
+const (
+	opAdd    manifestOp = "+"
+	opUpdate manifestOp = "~"
+	opRemove manifestOp = "-"
+)
+
+// A change needed to bring the store into line with a manifest.  The
+// change is to a rule if rule is non-empty, otherwise to the service
+// definition.
+type manifestChange struct {
+	op      manifestOp
+	service string
+	rule    string
+	// The values before and after the change, where there are
+	// such; a store.Service or a store.ContainerRule
+	from, to interface{}
+	// The version the change is conditional on, from when the
+	// store was read
+	version uint64
+}
+
+func (c manifestChange) String() string {
+	if c.rule != "" {
+		return fmt.Sprintf("%s rule %s/%s", c.op, c.service, c.rule)
+	}
+	return fmt.Sprintf("%s service %s", c.op, c.service)
+}
+
+// Work out the changes needed to make the services in the store
+// match the manifest.  Unless prune is set, services and rules not in
+// the manifest are left alone.  The changes are ordered so that they
+// can be made in sequence: a service is defined before its rules, and
+// removed after them.
+func planChanges(current map[string]*store.ServiceInfo, desired manifest, prune bool) []manifestChange {
+	var changes []manifestChange
+
+	for _, name := range sortedKeys(desired.Services) {
+		want := desired.Services[name]
+		have := current[name]
+
+		switch {
+		case have == nil:
+			changes = append(changes, manifestChange{op: opAdd, service: name, to: want.Service})
+		case !sameJSON(have.Service, want.Service):
+			changes = append(changes, manifestChange{op: opUpdate, service: name, from: have.Service, to: want.Service, version: have.Version})
+		}
+
+		var haveRules map[string]store.ContainerRule
+		var ruleVersions map[string]uint64
+		if have != nil {
+			haveRules = have.ContainerRules
+			ruleVersions = have.ContainerRuleVersions
+		}
+
+		for _, ruleName := range sortedKeys(want.Rules) {
+			rule := want.Rules[ruleName]
+			haveRule, found := haveRules[ruleName]
+			switch {
+			case !found:
+				changes = append(changes, manifestChange{op: opAdd, service: name, rule: ruleName, to: rule})
+			case !sameJSON(haveRule, rule):
+				changes = append(changes, manifestChange{op: opUpdate, service: name, rule: ruleName, from: haveRule, to: rule, version: ruleVersions[ruleName]})
+			}
+		}
+
+		if prune {
+			for _, ruleName := range sortedKeys(haveRules) {
+				if _, found := want.Rules[ruleName]; !found {
+					changes = append(changes, manifestChange{op: opRemove, service: name, rule: ruleName, from: haveRules[ruleName]})
+				}
+			}
+		}
+	}
+
+	if prune {
+		for _, name := range sortedKeys(current) {
+			if _, found := desired.Services[name]; !found {
+				changes = append(changes, manifestChange{op: opRemove, service: name, from: current[name].Service})
+			}
+		}
+	}
+
+	return changes
+}
+
+// Make a change to the store.  Additions and updates are conditional
+// on the version from when the store was read, so that changes made
+// in the meantime by someone else are not overwritten.
+func (c manifestChange) apply(st store.Store) error {
+	switch {
+	case c.op == opRemove && c.rule == "":
+		return st.RemoveService(c.service)
+	case c.op == opRemove:
+		return st.RemoveContainerRule(c.service, c.rule)
+	case c.rule == "":
+		return st.UpdateService(c.service, c.to.(store.Service), c.version)
+	default:
+		return st.UpdateContainerRule(c.service, c.rule, c.to.(store.ContainerRule), c.version)
+	}
+}
+
+func sameJSON(a, b interface{}) bool {
+	ja, erra := json.Marshal(a)
+	jb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && bytes.Equal(ja, jb)
+}
+
+// The keys of a map with string keys, sorted
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]serviceManifest:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*store.ServiceInfo:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]store.ContainerRule:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]store.Instance:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/pflag"
+
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+// The formats for --output
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+	OUTPUT_YAML  = "yaml"
+)
+
+func addOutputFlag(flags *pflag.FlagSet, output *string) {
+	flags.StringVarP(output, "output", "o", OUTPUT_TABLE, fmt.Sprintf(`output format: "%s" for human-readable output, or "%s" or "%s" for the schemas described in the documentation`, OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_YAML))
+}
+
+func checkOutputFormat(format string) error {
+	switch format {
+	case OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_YAML:
+		return nil
+	default:
+		return fmt.Errorf(`Unknown output format "%s"; expected "%s", "%s" or "%s"`, format, OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_YAML)
+	}
+}
+
+func (cmd *baseOpts) outputFormat() (string, error) {
+	if cmd.output == nil {
+		return OUTPUT_TABLE, nil
+	}
+	return *cmd.output, checkOutputFormat(*cmd.output)
+}
+
+// Print v in the output format selected, if it is JSON or YAML.  If
+// the format is table, nothing is printed and false is returned, so
+// the caller can print its own layout.
+func (cmd *baseOpts) printStructured(v interface{}) (bool, error) {
+	format, err := cmd.outputFormat()
+	if err != nil || format == OUTPUT_TABLE {
+		return false, err
+	}
+
+	var out []byte
+	switch format {
+	case OUTPUT_JSON:
+		if out, err = json.MarshalIndent(v, "", "  "); err == nil {
+			out = append(out, '\n')
+		}
+	case OUTPUT_YAML:
+		out, err = marshalYAML(v)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	_, err = cmd.getStdout().Write(out)
+	return true, err
+}
+
+// The schemas for JSON and YAML output.  These are relied upon by
+// scripts, so fields should only ever be added to them.  Lists are
+// sorted by name, so that output is stable.
+
+type serviceOutput struct {
+	Name             string                  `json:"name"`
+	Version          uint64                  `json:"version"`
+	Address          *netutil.IPPort         `json:"address,omitempty"`
+	InstancePort     int                     `json:"instancePort,omitempty"`
+	Protocol         string                  `json:"protocol,omitempty"`
+	Strategy         string                  `json:"strategy,omitempty"`
+	HealthCheck      *store.HealthCheck      `json:"healthCheck,omitempty"`
+	OutlierDetection *store.OutlierDetection `json:"outlierDetection,omitempty"`
+	Retries          *store.RetryPolicy      `json:"retries,omitempty"`
+	Timeouts         *store.Timeouts         `json:"timeouts,omitempty"`
+	Rules            []ruleOutput            `json:"rules"`
+	Instances        []instanceOutput        `json:"instances,omitempty"`
+}
+
+type ruleOutput struct {
+	Name         string         `json:"name"`
+	Version      uint64         `json:"version"`
+	Selector     store.Selector `json:"selector"`
+	InstancePort int            `json:"instancePort,omitempty"`
+	Weight       int            `json:"weight,omitempty"`
+	Traffic      int            `json:"traffic,omitempty"`
+}
+
+type instanceOutput struct {
+	Service string            `json:"service"`
+	Name    string            `json:"name"`
+	State   string            `json:"state"`
+	Address *netutil.IPPort   `json:"address,omitempty"`
+	Host    string            `json:"host,omitempty"`
+	Rule    string            `json:"rule"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Weight  int               `json:"weight,omitempty"`
+}
+
+type infoOutput struct {
+	Hosts    []string        `json:"hosts"`
+	Services []serviceOutput `json:"services"`
+}
+
+type versionOutput struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+}
+
+type changeOutput struct {
+	Op      string      `json:"op"`
+	Service string      `json:"service"`
+	Rule    string      `json:"rule,omitempty"`
+	From    interface{} `json:"from,omitempty"`
+	To      interface{} `json:"to,omitempty"`
+}
+
+func makeServiceOutput(name string, svc *store.ServiceInfo) serviceOutput {
+	out := serviceOutput{
+		Name:             name,
+		Version:          svc.Version,
+		Address:          svc.Address,
+		InstancePort:     svc.InstancePort,
+		Protocol:         svc.Protocol,
+		Strategy:         svc.Strategy,
+		HealthCheck:      svc.HealthCheck,
+		OutlierDetection: svc.OutlierDetection,
+		Retries:          svc.Retries,
+		Timeouts:         svc.Timeouts,
+		Rules:            []ruleOutput{},
+	}
+
+	for _, ruleName := range sortedKeys(svc.ContainerRules) {
+		rule := svc.ContainerRules[ruleName]
+		out.Rules = append(out.Rules, ruleOutput{
+			Name:         ruleName,
+			Version:      svc.ContainerRuleVersions[ruleName],
+			Selector:     rule.Selector,
+			InstancePort: rule.InstancePort,
+			Weight:       rule.Weight,
+			Traffic:      rule.Traffic,
+		})
+	}
+
+	for _, instName := range sortedKeys(svc.Instances) {
+		out.Instances = append(out.Instances, makeInstanceOutput(name, instName, svc.Instances[instName]))
+	}
+
+	return out
+}
+
+func makeServicesOutput(svcs map[string]*store.ServiceInfo) []serviceOutput {
+	out := []serviceOutput{}
+	for _, name := range sortedKeys(svcs) {
+		out = append(out, makeServiceOutput(name, svcs[name]))
+	}
+	return out
+}
+
+func makeInstanceOutput(svcName, instName string, inst store.Instance) instanceOutput {
+	out := instanceOutput{
+		Service: svcName,
+		Name:    instName,
+		State:   inst.Label(store.StateLabel),
+		Address: inst.Address,
+		Rule:    inst.ContainerRule,
+		Labels:  inst.Labels,
+		Weight:  inst.Weight,
+	}
+	if inst.Host.IP != nil {
+		out.Host = inst.Host.IP.String()
+	}
+	return out
+}
+
+func makeChangesOutput(changes []manifestChange) []changeOutput {
+	names := map[manifestOp]string{opAdd: "add", opUpdate: "update", opRemove: "remove"}
+	out := []changeOutput{}
+	for _, c := range changes {
+		out = append(out, changeOutput{
+			Op:      names[c.op],
+			Service: c.service,
+			Rule:    c.rule,
+			From:    c.from,
+			To:      c.to,
+		})
+	}
+	return out
+}
+
+// Print the resulting state of a service after changing it
+func (cmd *baseOpts) printResult(serviceName string) (bool, error) {
+	format, err := cmd.outputFormat()
+	if err != nil || format == OUTPUT_TABLE {
+		return false, err
+	}
+
+	svc, err := cmd.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true})
+	if err != nil {
+		return true, fmt.Errorf("Error fetching service: %s", err)
+	}
+
+	return cmd.printStructured(makeServiceOutput(serviceName, svc))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+	"github.com/weaveworks/flux/common/store/inmem"
+)
+
+func TestOutputBadFormat(t *testing.T) {
+	_, err := runOpts(&listOpts{}, []string{"--output", "xml"})
+	require.Error(t, err)
+}
+
+func TestServiceOutput(t *testing.T) {
+	opts := &addOpts{}
+	bout, _ := opts.tapOutput()
+	st, err := runOpts(opts, []string{
+		"foo", "--address", "10.3.4.5:80", "--image", "foo/bar", "-o", "json"})
+	require.NoError(t, err)
+
+	var svc serviceOutput
+	require.NoError(t, json.Unmarshal(bout.Bytes(), &svc))
+	require.Equal(t, "foo", svc.Name)
+	require.Equal(t, netutil.ParseIPPortPtr("10.3.4.5:80"), svc.Address)
+	require.Len(t, svc.Rules, 1)
+	require.Equal(t, DEFAULT_RULE, svc.Rules[0].Name)
+	require.Equal(t, store.Selector{"image": "foo/bar"}, svc.Rules[0].Selector)
+
+	selOpts := &selectOpts{}
+	bout, _ = selOpts.tapOutput()
+	require.NoError(t, runOptsWithStore(selOpts, st, []string{
+		"foo", "canary", "--tag", "canary", "-o", "yaml"}))
+	svc = serviceOutput{}
+	require.NoError(t, unmarshalYAML(bout.Bytes(), &svc))
+	require.Len(t, svc.Rules, 2)
+	require.Equal(t, "canary", svc.Rules[0].Name)
+}
+
+func TestListInfoQueryOutput(t *testing.T) {
+	st := inmem.NewInMem().Store("test fluxctl output")
+	require.NoError(t, st.RegisterHost("host1", &store.Host{IP: net.ParseIP("192.168.0.1")}))
+	require.NoError(t, st.AddService("foo", store.Service{}))
+	require.NoError(t, st.AddService("bar", store.Service{}))
+	require.NoError(t, st.AddInstance("foo", "inst1", store.Instance{
+		Address:       netutil.ParseIPPortPtr("192.168.0.1:8080"),
+		Host:          store.Host{IP: net.ParseIP("192.168.0.1")},
+		ContainerRule: DEFAULT_RULE,
+	}))
+
+	listOpts := &listOpts{}
+	bout, _ := listOpts.tapOutput()
+	require.NoError(t, runOptsWithStore(listOpts, st, []string{"--output", "json"}))
+	var svcs []serviceOutput
+	require.NoError(t, json.Unmarshal(bout.Bytes(), &svcs))
+	require.Len(t, svcs, 2)
+	require.Equal(t, "bar", svcs[0].Name)
+	require.Equal(t, "foo", svcs[1].Name)
+
+	infoOpts := &infoOpts{}
+	bout, _ = infoOpts.tapOutput()
+	require.NoError(t, runOptsWithStore(infoOpts, st, []string{"--output", "json"}))
+	var info infoOutput
+	require.NoError(t, json.Unmarshal(bout.Bytes(), &info))
+	require.Equal(t, []string{"192.168.0.1"}, info.Hosts)
+	require.Len(t, info.Services, 2)
+	require.Equal(t, []instanceOutput{{
+		Service: "foo",
+		Name:    "inst1",
+		State:   "live",
+		Address: netutil.ParseIPPortPtr("192.168.0.1:8080"),
+		Host:    "192.168.0.1",
+		Rule:    DEFAULT_RULE,
+	}}, info.Services[1].Instances)
+
+	queryOpts := &queryOpts{}
+	bout, _ = queryOpts.tapOutput()
+	require.NoError(t, runOptsWithStore(queryOpts, st, []string{"--output", "json"}))
+	var insts []instanceOutput
+	require.NoError(t, json.Unmarshal(bout.Bytes(), &insts))
+	require.Equal(t, info.Services[1].Instances, insts)
+}
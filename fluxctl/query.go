@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"text/tabwriter"
 	"text/template"
 
@@ -64,8 +65,20 @@ func (opts *queryOpts) run(_ *cobra.Command, args []string) error {
 		sel[store.RuleLabel] = opts.rule
 	}
 
+	format, err := opts.outputFormat()
+	if err != nil {
+		return err
+	}
+
+	var structured []instanceOutput
 	var printInstance func(svcName string, svc *store.ServiceInfo, instName string, inst store.Instance) error
-	if opts.quiet {
+	if format != OUTPUT_TABLE {
+		structured = []instanceOutput{}
+		printInstance = func(svcName string, _ *store.ServiceInfo, instName string, inst store.Instance) error {
+			structured = append(structured, makeInstanceOutput(svcName, instName, inst))
+			return nil
+		}
+	} else if opts.quiet {
 		printInstance = func(_ string, _ *store.ServiceInfo, instName string, _ store.Instance) error {
 			fmt.Fprintln(opts.getStdout(), instName)
 			return nil
@@ -100,7 +113,6 @@ func (opts *queryOpts) run(_ *cobra.Command, args []string) error {
 	}
 
 	svcs := make(map[string]*store.ServiceInfo)
-	var err error
 	if opts.service == "" {
 		svcs, err = opts.store.GetAllServices(store.QueryServiceOptions{WithInstances: true})
 	} else {
@@ -123,5 +135,20 @@ func (opts *queryOpts) run(_ *cobra.Command, args []string) error {
 		}
 	}
 
-	return nil
+	if structured != nil {
+		sort.Sort(instancesByName(structured))
+		_, err = opts.printStructured(structured)
+	}
+	return err
+}
+
+type instancesByName []instanceOutput
+
+func (a instancesByName) Len() int      { return len(a) }
+func (a instancesByName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a instancesByName) Less(i, j int) bool {
+	if a[i].Service != a[j].Service {
+		return a[i].Service < a[j].Service
+	}
+	return a[i].Name < a[j].Name
 }
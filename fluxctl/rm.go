@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
 )
 
 type rmOpts struct {
@@ -21,10 +23,30 @@ func (opts *rmOpts) makeCommand() *cobra.Command {
 }
 
 func (opts *rmOpts) run(_ *cobra.Command, args []string) error {
-	var err error
 	if len(args) != 1 {
 		return fmt.Errorf(`Please supply either a service name, or "--all"`)
 	}
+
+	format, err := opts.outputFormat()
+	if err != nil {
+		return err
+	}
+
+	// For structured output, echo what is removed
+	var removed map[string]*store.ServiceInfo
+	qopts := store.QueryServiceOptions{WithContainerRules: true}
+	if format != OUTPUT_TABLE {
+		if args[0] == "--all" {
+			removed, err = opts.store.GetAllServices(qopts)
+		} else {
+			removed = make(map[string]*store.ServiceInfo)
+			removed[args[0]], err = opts.store.GetService(args[0], qopts)
+		}
+		if err != nil {
+			return fmt.Errorf("Error fetching service: %s", err)
+		}
+	}
+
 	if args[0] == "--all" {
 		err = opts.store.RemoveAllServices()
 	} else {
@@ -33,5 +55,9 @@ func (opts *rmOpts) run(_ *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("Failed to delete: %s", err)
 	}
-	return nil
+
+	if removed != nil {
+		_, err = opts.printStructured(makeServicesOutput(removed))
+	}
+	return err
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+type rollbackOpts struct {
+	baseOpts
+}
+
+func (opts *rollbackOpts) makeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback <service> <revision>",
+		Short: "restore a previous revision of a service",
+		Long:  "Restore the service definition and selection rules of <service> to those recorded in <revision>, as shown by 'fluxctl history'.",
+		RunE:  opts.run,
+	}
+	return cmd
+}
+
+func (opts *rollbackOpts) run(_ *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Expected arguments <service> <revision>")
+	}
+	serviceName := args[0]
+	revision, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf(`Expected a revision number, but got "%s"`, args[1])
+	}
+
+	history, err := opts.store.GetServiceHistory(serviceName)
+	if err != nil {
+		return fmt.Errorf("Error fetching history: %s", err)
+	}
+
+	var rev *store.ServiceRevision
+	for i := range history {
+		if history[i].Revision == revision {
+			rev = &history[i]
+		}
+	}
+	if rev == nil {
+		return fmt.Errorf("Service %s has no revision %d", serviceName, revision)
+	}
+
+	// Make the updates conditional on what we read, so that we
+	// don't clobber changes made in the meantime.  Keep track of
+	// what has been done, in case we have to give up part way.
+	var applied []string
+	apply := func(what string, update func() error) {
+		if err == nil {
+			if err = update(); err == nil {
+				applied = append(applied, what)
+			}
+		}
+	}
+
+	current, ferr := opts.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true})
+	if ferr != nil {
+		// The history outlives the service, so it may have been
+		// removed; if so, it is created again, with no rules yet
+		apply("service definition", func() error {
+			return opts.store.UpdateService(serviceName, rev.Service, 0)
+		})
+		if err == store.ErrVersionConflict {
+			return fmt.Errorf("Error fetching service: %s", ferr)
+		}
+		current = &store.ServiceInfo{}
+	} else {
+		apply("service definition", func() error {
+			return opts.store.UpdateService(serviceName, rev.Service, current.Version)
+		})
+	}
+	for ruleName, rule := range rev.ContainerRules {
+		ruleName, rule := ruleName, rule
+		apply("rule "+ruleName, func() error {
+			return opts.store.UpdateContainerRule(serviceName, ruleName,
+				rule, current.ContainerRuleVersions[ruleName])
+		})
+	}
+	for ruleName := range current.ContainerRules {
+		if _, found := rev.ContainerRules[ruleName]; !found {
+			ruleName := ruleName
+			apply("removal of rule "+ruleName, func() error {
+				return opts.store.RemoveContainerRuleIfVersion(serviceName,
+					ruleName, current.ContainerRuleVersions[ruleName])
+			})
+		}
+	}
+
+	if err != nil {
+		if err == store.ErrVersionConflict {
+			err = fmt.Errorf("Service %s was changed by someone else during the rollback; check 'fluxctl info' and 'fluxctl history', then retry", serviceName)
+		} else {
+			err = fmt.Errorf("Error updating service: %s", err)
+		}
+		if len(applied) > 0 {
+			err = fmt.Errorf("%s (already applied: %s)", err,
+				strings.Join(applied, ", "))
+		}
+		return err
+	}
+
+	opts.recordRevision(serviceName, fmt.Sprintf("rollback to %d", revision),
+		rev.Service, rev.ContainerRules)
+	if done, err := opts.printResult(serviceName); done || err != nil {
+		return err
+	}
+	fmt.Fprintln(opts.getStdout(), serviceName)
+	return nil
+}
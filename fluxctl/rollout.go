@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
+)
+
+type rolloutOpts struct {
+	baseOpts
+
+	from         string
+	to           string
+	steps        string
+	interval     time.Duration
+	maxErrorRate float64
+	minRequests  int
+	prometheus   string
+
+	// Replaced in tests
+	errorRates errorRater
+	wait       func(time.Duration) bool
+}
+
+func (opts *rolloutOpts) makeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollout <service> --from <rule> --to <rule>",
+		Short: "shift traffic from one rule to another in steps",
+		Long:  "Shift the traffic of <service> from the instances of one rule to those of another, a step at a time. After each step, the HTTP error rate of the instances receiving the traffic is checked using Prometheus; if it exceeds --max-error-rate, or the rollout is interrupted, the rules are reverted to how they were before the rollout.",
+		RunE:  opts.run,
+	}
+	cmd.Flags().StringVar(&opts.from, "from", "", "the rule to shift traffic away from")
+	cmd.Flags().StringVar(&opts.to, "to", "", "the rule to shift traffic to")
+	cmd.Flags().StringVar(&opts.steps, "steps", "10,25,50,100", "the percentages of traffic to give to the --to rule at each step, in increasing order")
+	cmd.Flags().DurationVar(&opts.interval, "interval", 2*time.Minute, "how long to wait after each step before checking the error rate")
+	cmd.Flags().Float64Var(&opts.maxErrorRate, "max-error-rate", 0.01, "the fraction of HTTP requests that may get a 5xx response before the rollout is reverted")
+	cmd.Flags().IntVar(&opts.minRequests, "min-requests", 1, "the fewest HTTP requests the --to rule must get at each step for its error rate to count; with fewer, the rollout is reverted")
+	cmd.Flags().StringVar(&opts.prometheus, "prometheus", os.Getenv("PROMETHEUS_ADDRESS"), "the base URL of the Prometheus server that collects the balancers' metrics; e.g., http://prometheus:9090. Defaults to $PROMETHEUS_ADDRESS.")
+	return cmd
+}
+
+func parseSteps(steps string) ([]int, error) {
+	var res []int
+	for _, s := range strings.Split(steps, ",") {
+		step, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf(`Did not understand step "%s"; expected a percentage`, s)
+		}
+		if step <= 0 || step > 100 {
+			return nil, fmt.Errorf("Step %d is not a percentage between 1 and 100", step)
+		}
+		if len(res) > 0 && step <= res[len(res)-1] {
+			return nil, fmt.Errorf("Steps must be in increasing order")
+		}
+		res = append(res, step)
+	}
+	return res, nil
+}
+
+func (opts *rolloutOpts) run(_ *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected argument <service>")
+	}
+	serviceName := args[0]
+
+	if opts.from == "" || opts.to == "" {
+		return fmt.Errorf("Both --from and --to rules must be given")
+	}
+	if opts.from == opts.to {
+		return fmt.Errorf("The --from and --to rules must be different")
+	}
+
+	steps, err := parseSteps(opts.steps)
+	if err != nil {
+		return err
+	}
+	if opts.minRequests < 1 {
+		return fmt.Errorf("At least one request is needed at each step to check the error rate")
+	}
+
+	if opts.errorRates == nil {
+		if opts.prometheus == "" {
+			return fmt.Errorf("The address of Prometheus is needed to check error rates; supply --prometheus or set $PROMETHEUS_ADDRESS")
+		}
+		opts.errorRates = &promErrorRater{address: strings.TrimRight(opts.prometheus, "/")}
+	}
+
+	if opts.wait == nil {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+		opts.wait = func(d time.Duration) bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-sigs:
+				return false
+			}
+		}
+	}
+
+	svc, err := opts.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true})
+	if err != nil {
+		return fmt.Errorf("Error fetching service: %s", err)
+	}
+
+	r := rollout{
+		rolloutOpts: opts,
+		service:     serviceName,
+		svc:         svc.Service,
+		rules:       copyRules(svc.ContainerRules),
+		original:    make(map[string]store.ContainerRule),
+		versions:    make(map[string]uint64),
+	}
+	for _, ruleName := range []string{opts.from, opts.to} {
+		rule, found := svc.ContainerRules[ruleName]
+		if !found {
+			return fmt.Errorf(`Service "%s" has no rule "%s"`, serviceName, ruleName)
+		}
+		r.original[ruleName] = rule
+		r.versions[ruleName] = svc.ContainerRuleVersions[ruleName]
+	}
+
+	// The rollout gives the two rules explicit shares between them,
+	// which would leave nothing for other rules sharing what is
+	// left over
+	for _, ruleName := range sortedKeys(svc.ContainerRules) {
+		if ruleName != opts.from && ruleName != opts.to && svc.ContainerRules[ruleName].Traffic == 0 {
+			return fmt.Errorf(`Rule "%s" of service "%s" has no traffic percentage of its own, so would get no traffic during the rollout; give it one with 'fluxctl select --traffic', or remove it`, ruleName, serviceName)
+		}
+	}
+
+	// The traffic shifted is whatever is not given to other rules
+	base := 100 - otherTraffic(svc, opts.from) + r.original[opts.to].Traffic
+	if base <= 0 {
+		return fmt.Errorf(`Other rules of service "%s" have all its traffic`, serviceName)
+	}
+
+	// Progress goes to stdout, unless that is reserved for
+	// structured output
+	progress := opts.getStdout()
+	if format, err := opts.outputFormat(); err != nil {
+		return err
+	} else if format != OUTPUT_TABLE {
+		progress = opts.getStderr()
+	}
+
+	opts.recordInitialRevision(serviceName, svc)
+	for i, step := range steps {
+		toShare := base * step / 100
+		if err := r.setTraffic(base-toShare, toShare); err != nil {
+			return err
+		}
+		r.record(fmt.Sprintf("rollout %s to %s: %d%%", opts.from, opts.to, step))
+		fmt.Fprintf(progress, "Step %d of %d: %d%% of traffic to %s\n", i+1, len(steps), step, opts.to)
+
+		if !opts.wait(opts.interval) {
+			return r.revert(progress, "Rollout interrupted")
+		}
+
+		instances, err := r.instancesOf(opts.to)
+		if err != nil {
+			return r.revert(progress, fmt.Sprintf("Unable to find instances of %s: %s", opts.to, err))
+		}
+		errors, total, err := opts.errorRates.errorRate(instances, opts.interval)
+		if err != nil {
+			return r.revert(progress, fmt.Sprintf("Unable to check error rate: %s", err))
+		}
+
+		// Without enough requests, there is no telling whether
+		// the instances are healthy
+		if total < float64(opts.minRequests) {
+			return r.revert(progress, fmt.Sprintf("Only %.0f requests to %s, fewer than the minimum of %d", total, opts.to, opts.minRequests))
+		}
+		rate := errors / total
+		fmt.Fprintf(progress, "  Error rate %.2f%% of %.0f requests\n", rate*100, total)
+		if rate > opts.maxErrorRate {
+			return r.revert(progress, fmt.Sprintf("Error rate %.2f%% exceeds the maximum of %.2f%%", rate*100, opts.maxErrorRate*100))
+		}
+	}
+
+	fmt.Fprintf(progress, "Rollout to %s complete\n", opts.to)
+	_, err = opts.printResult(serviceName)
+	return err
+}
+
+type rollout struct {
+	*rolloutOpts
+	service string
+	// The service as read before the rollout, and all its rules
+	// as last updated
+	svc   store.Service
+	rules map[string]store.ContainerRule
+
+	// The rules as they were before the rollout, and the
+	// versions of the rules as last updated
+	original map[string]store.ContainerRule
+	versions map[string]uint64
+}
+
+func (r *rollout) setTraffic(fromShare, toShare int) error {
+	from := r.original[r.from]
+	from.Traffic = fromShare
+	to := r.original[r.to]
+	to.Traffic = toShare
+	return r.update(map[string]store.ContainerRule{r.from: from, r.to: to})
+}
+
+// Update the rules, conditional on them not having been changed by
+// anyone else during the rollout
+func (r *rollout) update(rules map[string]store.ContainerRule) error {
+	for _, ruleName := range []string{r.from, r.to} {
+		err := r.store.UpdateContainerRule(r.service, ruleName, rules[ruleName], r.versions[ruleName])
+		if err == store.ErrVersionConflict {
+			return fmt.Errorf(`Rule "%s" of service "%s" has been changed by someone else during the rollout; stopping`, ruleName, r.service)
+		}
+		if err != nil {
+			return fmt.Errorf("Error updating service: %s", err)
+		}
+		r.rules[ruleName] = rules[ruleName]
+	}
+
+	svc, err := r.store.GetService(r.service, store.QueryServiceOptions{WithContainerRules: true})
+	if err != nil {
+		return fmt.Errorf("Error fetching service: %s", err)
+	}
+	for _, ruleName := range []string{r.from, r.to} {
+		r.versions[ruleName] = svc.ContainerRuleVersions[ruleName]
+	}
+	return nil
+}
+
+// Record the service, with the rules as last updated, in its history
+func (r *rollout) record(description string) {
+	r.recordRevision(r.service, description, r.svc, copyRules(r.rules))
+}
+
+// Put the rules back how they were, and report why
+func (r *rollout) revert(progress io.Writer, reason string) error {
+	fmt.Fprintln(progress, reason)
+	if err := r.update(r.original); err != nil {
+		return fmt.Errorf("%s; reverting failed: %s", reason, err)
+	}
+	r.record(fmt.Sprintf("rollout %s to %s: reverted", r.from, r.to))
+	fmt.Fprintf(progress, "Reverted rules %s and %s\n", r.from, r.to)
+	return fmt.Errorf("Rollout to %s of service %s reverted: %s", r.to, r.service, reason)
+}
+
+func (r *rollout) instancesOf(ruleName string) ([]string, error) {
+	svc, err := r.store.GetService(r.service, store.QueryServiceOptions{WithInstances: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, inst := range svc.Instances {
+		if inst.ContainerRule == ruleName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Something that can say how many HTTP requests to the given instances
+// got an error response, out of how many, over a period up to now
+type errorRater interface {
+	errorRate(instances []string, window time.Duration) (errors, total float64, err error)
+}
+
+// Works out error rates from the metrics the balancers give to
+// Prometheus
+type promErrorRater struct {
+	address string
+}
+
+func (p *promErrorRater) errorRate(instances []string, window time.Duration) (float64, float64, error) {
+	if len(instances) == 0 {
+		return 0, 0, nil
+	}
+
+	quoted := make([]string, len(instances))
+	for i, inst := range instances {
+		quoted[i] = regexp.QuoteMeta(inst)
+	}
+	match := fmt.Sprintf(`individual=~"%s"`, strings.Join(quoted, "|"))
+	rng := fmt.Sprintf("[%ds]", int(window.Seconds()))
+
+	errors, err := p.query(`sum(increase(flux_http_total{` + match + `,code=~"5.."}` + rng + `))`)
+	if err != nil {
+		return 0, 0, err
+	}
+	total, err := p.query(`sum(increase(flux_http_total{` + match + `}` + rng + `))`)
+	return errors, total, err
+}
+
+// Run a query giving a single number; no result is taken to mean 0
+func (p *promErrorRater) query(query string) (float64, error) {
+	resp, err := http.Get(p.address + "/api/v1/query?" + url.Values{"query": {query}}.Encode())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Result []struct {
+				Value []interface{} `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("unable to parse response from Prometheus: %s", err)
+	}
+	if result.Status != "success" {
+		return 0, fmt.Errorf("query failed: %s", result.Error)
+	}
+
+	if len(result.Data.Result) == 0 {
+		return 0, nil
+	}
+	value := result.Data.Result[0].Value
+	if len(value) != 2 {
+		return 0, fmt.Errorf("unexpected result from Prometheus: %v", value)
+	}
+	s, _ := value[1].(string)
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/store"
+	"github.com/weaveworks/flux/common/store/inmem"
+)
+
+// Gives each of the rates in turn, recording what was asked
+type fakeErrorRater struct {
+	rates     []float64
+	instances [][]string
+}
+
+func (f *fakeErrorRater) errorRate(instances []string, _ time.Duration) (float64, float64, error) {
+	f.instances = append(f.instances, instances)
+	rate := f.rates[0]
+	f.rates = f.rates[1:]
+	return rate * 1000, 1000, nil
+}
+
+// As if no requests reached the instances
+type noRequestsRater struct{}
+
+func (noRequestsRater) errorRate([]string, time.Duration) (float64, float64, error) {
+	return 0, 0, nil
+}
+
+func rolloutStore(t *testing.T) store.Store {
+	st := inmem.NewInMem().Store("test fluxctl")
+	require.NoError(t, st.AddService("svc", store.Service{}))
+	require.NoError(t, st.SetContainerRule("svc", "stable", store.ContainerRule{Selector: store.Selector{"tag": "v1"}}))
+	require.NoError(t, st.SetContainerRule("svc", "canary", store.ContainerRule{Selector: store.Selector{"tag": "v2"}}))
+	require.NoError(t, st.AddInstance("svc", "s1", store.Instance{ContainerRule: "stable"}))
+	require.NoError(t, st.AddInstance("svc", "c1", store.Instance{ContainerRule: "canary"}))
+	return st
+}
+
+func ruleSnapshot(t *testing.T, st store.Store) map[string]store.ContainerRule {
+	svc, err := st.GetService("svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	return svc.ContainerRules
+}
+
+func runRollout(st store.Store, args ...string) error {
+	opts := &rolloutOpts{errorRates: &fakeErrorRater{}}
+	opts.wait = func(time.Duration) bool { return true }
+	opts.tapOutput()
+	return runOptsWithStore(opts, st, append([]string{"svc"}, args...))
+}
+
+func TestRolloutArgs(t *testing.T) {
+	st := rolloutStore(t)
+	require.Error(t, runRollout(st))
+	require.Error(t, runRollout(st, "--from", "stable"))
+	require.Error(t, runRollout(st, "--from", "stable", "--to", "stable"))
+	require.Error(t, runRollout(st, "--from", "stable", "--to", "nonesuch"))
+	require.Error(t, runRollout(st, "--from", "stable", "--to", "canary", "--steps", "50,25"))
+	require.Error(t, runRollout(st, "--from", "stable", "--to", "canary", "--steps", "10,200"))
+	require.Error(t, runOptsWithStore(&rolloutOpts{}, st, []string{"svc", "--from", "stable", "--to", "canary", "--prometheus", ""}))
+}
+
+func TestRollout(t *testing.T) {
+	st := rolloutStore(t)
+	rater := &fakeErrorRater{rates: []float64{0, 0.001, 0}}
+
+	var traffic []int
+	opts := &rolloutOpts{errorRates: rater}
+	opts.wait = func(time.Duration) bool {
+		traffic = append(traffic, ruleSnapshot(t, st)["canary"].Traffic)
+		return true
+	}
+	bout, _ := opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{
+		"svc", "--from", "stable", "--to", "canary", "--steps", "10,50,100"}))
+
+	require.Equal(t, []int{10, 50, 100}, traffic)
+	require.Equal(t, [][]string{{"c1"}, {"c1"}, {"c1"}}, rater.instances)
+	require.Contains(t, bout.String(), "complete")
+
+	final := ruleSnapshot(t, st)
+	require.Equal(t, 100, final["canary"].Traffic)
+	require.Equal(t, 0, final["stable"].Traffic)
+	require.Equal(t, store.Selector{"tag": "v1"}, final["stable"].Selector)
+
+	history, err := st.GetServiceHistory("svc")
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	require.Equal(t, "initial", history[0].Description)
+	require.Equal(t, 0, history[0].ContainerRules["canary"].Traffic)
+	require.Equal(t, "rollout stable to canary: 100%", history[3].Description)
+	require.Equal(t, final, history[3].ContainerRules)
+}
+
+func TestRolloutShare(t *testing.T) {
+	st := rolloutStore(t)
+	// Another rule keeps its share
+	require.NoError(t, st.SetContainerRule("svc", "other", store.ContainerRule{Selector: store.Selector{"tag": "v0"}, Traffic: 20}))
+
+	opts := &rolloutOpts{errorRates: &fakeErrorRater{rates: []float64{0}}}
+	opts.wait = func(time.Duration) bool { return true }
+	opts.tapOutput()
+	require.NoError(t, runOptsWithStore(opts, st, []string{
+		"svc", "--from", "stable", "--to", "canary", "--steps", "50"}))
+
+	final := ruleSnapshot(t, st)
+	require.Equal(t, 40, final["canary"].Traffic)
+	require.Equal(t, 40, final["stable"].Traffic)
+	require.Equal(t, 20, final["other"].Traffic)
+
+	// A rule sharing what is left over would be left with nothing
+	require.NoError(t, st.SetContainerRule("svc", "leftover", store.ContainerRule{Selector: store.Selector{"tag": "v4"}}))
+	err := runRollout(st, "--from", "canary", "--to", "stable", "--steps", "100")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `Rule "leftover"`)
+	require.Equal(t, final, withoutRule(ruleSnapshot(t, st), "leftover"))
+}
+
+func withoutRule(rules map[string]store.ContainerRule, ruleName string) map[string]store.ContainerRule {
+	delete(rules, ruleName)
+	return rules
+}
+
+func TestRolloutRevert(t *testing.T) {
+	st := rolloutStore(t)
+	before := ruleSnapshot(t, st)
+
+	// Too many errors at the second step
+	rater := &fakeErrorRater{rates: []float64{0, 0.2}}
+	opts := &rolloutOpts{errorRates: rater}
+	opts.wait = func(time.Duration) bool { return true }
+	bout, _ := opts.tapOutput()
+	err := runOptsWithStore(opts, st, []string{
+		"svc", "--from", "stable", "--to", "canary", "--steps", "10,50,100", "--max-error-rate", "0.05"})
+	require.Error(t, err)
+	require.Contains(t, bout.String(), "Error rate 20.00%")
+	require.Equal(t, before, ruleSnapshot(t, st))
+
+	history, err := st.GetServiceHistory("svc")
+	require.NoError(t, err)
+	require.Equal(t, "rollout stable to canary: reverted", history[len(history)-1].Description)
+
+	// Interrupting also reverts
+	opts = &rolloutOpts{errorRates: &fakeErrorRater{}}
+	opts.wait = func(time.Duration) bool { return false }
+	opts.tapOutput()
+	require.Error(t, runOptsWithStore(opts, st, []string{
+		"svc", "--from", "stable", "--to", "canary"}))
+	require.Equal(t, before, ruleSnapshot(t, st))
+}
+
+func TestRolloutNoRequests(t *testing.T) {
+	st := rolloutStore(t)
+	before := ruleSnapshot(t, st)
+
+	// Without requests there is no error rate to go on
+	opts := &rolloutOpts{errorRates: noRequestsRater{}}
+	opts.wait = func(time.Duration) bool { return true }
+	bout, _ := opts.tapOutput()
+	require.Error(t, runOptsWithStore(opts, st, []string{
+		"svc", "--from", "stable", "--to", "canary", "--steps", "50,100"}))
+	require.Contains(t, bout.String(), "Only 0 requests")
+	require.Equal(t, before, ruleSnapshot(t, st))
+
+	// Nor with fewer than the minimum
+	opts = &rolloutOpts{errorRates: &fakeErrorRater{rates: []float64{0}}}
+	opts.wait = func(time.Duration) bool { return true }
+	opts.tapOutput()
+	require.Error(t, runOptsWithStore(opts, st, []string{
+		"svc", "--from", "stable", "--to", "canary", "--min-requests", "5000"}))
+	require.Equal(t, before, ruleSnapshot(t, st))
+}
+
+func TestRolloutConflict(t *testing.T) {
+	st := rolloutStore(t)
+
+	// Someone else changes the rule during the rollout
+	opts := &rolloutOpts{errorRates: &fakeErrorRater{rates: []float64{0, 0}}}
+	opts.wait = func(time.Duration) bool {
+		require.NoError(t, st.SetContainerRule("svc", "canary", store.ContainerRule{Selector: store.Selector{"tag": "v3"}}))
+		return true
+	}
+	opts.tapOutput()
+	err := runOptsWithStore(opts, st, []string{
+		"svc", "--from", "stable", "--to", "canary", "--steps", "10,100"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "changed by someone else")
+	require.Equal(t, store.Selector{"tag": "v3"}, ruleSnapshot(t, st)["canary"].Selector)
+}
+
+func TestPromErrorRater(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/query", r.URL.Path)
+		q := r.URL.Query().Get("query")
+		queries = append(queries, q)
+		value := "200"
+		if strings.Contains(q, `code=~"5.."`) {
+			value = "5"
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1469000000.0,"%s"]}]}}`, value)
+	}))
+	defer srv.Close()
+
+	p := &promErrorRater{address: srv.URL}
+	errors, total, err := p.errorRate([]string{"a", "b"}, 2*time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 5.0, errors)
+	require.Equal(t, 200.0, total)
+	require.Contains(t, queries[1], `individual=~"a|b"`)
+	require.Contains(t, queries[1], "[120s]")
+
+	// No instances, no requests
+	errors, total, err = p.errorRate(nil, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, total)
+}
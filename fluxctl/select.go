@@ -4,13 +4,18 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+
+	"github.com/weaveworks/flux/common/store"
 )
 
 type selectOpts struct {
 	baseOpts
 	spec
+	ifVersion
 
 	instancePort int
+	weight       int
+	traffic      int
 }
 
 func (opts *selectOpts) makeCommand() *cobra.Command {
@@ -22,6 +27,9 @@ func (opts *selectOpts) makeCommand() *cobra.Command {
 	}
 	opts.addSpecVars(cmd)
 	cmd.Flags().IntVar(&opts.instancePort, "instance-port", 0, "use this instance port instead of the default for the service")
+	cmd.Flags().IntVar(&opts.weight, "weight", 0, fmt.Sprintf("the weight of the instances selected, relative to other instances; 0 means the default of %d. A container's %s label overrides this.", store.DefaultWeight, store.WeightLabel))
+	cmd.Flags().IntVar(&opts.traffic, "traffic", 0, "the percentage of the service's traffic to send to the instances selected, however many there are; 0 means share whatever other rules leave over")
+	opts.addIfVersionVar(cmd, "rule")
 	return cmd
 }
 
@@ -39,7 +47,7 @@ func (opts *selectOpts) run(_ *cobra.Command, args []string) error {
 	serviceName = args[0]
 
 	// Check that the service exists
-	err := opts.store.CheckRegisteredService(serviceName)
+	svc, err := opts.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true})
 	if err != nil {
 		return fmt.Errorf("Error fetching service: %s", err)
 	}
@@ -55,11 +63,54 @@ func (opts *selectOpts) run(_ *cobra.Command, args []string) error {
 	if opts.instancePort != 0 {
 		spec.InstancePort = opts.instancePort
 	}
+	if opts.weight < 0 {
+		return fmt.Errorf("The weight must not be negative")
+	}
+	spec.Weight = opts.weight
+
+	if opts.traffic < 0 || opts.traffic > 100 {
+		return fmt.Errorf("The traffic percentage must be between 0 and 100")
+	}
+	spec.Traffic = opts.traffic
+	if total := otherTraffic(svc, ruleName) + spec.Traffic; spec.Traffic > 0 && total > 100 {
+		return fmt.Errorf(`The rules of service "%s" would have %d%% of its traffic between them; reduce the traffic of this or other rules`, serviceName, total)
+	}
 
-	if err = opts.store.SetContainerRule(serviceName, ruleName, *spec); err != nil {
+	opts.recordInitialRevision(serviceName, svc)
+	if opts.conditional() {
+		err = opts.store.UpdateContainerRule(serviceName, ruleName, *spec, opts.version)
+		if err == store.ErrVersionConflict {
+			var current uint64
+			if info, err := opts.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true}); err == nil {
+				current = info.ContainerRuleVersions[ruleName]
+			}
+			return opts.conflictError(fmt.Sprintf(`Rule "%s" of service "%s"`, ruleName, serviceName), current)
+		}
+	} else {
+		err = opts.store.SetContainerRule(serviceName, ruleName, *spec)
+	}
+	if err != nil {
 		return fmt.Errorf("Error updating service: %s", err)
 	}
 
+	rules := copyRules(svc.ContainerRules)
+	rules[ruleName] = *spec
+	opts.recordRevision(serviceName, "select "+ruleName, svc.Service, rules)
+	if done, err := opts.printResult(serviceName); done || err != nil {
+		return err
+	}
 	fmt.Fprintln(opts.getStdout(), ruleName)
 	return nil
 }
+
+// The traffic percentage given to rules of the service other than the
+// one named
+func otherTraffic(svc *store.ServiceInfo, ruleName string) int {
+	total := 0
+	for name, rule := range svc.ContainerRules {
+		if name != ruleName {
+			total += rule.Traffic
+		}
+	}
+	return total
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -52,3 +53,80 @@ func TestSelect(t *testing.T) {
 	svc, err = st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
 	require.Len(t, svc.ContainerRules, 0)
 }
+
+func TestSelectIfVersion(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo-svc"})
+	require.NoError(t, err)
+
+	err = runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "--image", "foo/bar", "--if-version", "0",
+	})
+	require.NoError(t, err)
+
+	svc, err := st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	version := svc.ContainerRuleVersions[DEFAULT_RULE]
+	require.NotZero(t, version)
+
+	// Changed by someone else
+	require.NoError(t, st.SetContainerRule("foo-svc", DEFAULT_RULE,
+		store.ContainerRule{Selector: map[string]string{"image": "foo/baz"}}))
+	err = runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "--image", "foo/boo", "--if-version", fmt.Sprint(version),
+	})
+	require.Error(t, err)
+
+	svc, err = st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, "foo/baz", svc.ContainerRules[DEFAULT_RULE].Selector["image"])
+}
+
+func TestSelectWeight(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo-svc"})
+	require.NoError(t, err)
+
+	require.Error(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "canary", "--image", "foo/bar", "--tag", "new", "--weight", "-1",
+	}))
+
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "canary", "--image", "foo/bar", "--tag", "new", "--weight", "5",
+	}))
+	svc, err := st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, 5, svc.ContainerRules["canary"].Weight)
+}
+
+func TestSelectTraffic(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo-svc", "--image", "foo/bar"})
+	require.NoError(t, err)
+
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "canary", "--image", "foo/bar", "--tag", "new", "--traffic", "10",
+	}))
+	svc, err := st.GetService("foo-svc", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, 10, svc.ContainerRules["canary"].Traffic)
+	require.Equal(t, 0, svc.ContainerRules[DEFAULT_RULE].Traffic)
+
+	// Percentages out of range
+	require.Error(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "canary", "--image", "foo/bar", "--traffic", "101",
+	}))
+	require.Error(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "canary", "--image", "foo/bar", "--traffic", "-1",
+	}))
+
+	// The rules between them cannot have more than all the traffic
+	require.Error(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", DEFAULT_RULE, "--image", "foo/bar", "--traffic", "95",
+	}))
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", DEFAULT_RULE, "--image", "foo/bar", "--traffic", "90",
+	}))
+
+	// Replacing a rule does not count its old share
+	require.NoError(t, runOptsWithStore(&selectOpts{}, st, []string{
+		"foo-svc", "canary", "--image", "foo/bar", "--tag", "new", "--traffic", "5",
+	}))
+}
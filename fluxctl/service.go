@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -14,10 +16,37 @@ const DEFAULT_RULE = "default"
 type addOpts struct {
 	baseOpts
 	spec
+	ifVersion
 
 	address      string
 	instancePort int
 	protocol     string
+	strategy     string
+
+	healthCheck        string
+	healthPath         string
+	healthStatus       int
+	healthInterval     time.Duration
+	healthTimeout      time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	outlierDetection     bool
+	outlier5xx           int
+	outlierGatewayErrors int
+	maxEjectionPercent   int
+
+	retry        bool
+	maxRetries   int
+	retryMethods string
+	retryBudget  int
+	retryMaxBody int64
+
+	connectTimeout       time.Duration
+	idleTimeout          time.Duration
+	requestHeaderTimeout time.Duration
+	requestTimeout       time.Duration
+	drainTimeout         time.Duration
 }
 
 func (opts *addOpts) makeCommand() *cobra.Command {
@@ -29,8 +58,31 @@ func (opts *addOpts) makeCommand() *cobra.Command {
 	}
 	addCmd.Flags().StringVar(&opts.address, "address", "", "in the format <ipaddr>:<port>, the IP address and port at which the service should be made available on each host.")
 	addCmd.Flags().StringVarP(&opts.protocol, "protocol", "p", "", `the protocol to assume for connections to the service; either "http" or "tcp". Overrides the protocol given in --address if present.`)
+	addCmd.Flags().StringVar(&opts.strategy, "strategy", "", fmt.Sprintf(`how to choose an instance for each connection; one of %s. The default is "%s".`, quotedList(store.Strategies), store.StrategyRandom))
 	addCmd.Flags().IntVar(&opts.instancePort, "instance-port", 0, "port to use for instance addresses (if not the same as in the service address).")
+	addCmd.Flags().StringVar(&opts.healthCheck, "health-check", "", fmt.Sprintf(`check the health of instances; either "%s" to check that a connection can be made, or "%s" to check the response to a GET request. Unhealthy instances are given no connections.`, store.HealthCheckTCP, store.HealthCheckHTTP))
+	addCmd.Flags().StringVar(&opts.healthPath, "health-path", "", `the path to request in http health checks; "/" if not given.`)
+	addCmd.Flags().IntVar(&opts.healthStatus, "health-status", 0, "the status code expected from http health checks; if not given, any 2xx or 3xx status passes.")
+	addCmd.Flags().DurationVar(&opts.healthInterval, "health-interval", 0, fmt.Sprintf("how often to check each instance; %s if not given.", store.DefaultHealthCheckInterval))
+	addCmd.Flags().DurationVar(&opts.healthTimeout, "health-timeout", 0, fmt.Sprintf("how long to wait for a check to pass; %s if not given.", store.DefaultHealthCheckTimeout))
+	addCmd.Flags().IntVar(&opts.healthyThreshold, "healthy-threshold", 0, fmt.Sprintf("how many checks in a row an instance must pass to become healthy; %d if not given.", store.DefaultHealthyThreshold))
+	addCmd.Flags().IntVar(&opts.unhealthyThreshold, "unhealthy-threshold", 0, fmt.Sprintf("how many checks in a row an instance must fail to become unhealthy; %d if not given.", store.DefaultUnhealthyThreshold))
+	addCmd.Flags().BoolVar(&opts.outlierDetection, "outlier-detection", false, "stop sending requests to an instance for a while if it gives too many error responses in a row; only for http services. Implied by the other outlier options.")
+	addCmd.Flags().IntVar(&opts.outlier5xx, "outlier-5xx", 0, fmt.Sprintf("with outlier detection, how many 5xx responses in a row an instance may give before it is ejected; %d if not given.", store.DefaultConsecutive5xx))
+	addCmd.Flags().IntVar(&opts.outlierGatewayErrors, "outlier-gateway-errors", 0, fmt.Sprintf("with outlier detection, how many gateway errors (a 502, 503 or 504 status, or no response) in a row an instance may give before it is ejected; %d if not given.", store.DefaultConsecutiveGatewayErrors))
+	addCmd.Flags().IntVar(&opts.maxEjectionPercent, "max-ejection-percent", 0, fmt.Sprintf("with outlier detection, the most instances that may be ejected at once, as a percentage; %d if not given. One instance may always be ejected.", store.DefaultMaxEjectionPercent))
+	addCmd.Flags().BoolVar(&opts.retry, "retry", false, "send a request again to another instance if it gets no response, or a 502 or 503 status; only for http services, and only for GET and HEAD requests unless --retry-methods is given. Implied by the other retry options.")
+	addCmd.Flags().IntVar(&opts.maxRetries, "max-retries", 0, fmt.Sprintf("with retries, how many times a request may be retried; %d if not given.", store.DefaultMaxRetries))
+	addCmd.Flags().StringVar(&opts.retryMethods, "retry-methods", "", "with retries, other request methods that are safe to retry, given as a comma-delimited list (e.g., PUT,DELETE).")
+	addCmd.Flags().IntVar(&opts.retryBudget, "retry-budget", 0, fmt.Sprintf("with retries, the most retries to make, as a percentage of requests; %d if not given.", store.DefaultBudgetPercent))
+	addCmd.Flags().Int64Var(&opts.retryMaxBody, "retry-max-body", 0, fmt.Sprintf("with retries, the largest request body in bytes that will be kept so that the request can be retried; %d if not given.", store.DefaultMaxBodyBytes))
+	addCmd.Flags().DurationVar(&opts.connectTimeout, "connect-timeout", 0, "give up making a connection to an instance after this long, and treat the instance as failed; no timeout if not given.")
+	addCmd.Flags().DurationVar(&opts.idleTimeout, "idle-timeout", 0, "close a connection that has had no traffic for this long (for http services, no new request); no timeout if not given.")
+	addCmd.Flags().DurationVar(&opts.requestHeaderTimeout, "request-header-timeout", 0, "for http services, close a connection if the header of a request takes longer than this to arrive once it has started; no timeout if not given.")
+	addCmd.Flags().DurationVar(&opts.requestTimeout, "request-timeout", 0, "for http services, give up on a request if it and its response take longer than this, after the request header; no timeout if not given.")
+	addCmd.Flags().DurationVar(&opts.drainTimeout, "drain-timeout", 0, "close connections to a removed instance, or to an old service address, that are still active this long after it went away; if not given, they are left to finish.")
 	opts.addSpecVars(addCmd)
+	opts.addIfVersionVar(addCmd, "service")
 	return addCmd
 }
 
@@ -64,13 +116,54 @@ func (opts *addOpts) run(cmd *cobra.Command, args []string) error {
 	if opts.protocol != "" {
 		svc.Protocol = opts.protocol
 	}
+	if opts.strategy != "" {
+		if !validStrategy(opts.strategy) {
+			return fmt.Errorf(`Unknown load-balancing strategy "%s"; expected one of %s`, opts.strategy, quotedList(store.Strategies))
+		}
+		svc.Strategy = opts.strategy
+	}
+	if svc.HealthCheck, err = opts.makeHealthCheck(); err != nil {
+		return err
+	}
+	if svc.OutlierDetection, err = opts.makeOutlierDetection(); err != nil {
+		return err
+	}
+	if svc.Retries, err = opts.makeRetries(); err != nil {
+		return err
+	}
+	if svc.Timeouts, err = opts.makeTimeouts(); err != nil {
+		return err
+	}
 	if opts.instancePort == 0 && svc.Address != nil {
 		svc.InstancePort = svc.Address.Port()
 	} else {
 		svc.InstancePort = opts.instancePort
 	}
 
-	err = opts.store.AddService(serviceName, svc)
+	// The service as it was, if it existed.  With --if-version,
+	// the default rule is only written if it has not changed since
+	// it was read here, along with the service.
+	prior, err := opts.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true})
+	var ruleVersion uint64
+	if err != nil {
+		prior = nil
+	} else {
+		ruleVersion = prior.ContainerRuleVersions[DEFAULT_RULE]
+	}
+
+	opts.recordInitialRevision(serviceName, prior)
+	if opts.conditional() {
+		err = opts.store.UpdateService(serviceName, svc, opts.version)
+		if err == store.ErrVersionConflict {
+			var current uint64
+			if info, err := opts.store.GetService(serviceName, store.QueryServiceOptions{}); err == nil {
+				current = info.Version
+			}
+			return opts.conflictError(fmt.Sprintf(`Service "%s"`, serviceName), current)
+		}
+	} else {
+		err = opts.store.AddService(serviceName, svc)
+	}
 	if err != nil {
 		return fmt.Errorf("Error updating service: %s", err)
 	}
@@ -81,11 +174,175 @@ func (opts *addOpts) run(cmd *cobra.Command, args []string) error {
 	}
 
 	if spec != nil {
-		if err = opts.store.SetContainerRule(serviceName, DEFAULT_RULE, *spec); err != nil {
+		if opts.conditional() {
+			err = opts.store.UpdateContainerRule(serviceName, DEFAULT_RULE, *spec, ruleVersion)
+			if err == store.ErrVersionConflict {
+				var current uint64
+				if info, err := opts.store.GetService(serviceName, store.QueryServiceOptions{WithContainerRules: true}); err == nil {
+					current = info.ContainerRuleVersions[DEFAULT_RULE]
+				}
+				return opts.conflictError(fmt.Sprintf(`Rule "%s" of service "%s"`, DEFAULT_RULE, serviceName), current)
+			}
+		} else {
+			err = opts.store.SetContainerRule(serviceName, DEFAULT_RULE, *spec)
+		}
+		if err != nil {
 			return fmt.Errorf("Error updating service: %s", err)
 		}
 	}
 
+	rules := make(map[string]store.ContainerRule)
+	if prior != nil {
+		rules = copyRules(prior.ContainerRules)
+	}
+	if spec != nil {
+		rules[DEFAULT_RULE] = *spec
+	}
+	opts.recordRevision(serviceName, "service", svc, rules)
+	if done, err := opts.printResult(serviceName); done || err != nil {
+		return err
+	}
 	fmt.Fprintln(opts.getStdout(), serviceName)
 	return nil
 }
+
+func (opts *addOpts) makeHealthCheck() (*store.HealthCheck, error) {
+	if opts.healthCheck == "" {
+		if opts.healthPath != "" || opts.healthStatus != 0 || opts.healthInterval != 0 || opts.healthTimeout != 0 || opts.healthyThreshold != 0 || opts.unhealthyThreshold != 0 {
+			return nil, fmt.Errorf("Health check options need --health-check to say the type of check")
+		}
+		return nil, nil
+	}
+
+	check := &store.HealthCheck{
+		Type:               opts.healthCheck,
+		Path:               opts.healthPath,
+		Status:             opts.healthStatus,
+		Interval:           store.Duration(opts.healthInterval),
+		Timeout:            store.Duration(opts.healthTimeout),
+		HealthyThreshold:   opts.healthyThreshold,
+		UnhealthyThreshold: opts.unhealthyThreshold,
+	}
+	if err := check.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid health check: %s", err)
+	}
+	return check, nil
+}
+
+func (opts *addOpts) makeOutlierDetection() (*store.OutlierDetection, error) {
+	if !opts.outlierDetection && opts.outlier5xx == 0 && opts.outlierGatewayErrors == 0 && opts.maxEjectionPercent == 0 {
+		return nil, nil
+	}
+
+	od := &store.OutlierDetection{
+		Consecutive5xx:           opts.outlier5xx,
+		ConsecutiveGatewayErrors: opts.outlierGatewayErrors,
+		MaxEjectionPercent:       opts.maxEjectionPercent,
+	}
+	if err := od.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid outlier detection: %s", err)
+	}
+	return od, nil
+}
+
+func (opts *addOpts) makeRetries() (*store.RetryPolicy, error) {
+	if !opts.retry && opts.maxRetries == 0 && opts.retryMethods == "" && opts.retryBudget == 0 && opts.retryMaxBody == 0 {
+		return nil, nil
+	}
+
+	rp := &store.RetryPolicy{
+		MaxRetries:    opts.maxRetries,
+		BudgetPercent: opts.retryBudget,
+		MaxBodyBytes:  opts.retryMaxBody,
+	}
+	if opts.retryMethods != "" {
+		for _, method := range strings.Split(opts.retryMethods, ",") {
+			rp.Methods = append(rp.Methods, strings.ToUpper(strings.TrimSpace(method)))
+		}
+	}
+	if err := rp.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid retries: %s", err)
+	}
+	return rp, nil
+}
+
+func (opts *addOpts) makeTimeouts() (*store.Timeouts, error) {
+	if opts.connectTimeout == 0 && opts.idleTimeout == 0 && opts.requestHeaderTimeout == 0 && opts.requestTimeout == 0 && opts.drainTimeout == 0 {
+		return nil, nil
+	}
+
+	timeouts := &store.Timeouts{
+		Connect:       store.Duration(opts.connectTimeout),
+		Idle:          store.Duration(opts.idleTimeout),
+		RequestHeader: store.Duration(opts.requestHeaderTimeout),
+		Request:       store.Duration(opts.requestTimeout),
+		Drain:         store.Duration(opts.drainTimeout),
+	}
+	if err := timeouts.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid timeouts: %s", err)
+	}
+	return timeouts, nil
+}
+
+// A one-line summary of the timeouts given
+func describeTimeouts(timeouts *store.Timeouts) string {
+	var descs []string
+	for _, t := range []struct {
+		name    string
+		timeout store.Duration
+	}{
+		{"connect", timeouts.Connect},
+		{"idle", timeouts.Idle},
+		{"request header", timeouts.RequestHeader},
+		{"request", timeouts.Request},
+		{"drain", timeouts.Drain},
+	} {
+		if t.timeout != 0 {
+			descs = append(descs, fmt.Sprintf("%s %s", t.name, t.timeout))
+		}
+	}
+	return strings.Join(descs, ", ")
+}
+
+// A one-line summary of retries, with defaults filled in
+func describeRetries(retries *store.RetryPolicy) string {
+	rp := retries.WithDefaults()
+	methods := append([]string{"GET", "HEAD"}, rp.Methods...)
+	return fmt.Sprintf("up to %d times for %s, within %d%% of requests, with bodies up to %d bytes", rp.MaxRetries, strings.Join(methods, ","), rp.BudgetPercent, rp.MaxBodyBytes)
+}
+
+// A one-line summary of outlier detection, with defaults filled in
+func describeOutlierDetection(outliers *store.OutlierDetection) string {
+	od := outliers.WithDefaults()
+	return fmt.Sprintf("eject after %d 5xx or %d gateway errors in a row, up to %d%% of instances", od.Consecutive5xx, od.ConsecutiveGatewayErrors, od.MaxEjectionPercent)
+}
+
+// A one-line summary of a health check, with defaults filled in
+func describeHealthCheck(check *store.HealthCheck) string {
+	hc := check.WithDefaults()
+	desc := hc.Type
+	if hc.Type == store.HealthCheckHTTP {
+		desc += " GET " + hc.Path
+		if hc.Status != 0 {
+			desc += fmt.Sprintf(" expecting %d", hc.Status)
+		}
+	}
+	return fmt.Sprintf("%s every %s, timeout %s, healthy after %d, unhealthy after %d", desc, hc.Interval, hc.Timeout, hc.HealthyThreshold, hc.UnhealthyThreshold)
+}
+
+func validStrategy(strategy string) bool {
+	for _, s := range store.Strategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+func quotedList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = `"` + item + `"`
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -51,6 +53,86 @@ func TestServiceAddress(t *testing.T) {
 	require.Equal(t, 7777, services["foo"].InstancePort)
 }
 
+func TestServiceStrategy(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo", "--strategy", store.StrategyLeastConn})
+	require.NoError(t, err)
+	require.Equal(t, store.StrategyLeastConn, allServices(t, st)["foo"].Strategy)
+
+	st, err = runOpts(&addOpts{}, []string{"foo", "--strategy", "fastest"})
+	require.Error(t, err)
+	require.Empty(t, allServices(t, st))
+}
+
+func TestServiceHealthCheck(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo", "--health-check", "http",
+		"--health-path", "/health", "--health-interval", "5s", "--unhealthy-threshold", "4"})
+	require.NoError(t, err)
+	require.Equal(t, &store.HealthCheck{
+		Type:               store.HealthCheckHTTP,
+		Path:               "/health",
+		Interval:           store.Duration(5 * time.Second),
+		UnhealthyThreshold: 4,
+	}, allServices(t, st)["foo"].HealthCheck)
+
+	for _, args := range [][]string{
+		{"foo", "--health-check", "ping"},
+		{"foo", "--health-check", "tcp", "--health-path", "/health"},
+		{"foo", "--health-check", "http", "--health-path", "health"},
+		{"foo", "--health-check", "tcp", "--healthy-threshold", "-1"},
+		{"foo", "--health-path", "/health"},
+	} {
+		st, err = runOpts(&addOpts{}, args)
+		require.Error(t, err, "%v", args)
+		require.Empty(t, allServices(t, st))
+	}
+}
+
+func TestServiceOutlierDetection(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo", "--outlier-detection"})
+	require.NoError(t, err)
+	require.Equal(t, &store.OutlierDetection{}, allServices(t, st)["foo"].OutlierDetection)
+
+	st, err = runOpts(&addOpts{}, []string{"foo", "--outlier-5xx", "10", "--max-ejection-percent", "20"})
+	require.NoError(t, err)
+	require.Equal(t, &store.OutlierDetection{Consecutive5xx: 10, MaxEjectionPercent: 20}, allServices(t, st)["foo"].OutlierDetection)
+
+	st, err = runOpts(&addOpts{}, []string{"foo", "--max-ejection-percent", "120"})
+	require.Error(t, err)
+	require.Empty(t, allServices(t, st))
+}
+
+func TestServiceRetries(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo", "--retry"})
+	require.NoError(t, err)
+	require.Equal(t, &store.RetryPolicy{}, allServices(t, st)["foo"].Retries)
+
+	st, err = runOpts(&addOpts{}, []string{"foo", "--retry-methods", "put, delete", "--max-retries", "1"})
+	require.NoError(t, err)
+	require.Equal(t, &store.RetryPolicy{Methods: []string{"PUT", "DELETE"}, MaxRetries: 1}, allServices(t, st)["foo"].Retries)
+
+	st, err = runOpts(&addOpts{}, []string{"foo", "--retry-methods", "PUT,,DELETE"})
+	require.Error(t, err)
+	require.Empty(t, allServices(t, st))
+}
+
+func TestServiceTimeouts(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo", "--connect-timeout", "2s", "--request-timeout", "1m"})
+	require.NoError(t, err)
+	require.Equal(t, &store.Timeouts{
+		Connect: store.Duration(2 * time.Second),
+		Request: store.Duration(time.Minute),
+	}, allServices(t, st)["foo"].Timeouts)
+	require.Equal(t, "connect 2s, request 1m0s", describeTimeouts(allServices(t, st)["foo"].Timeouts))
+
+	st, err = runOpts(&addOpts{}, []string{"foo", "--drain-timeout", "30s"})
+	require.NoError(t, err)
+	require.Equal(t, &store.Timeouts{Drain: store.Duration(30 * time.Second)}, allServices(t, st)["foo"].Timeouts)
+
+	st, err = runOpts(&addOpts{}, []string{"foo", "--idle-timeout", "-1s"})
+	require.Error(t, err)
+	require.Empty(t, allServices(t, st))
+}
+
 func TestServiceSelect(t *testing.T) {
 	st, err := runOpts(&addOpts{}, []string{
 		"svc", "--image", "repo/image",
@@ -68,3 +150,61 @@ func TestServiceSelect(t *testing.T) {
 		},
 	}, specs[DEFAULT_RULE])
 }
+
+func TestServiceIfVersion(t *testing.T) {
+	// Version 0 means the service must not exist yet
+	st, err := runOpts(&addOpts{}, []string{"foo", "--if-version", "0"})
+	require.NoError(t, err)
+	err = runOptsWithStore(&addOpts{}, st, []string{"foo", "--if-version", "0"})
+	require.Error(t, err)
+
+	svc, err := st.GetService("foo", store.QueryServiceOptions{})
+	require.NoError(t, err)
+	version := fmt.Sprint(svc.Version)
+
+	err = runOptsWithStore(&addOpts{}, st, []string{
+		"foo", "--if-version", version, "--instance-port", "8080"})
+	require.NoError(t, err)
+
+	// Someone else has changed it in the meantime
+	conflict := runOptsWithStore(&addOpts{}, st, []string{
+		"foo", "--if-version", version, "--instance-port", "9090"})
+	require.Error(t, conflict)
+	svc, err = st.GetService("foo", store.QueryServiceOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 8080, svc.InstancePort)
+	require.Contains(t, conflict.Error(),
+		fmt.Sprintf("--if-version=%d", svc.Version))
+}
+
+// A store in which someone else selects containers for the default
+// rule just after each service update
+type racingRuleStore struct {
+	store.Store
+}
+
+func (st racingRuleStore) UpdateService(name string, svc store.Service, version uint64) error {
+	if err := st.Store.UpdateService(name, svc, version); err != nil {
+		return err
+	}
+	return st.Store.SetContainerRule(name, DEFAULT_RULE, store.ContainerRule{
+		Selector: map[string]string{"image": "someone/else"},
+	})
+}
+
+func TestServiceIfVersionRule(t *testing.T) {
+	st, err := runOpts(&addOpts{}, []string{"foo", "--image", "foo/bar"})
+	require.NoError(t, err)
+	svc, err := st.GetService("foo", store.QueryServiceOptions{})
+	require.NoError(t, err)
+
+	// The default rule is not overwritten when it has changed
+	conflict := runOptsWithStore(&addOpts{}, racingRuleStore{st}, []string{
+		"foo", "--if-version", fmt.Sprint(svc.Version), "--image", "foo/baz"})
+	require.Error(t, conflict)
+	require.Contains(t, conflict.Error(), DEFAULT_RULE)
+	svc, err = st.GetService("foo", store.QueryServiceOptions{WithContainerRules: true})
+	require.NoError(t, err)
+	require.Equal(t, "someone/else",
+		svc.ContainerRules[DEFAULT_RULE].Selector["image"])
+}
@@ -1,23 +1,28 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"os/user"
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/weaveworks/flux/common/store"
 )
 
 type commandOpts interface {
 	setStore(store.Store)
+	setOutput(*string)
 	makeCommand() *cobra.Command
 	redirect(io.Writer, io.Writer)
 }
 
 type baseOpts struct {
 	store  store.Store
+	output *string
 	stdout io.Writer
 	stderr io.Writer
 }
@@ -26,6 +31,10 @@ func (cmd *baseOpts) setStore(st store.Store) {
 	cmd.store = st
 }
 
+func (cmd *baseOpts) setOutput(output *string) {
+	cmd.output = output
+}
+
 func (cmd *baseOpts) redirect(stdout io.Writer, stderr io.Writer) {
 	cmd.stdout = stdout
 	cmd.stderr = stderr
@@ -45,6 +54,50 @@ func (cmd *baseOpts) getStdout() io.Writer {
 	return os.Stdout
 }
 
+// Record the configuration of a service before changing it, if
+// nothing has been recorded for it yet.  info is the service as read
+// before the change, or nil if it did not exist.
+func (cmd *baseOpts) recordInitialRevision(serviceName string, info *store.ServiceInfo) {
+	if info == nil {
+		return
+	}
+	if err := store.RecordInitialRevision(cmd.store, serviceName, info); err != nil {
+		fmt.Fprintf(cmd.getStderr(), "Warning: unable to record initial revision of service %s: %s\n", serviceName, err)
+	}
+}
+
+// Record the configuration of a service in its history, having
+// changed it to that.  The change has been made by this point, so
+// failing to record it is only worth a warning.
+func (cmd *baseOpts) recordRevision(serviceName, description string, svc store.Service, rules map[string]store.ContainerRule) {
+	if err := store.RecordServiceRevision(cmd.store, serviceName, author(), description, svc, rules); err != nil {
+		fmt.Fprintf(cmd.getStderr(), "Warning: unable to record revision of service %s: %s\n", serviceName, err)
+	}
+}
+
+// A copy of the rules given, to make changes to
+func copyRules(rules map[string]store.ContainerRule) map[string]store.ContainerRule {
+	res := make(map[string]store.ContainerRule)
+	for name, rule := range rules {
+		res[name] = rule
+	}
+	return res
+}
+
+// Who to record as having made changes
+func author() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+
+	return name
+}
+
 type selector struct {
 	env    string
 	labels string
@@ -106,3 +159,23 @@ func (opts *spec) makeSpec() (*store.ContainerRule, error) {
 		return nil, nil
 	}
 }
+
+// For making an update conditional on the version of the thing being
+// updated, so that concurrent changes aren't silently overwritten.
+type ifVersion struct {
+	version     uint64
+	versionFlag *pflag.Flag
+}
+
+func (opts *ifVersion) addIfVersionVar(cmd *cobra.Command, what string) {
+	cmd.Flags().Uint64Var(&opts.version, "if-version", 0, fmt.Sprintf("only update if the %s is still at this version, as shown by 'fluxctl info'; 0 means only if it does not exist yet", what))
+	opts.versionFlag = cmd.Flags().Lookup("if-version")
+}
+
+func (opts *ifVersion) conditional() bool {
+	return opts.versionFlag != nil && opts.versionFlag.Changed
+}
+
+func (opts *ifVersion) conflictError(what string, current uint64) error {
+	return fmt.Errorf("%s has been changed by someone else; it is at version %d, not %d. Check the changes, and retry with --if-version=%d to overwrite them", what, current, opts.version, current)
+}
@@ -24,6 +24,12 @@ func (opts *versionOpts) run(_ *cobra.Command, args []string) error {
 	if len(args) > 0 {
 		return fmt.Errorf("Unexpected arguments: %s", args)
 	}
+	if done, err := opts.printStructured(versionOutput{
+		Version:  version.Version(),
+		Revision: version.Revision(),
+	}); done || err != nil {
+		return err
+	}
 	fmt.Fprintln(opts.getStdout(), version.Banner())
 	return nil
 }
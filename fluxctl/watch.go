@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/flux/common/daemon"
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+type watchOpts struct {
+	baseOpts
+
+	service string
+	hosts   bool
+}
+
+func (opts *watchOpts) makeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "print changes to services and instances as they happen",
+		Long:  "Print a line for each change to services, their rules and their instances, until interrupted. With --hosts, also print hosts arriving and departing. With --output=json, each change is printed as a JSON object on its own line; with --output=yaml, as a YAML document.",
+		RunE:  opts.run,
+	}
+	cmd.Flags().StringVarP(&opts.service, "service", "s", "", "print only changes to <service>")
+	cmd.Flags().BoolVar(&opts.hosts, "hosts", false, "also print hosts arriving and departing")
+	return cmd
+}
+
+// A change seen while watching
+type watchEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Service  string    `json:"service,omitempty"`
+	Rule     string    `json:"rule,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+func (ev watchEvent) String() string {
+	var subject string
+	switch {
+	case ev.Rule != "":
+		subject = ev.Service + "/" + ev.Rule
+	case ev.Instance != "":
+		subject = ev.Service + "/" + ev.Instance
+	case ev.Service != "":
+		subject = ev.Service
+	default:
+		subject = ev.Host
+	}
+
+	s := fmt.Sprintf("%s %s %s", ev.Time.Format(time.RFC3339), ev.Event, subject)
+	if ev.Detail != "" {
+		s += " " + ev.Detail
+	}
+	return s
+}
+
+func (opts *watchOpts) run(_ *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Expected no arguments")
+	}
+
+	format, err := opts.outputFormat()
+	if err != nil {
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	// The changes are worked out on the watch's goroutine, and
+	// printed on this one
+	events := make(chan []watchEvent)
+	var services map[string]*store.ServiceInfo
+	watchErrs := daemon.NewErrorSink()
+	watch := store.WatchServicesIndirectStartFunc(opts.store, 5*time.Second,
+		store.QueryServiceOptions{WithInstances: true, WithContainerRules: true},
+		func(update store.ServiceUpdate, stop <-chan struct{}) {
+			evs := opts.processUpdate(&services, update, time.Now())
+			if len(evs) > 0 {
+				select {
+				case events <- evs:
+				case <-stop:
+				}
+			}
+		})(watchErrs)
+	defer watch.Stop()
+
+	hostChanges := make(chan store.HostChange)
+	hostErrs := daemon.NewErrorSink()
+	if opts.hosts {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		opts.store.WatchHosts(ctx, hostChanges, hostErrs)
+	}
+
+	for {
+		select {
+		case evs := <-events:
+			for _, ev := range evs {
+				if err := opts.printEvent(format, ev); err != nil {
+					return err
+				}
+			}
+
+		case change := <-hostChanges:
+			ev := watchEvent{Time: time.Now(), Event: "host arrived", Host: change.Name}
+			if change.HostDeparted {
+				ev.Event = "host departed"
+			}
+			if err := opts.printEvent(format, ev); err != nil {
+				return err
+			}
+
+		case err := <-watchErrs:
+			return err
+		case err := <-hostErrs:
+			return fmt.Errorf("Error watching hosts: %s", err)
+
+		case <-sigs:
+			return nil
+		}
+	}
+}
+
+func (opts *watchOpts) printEvent(format string, ev watchEvent) error {
+	out := opts.getStdout()
+	switch format {
+	case OUTPUT_JSON:
+		return json.NewEncoder(out).Encode(ev)
+	case OUTPUT_YAML:
+		bytes, err := marshalYAML(ev)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "---\n%s", bytes)
+		return err
+	default:
+		_, err := fmt.Fprintln(out, ev)
+		return err
+	}
+}
+
+// Apply an update to the snapshot of services, and return the events
+// describing how the snapshot changed.  The first update establishes
+// the snapshot, so produces no events.
+func (opts *watchOpts) processUpdate(services *map[string]*store.ServiceInfo, update store.ServiceUpdate, t time.Time) []watchEvent {
+	var evs []watchEvent
+	first := *services == nil
+	if first {
+		*services = make(map[string]*store.ServiceInfo)
+	}
+
+	updated := update.Services
+	if update.Reset {
+		// Anything not in the reset has gone away
+		updated = make(map[string]*store.ServiceInfo)
+		for name := range *services {
+			updated[name] = nil
+		}
+		for name, svc := range update.Services {
+			updated[name] = svc
+		}
+	}
+
+	for _, name := range sortedKeys(updated) {
+		if opts.service != "" && name != opts.service {
+			continue
+		}
+
+		svc := updated[name]
+		if !first {
+			evs = append(evs, diffService(t, name, (*services)[name], svc)...)
+		}
+		if svc != nil {
+			(*services)[name] = svc
+		} else {
+			delete(*services, name)
+		}
+	}
+
+	return evs
+}
+
+// Describe the differences between two snapshots of a service, either
+// of which may be nil
+func diffService(t time.Time, name string, prev, cur *store.ServiceInfo) []watchEvent {
+	var evs []watchEvent
+	event := func(ev watchEvent) {
+		ev.Time = t
+		ev.Service = name
+		evs = append(evs, ev)
+	}
+
+	switch {
+	case prev == nil && cur == nil:
+		return nil
+	case cur == nil:
+		event(watchEvent{Event: "service removed"})
+		return evs
+	case prev == nil:
+		event(watchEvent{Event: "service added", Detail: addressString(cur.Address)})
+		prev = &store.ServiceInfo{}
+	default:
+		if !sameJSON(prev.Address, cur.Address) {
+			event(watchEvent{Event: "address changed", Detail: addressString(cur.Address)})
+		}
+		if prev.InstancePort != cur.InstancePort || prev.Protocol != cur.Protocol || prev.Strategy != cur.Strategy || !sameJSON(prev.HealthCheck, cur.HealthCheck) || !sameJSON(prev.OutlierDetection, cur.OutlierDetection) || !sameJSON(prev.Retries, cur.Retries) || !sameJSON(prev.Timeouts, cur.Timeouts) {
+			event(watchEvent{Event: "service changed"})
+		}
+	}
+
+	for _, rule := range sortedKeys(prev.ContainerRules) {
+		if _, found := cur.ContainerRules[rule]; !found {
+			event(watchEvent{Event: "rule removed", Rule: rule})
+		}
+	}
+	for _, rule := range sortedKeys(cur.ContainerRules) {
+		prevRule, found := prev.ContainerRules[rule]
+		switch {
+		case !found:
+			event(watchEvent{Event: "rule added", Rule: rule})
+		case !sameJSON(prevRule, cur.ContainerRules[rule]):
+			event(watchEvent{Event: "rule changed", Rule: rule})
+		}
+	}
+
+	for _, inst := range sortedKeys(prev.Instances) {
+		if _, found := cur.Instances[inst]; !found {
+			event(watchEvent{Event: "instance removed", Instance: inst})
+		}
+	}
+	for _, inst := range sortedKeys(cur.Instances) {
+		prevInst, found := prev.Instances[inst]
+		curInst := cur.Instances[inst]
+		detail := strings.TrimSpace(addressString(curInst.Address) + " " + curInst.Label(store.StateLabel))
+		switch {
+		case !found:
+			event(watchEvent{Event: "instance added", Instance: inst, Detail: detail})
+		case !sameJSON(prevInst.Address, curInst.Address) || prevInst.Label(store.StateLabel) != curInst.Label(store.StateLabel) || prevInst.Weight != curInst.Weight:
+			event(watchEvent{Event: "instance changed", Instance: inst, Detail: detail})
+		}
+	}
+
+	return evs
+}
+
+func addressString(addr *netutil.IPPort) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
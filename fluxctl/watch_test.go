@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/flux/common/netutil"
+	"github.com/weaveworks/flux/common/store"
+)
+
+func eventStrings(evs []watchEvent) []string {
+	var res []string
+	for _, ev := range evs {
+		s := ev.String()
+		// Drop the timestamp
+		res = append(res, s[strings.Index(s, " ")+1:])
+	}
+	return res
+}
+
+func TestWatchProcessUpdate(t *testing.T) {
+	opts := &watchOpts{}
+	var services map[string]*store.ServiceInfo
+	now := time.Now()
+
+	foo := &store.ServiceInfo{
+		Service: store.Service{Address: netutil.ParseIPPortPtr("10.3.4.5:80")},
+		ContainerRules: map[string]store.ContainerRule{
+			"default": {Selector: map[string]string{"image": "foo"}},
+		},
+		Instances: map[string]store.Instance{
+			"a": {Address: netutil.ParseIPPortPtr("192.168.0.1:8080")},
+		},
+	}
+
+	// The initial state produces no events
+	require.Empty(t, opts.processUpdate(&services, store.ServiceUpdate{
+		Services: map[string]*store.ServiceInfo{"foo": foo},
+		Reset:    true,
+	}, now))
+
+	foo2 := &store.ServiceInfo{
+		Service: store.Service{Address: netutil.ParseIPPortPtr("10.3.4.6:80")},
+		ContainerRules: map[string]store.ContainerRule{
+			"default": {Selector: map[string]string{"image": "foo", "tag": "v2"}},
+			"canary":  {Selector: map[string]string{"image": "foo"}},
+		},
+		Instances: map[string]store.Instance{
+			"a": {},
+			"b": {Address: netutil.ParseIPPortPtr("192.168.0.2:8080")},
+		},
+	}
+	require.Equal(t, []string{
+		"address changed foo 10.3.4.6:80",
+		"rule added foo/canary",
+		"rule changed foo/default",
+		"instance changed foo/a no address",
+		"instance added foo/b 192.168.0.2:8080 live",
+	}, eventStrings(opts.processUpdate(&services, store.ServiceUpdate{
+		Services: map[string]*store.ServiceInfo{"foo": foo2},
+	}, now)))
+
+	require.Equal(t, []string{
+		"service added bar",
+	}, eventStrings(opts.processUpdate(&services, store.ServiceUpdate{
+		Services: map[string]*store.ServiceInfo{"bar": {}},
+	}, now)))
+
+	// A reset that lacks a service means it has gone
+	require.Equal(t, []string{
+		"service removed bar",
+		"instance removed foo/b",
+	}, eventStrings(opts.processUpdate(&services, store.ServiceUpdate{
+		Services: map[string]*store.ServiceInfo{"foo": {
+			Service:        foo2.Service,
+			ContainerRules: foo2.ContainerRules,
+			Instances:      map[string]store.Instance{"a": {}},
+		}},
+		Reset: true,
+	}, now)))
+}
+
+func TestWatchOnlyService(t *testing.T) {
+	opts := &watchOpts{service: "foo"}
+	var services map[string]*store.ServiceInfo
+	now := time.Now()
+
+	require.Empty(t, opts.processUpdate(&services, store.ServiceUpdate{Reset: true}, now))
+	require.Empty(t, opts.processUpdate(&services, store.ServiceUpdate{
+		Services: map[string]*store.ServiceInfo{"bar": {}},
+	}, now))
+	require.Len(t, opts.processUpdate(&services, store.ServiceUpdate{
+		Services: map[string]*store.ServiceInfo{"foo": {}},
+	}, now), 1)
+}
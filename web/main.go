@@ -113,6 +113,7 @@ type serviceInfo struct {
 	Address        *ipPort             `json:"address,omitempty"`
 	InstancePort   int                 `json:"instancePort,omitempty"`
 	Protocol       string              `json:"protocol,omitempty"`
+	Strategy       string              `json:"strategy,omitempty"`
 	Instances      []instanceInfo      `json:"instances,omitempty"`
 	ContainerRules []containerRuleInfo `json:"groups,omitempty"`
 }
@@ -123,6 +124,7 @@ type instanceInfo struct {
 	ContainerRule string            `json:"containerRule"`
 	Address       *ipPort           `json:"address,omitempty"`
 	Labels        map[string]string `json:"labels"`
+	Weight        int               `json:"weight,omitempty"`
 }
 
 type containerRuleInfo struct {
@@ -139,6 +141,7 @@ func wrapServiceInfo(name string, si *store.ServiceInfo) serviceInfo {
 			ContainerRule: inst.ContainerRule,
 			Address:       wrapIPPort(inst.Address),
 			Labels:        inst.Labels,
+			Weight:        inst.Weight,
 		})
 	}
 
@@ -155,6 +158,7 @@ func wrapServiceInfo(name string, si *store.ServiceInfo) serviceInfo {
 		Address:        wrapIPPort(si.Address),
 		InstancePort:   si.InstancePort,
 		Protocol:       si.Protocol,
+		Strategy:       si.Strategy,
 		Instances:      insts,
 		ContainerRules: rules,
 	}